@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const caPathV1 = "/api/v1/ca"
+
+// MediaTypeCRL is the media type of a DER encoded certificate revocation list.
+const MediaTypeCRL = "application/pkix-crl"
+
+// CAV1 dispatches the routes of the certificate authority below /api/v1/ca:
+//
+//	GET /ca/certificates   downloads the intermediate and root certificates as PEM
+//	GET /ca/crl            downloads the certificate revocation list, DER encoded or PEM if requested
+func (s *Server) CAV1(response http.ResponseWriter, request *http.Request) {
+	switch strings.Trim(strings.TrimPrefix(request.URL.Path, caPathV1), "/") {
+	case "certificates":
+		if allowMethods(response, request, http.MethodGet) {
+			s.caCertificatesV1(response, request)
+		}
+	case "crl":
+		if allowMethods(response, request, http.MethodGet) {
+			s.crlV1(response, request)
+		}
+	default:
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			http.StatusText(http.StatusNotFound),
+		})
+	}
+}
+
+// caCertificatesV1 writes the certificates of the certificate authority, the intermediate one first.
+func (s *Server) caCertificatesV1(response http.ResponseWriter, request *http.Request) {
+	chain, err := s.signatureService.CertificateChain()
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteContentResponse(response, http.StatusOK, MediaTypePEM, encodeCertificates(chain...))
+}
+
+// crlV1 writes the certificate revocation list in the format negotiated through the Accept header.
+func (s *Server) crlV1(response http.ResponseWriter, request *http.Request) {
+	mediaType, ok := negotiateMediaType(request.Header.Get("Accept"), MediaTypeCRL, MediaTypePEM)
+	if !ok {
+		WriteErrorResponse(response, http.StatusNotAcceptable, []string{
+			http.StatusText(http.StatusNotAcceptable),
+		})
+		return
+	}
+
+	crl, err := s.signatureService.CRL(request.Context())
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	if mediaType == MediaTypePEM {
+		crl = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+	}
+	WriteContentResponse(response, http.StatusOK, mediaType, crl)
+}
+
+// certificateV1 handles the certificate of a device.
+func (s *Server) certificateV1(response http.ResponseWriter, request *http.Request, id string) {
+	switch request.Method {
+	case http.MethodGet:
+		s.downloadCertificateV1(response, request, id)
+	case http.MethodPost:
+		certificate, err := s.signatureService.IssueCertificate(request.Context(), id)
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		response.Header().Set("Location", devicesPathV1+"/"+id+"/certificate?key_version="+strconv.Itoa(certificate.KeyVersion))
+		s.writeCertificate(response, http.StatusCreated, certificate)
+	default:
+		allowMethods(response, request, http.MethodGet, http.MethodPost)
+	}
+}
+
+// downloadCertificateV1 writes the certificate of a device key selected by the optional key_version query
+// parameter. It defaults to a PEM bundle of the certificate and its chain, application/json gives the
+// certificate with its details.
+func (s *Server) downloadCertificateV1(response http.ResponseWriter, request *http.Request, id string) {
+	mediaType, ok := negotiateMediaType(request.Header.Get("Accept"), MediaTypePEM, "application/json")
+	if !ok {
+		WriteErrorResponse(response, http.StatusNotAcceptable, []string{
+			http.StatusText(http.StatusNotAcceptable),
+		})
+		return
+	}
+
+	var keyVersion int
+	if value := request.URL.Query().Get("key_version"); value != "" {
+		var err error
+		keyVersion, err = strconv.Atoi(value)
+		if err != nil || keyVersion < 1 {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{
+				"key_version must be a positive integer",
+			})
+			return
+		}
+	}
+
+	certificate, err := s.signatureService.GetCertificate(request.Context(), id, keyVersion)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	if mediaType == MediaTypePEM {
+		chain, err := s.signatureService.CertificateChain()
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		WriteContentResponse(response, http.StatusOK, MediaTypePEM, encodeCertificates(append([][]byte{certificate.Certificate}, chain...)...))
+		return
+	}
+	s.writeCertificate(response, http.StatusOK, certificate)
+}
+
+// revokeCertificateV1 revokes the certificate of the current key of a device. The request body with a reason is optional.
+func (s *Server) revokeCertificateV1(response http.ResponseWriter, request *http.Request, id string) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+	var data domain.RevokeCertificateRequest
+	if len(body) > 0 && json.Unmarshal(body, &data) != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"failed to parse JSON body",
+		})
+		return
+	}
+
+	certificate, err := s.signatureService.RevokeCertificate(request.Context(), id, data.Reason)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	s.writeCertificate(response, http.StatusOK, certificate)
+}
+
+// writeCertificate writes a device certificate with its chain as a JSON API response.
+func (s *Server) writeCertificate(response http.ResponseWriter, code int, certificate *domain.DeviceCertificate) {
+	certificateResponse, err := s.signatureService.CertificateResponse(certificate)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteAPIResponse(response, code, certificateResponse)
+}
+
+// encodeCertificates concatenates the DER encoded certificates as "CERTIFICATE" PEM blocks.
+func encodeCertificates(certificates ...[]byte) []byte {
+	var bundle []byte
+	for _, der := range certificates {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return bundle
+}
+
+// negotiateMediaType picks the first of the supported media types accepted by an Accept header,
+// the first supported one is the default.
+func negotiateMediaType(accept string, supported ...string) (string, bool) {
+	if accept == "" {
+		return supported[0], true
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return supported[0], true
+		}
+		for _, candidate := range supported {
+			if mediaType == candidate {
+				return candidate, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newCertificateTestServer(t *testing.T) http.Handler {
+	ca, err := crypto.OpenCertificateAuthority(crypto.CertificateAuthorityConfig{})
+	assert.NoError(t, err)
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage(), domain.WithCertificateAuthority(ca))
+	return NewServer("http://localhost", ":8080", service).Handler()
+}
+
+// decodeCertificates parses the certificates of a PEM bundle.
+func decodeCertificates(t *testing.T, bundle []byte) []*x509.Certificate {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certificates
+		}
+		assert.Equal(t, "CERTIFICATE", block.Type)
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		assert.NoError(t, err)
+		certificates = append(certificates, certificate)
+	}
+}
+
+func TestV1Certificate(t *testing.T) {
+	handler := newCertificateTestServer(t)
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC", "label": "Till 1"}`, &device)
+	certificatePath := "/api/v1/devices/" + device.ID + "/certificate"
+
+	rr := requestV1(t, handler, http.MethodGet, certificatePath, "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypePEM, rr.Header().Get("Content-Type"))
+	chain := decodeCertificates(t, rr.Body.Bytes())
+	if assert.Len(t, chain, 3) {
+		assert.Equal(t, "Till 1", chain[0].Subject.CommonName)
+		assert.Equal(t, device.ID, chain[0].Subject.SerialNumber)
+		assert.NoError(t, chain[0].CheckSignatureFrom(chain[1]))
+		assert.NoError(t, chain[1].CheckSignatureFrom(chain[2]))
+	}
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/ca/certificates", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, chain[1:], decodeCertificates(t, rr.Body.Bytes()))
+
+	req := httptest.NewRequest(http.MethodGet, certificatePath+"?key_version=1", nil)
+	req.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var certificate domain.DeviceCertificateResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &Response{Data: &certificate}))
+	assert.Equal(t, 1, certificate.KeyVersion)
+	assert.Equal(t, chain[0].SerialNumber.Text(16), certificate.SerialNumber)
+	assert.Len(t, certificate.Chain, 2)
+
+	rr = requestV1(t, handler, http.MethodGet, certificatePath+"?key_version=2", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodGet, certificatePath+"?key_version=first", "", nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, certificatePath, "", nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = requestV1(t, handler, http.MethodDelete, certificatePath, "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestV1IssueCertificate(t *testing.T) {
+	ca, err := crypto.OpenCertificateAuthority(crypto.CertificateAuthorityConfig{})
+	assert.NoError(t, err)
+	storage := persistence.NewSignatureDeviceStorage()
+	device, err := domain.NewSignatureService(storage).CreateDevice(context.Background(), domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	handler := NewServer("http://localhost", ":8080", domain.NewSignatureService(storage, domain.WithCertificateAuthority(ca))).Handler()
+	certificatePath := "/api/v1/devices/" + device.ID + "/certificate"
+
+	rr := requestV1(t, handler, http.MethodGet, certificatePath, "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	var issued domain.DeviceCertificateResponse
+	rr = requestV1(t, handler, http.MethodPost, certificatePath, "", &issued)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, certificatePath+"?key_version=1", rr.Header().Get("Location"))
+	assert.Equal(t, 1, issued.KeyVersion)
+
+	rr = requestV1(t, handler, http.MethodGet, certificatePath, "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestV1RevokeCertificate(t *testing.T) {
+	handler := newCertificateTestServer(t)
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ED25519"}`, &device)
+	revokePath := "/api/v1/devices/" + device.ID + "/certificate/revoke"
+
+	rr := requestV1(t, handler, http.MethodPost, revokePath, `{"reason": "lost"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	var revoked domain.DeviceCertificateResponse
+	rr = requestV1(t, handler, http.MethodPost, revokePath, `{"reason": "key_compromise"}`, &revoked)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotNil(t, revoked.RevokedAt)
+	assert.Equal(t, domain.RevocationReasonKeyCompromise, revoked.RevocationReason)
+
+	rr = requestV1(t, handler, http.MethodPost, revokePath, "", nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/ca/crl", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypeCRL, rr.Header().Get("Content-Type"))
+	crl, err := x509.ParseRevocationList(rr.Body.Bytes())
+	assert.NoError(t, err)
+	if assert.Len(t, crl.RevokedCertificates, 1) {
+		assert.Equal(t, revoked.SerialNumber, crl.RevokedCertificates[0].SerialNumber.Text(16))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/ca/crl", nil)
+	req.Header.Set("Accept", MediaTypePEM)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	block, _ := pem.Decode(rr.Body.Bytes())
+	if assert.NotNil(t, block) {
+		assert.Equal(t, "X509 CRL", block.Type)
+	}
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/ca/unknown", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestV1CertificateWithoutCertificateAuthority(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC"}`, &device)
+
+	rr := requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+device.ID+"/certificate", "", nil)
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/certificate", "", nil)
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/ca/crl", "", nil)
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+}
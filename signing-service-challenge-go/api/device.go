@@ -1,22 +1,13 @@
 package api
 
 import (
-	"encoding/base64"
 	"encoding/json"
-	"fmt"
-	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
-	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
-	"github.com/google/uuid"
 	"io"
 	"net/http"
-	"strconv"
 )
 
 func (s *Server) CreateSignatureDevice(response http.ResponseWriter, request *http.Request) {
-	signatureService := domain.GetSignatureService()
-	signatureService.Mutex.Lock()
-	defer signatureService.Mutex.Unlock()
 	if request.Method != http.MethodPost {
 		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
 			http.StatusText(http.StatusMethodNotAllowed),
@@ -37,52 +28,17 @@ func (s *Server) CreateSignatureDevice(response http.ResponseWriter, request *ht
 		return
 	}
 
-	// Access the field values
-	fmt.Println("Received field 1:", data.Algorithm)
-	fmt.Println("Received field 2:", data.Label)
-
-	var generator crypto.KeyPairGenerator
-	algo := domain.AlgorithmNames[data.Algorithm]
-	switch algo {
-	case domain.RSA:
-		generator = &crypto.RSAGenerator{}
-	case domain.ECC:
-		generator = &crypto.ECCGenerator{}
-	default:
-		WriteErrorResponse(response, http.StatusNotImplemented, []string{
-			http.StatusText(http.StatusNotImplemented),
-		})
-		return
-	}
-
-	counter := domain.Increment().Get()
-	fmt.Println("signature counter:", counter)
-
-	signatureDevice := &domain.InternalSignatureDevice{
-		ID:               uuid.New().String(),
-		Algorithm:        generator,
-		Label:            data.Label,
-		SignatureCounter: counter,
-	}
-
-	err = s.storage.CreateSignatureDevice(signatureDevice)
+	signatureDevice, err := s.signatureService.CreateDevice(request.Context(), data)
 	if err != nil {
+		WriteServiceError(response, err)
 		return
 	}
 
-	signatureService.Devices[signatureDevice.ID] = signatureDevice
-	signatureResponse := CreateSignatureDeviceResponse(
-		signatureDevice.ID,
-		signatureDevice.Algorithm.GetAlgorithm(),
-		*signatureDevice.Label,
-	)
+	signatureResponse := CreateSignatureDeviceResponse(signatureDevice)
 	WriteAPIResponse(response, http.StatusCreated, signatureResponse)
 }
 
 func (s *Server) SignTransaction(response http.ResponseWriter, request *http.Request) {
-	signatureService := domain.GetSignatureService()
-	signatureService.Mutex.Lock()
-	defer signatureService.Mutex.Unlock()
 	if request.Method != http.MethodPost {
 		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
 			http.StatusText(http.StatusMethodNotAllowed),
@@ -103,77 +59,28 @@ func (s *Server) SignTransaction(response http.ResponseWriter, request *http.Req
 		return
 	}
 
-	fmt.Println("Received field 1:", data.ID)
-	fmt.Println("Received field 2:", data.Data)
-
-	device := signatureService.Devices[data.ID]
-	fmt.Println("device:", device)
+	idempotencyKey, ok := readIdempotencyKey(response, request, data.IdempotencyKey)
+	if !ok {
+		return
+	}
 
-	if device == nil {
-		WriteErrorResponse(response, http.StatusNotFound, []string{
-			http.StatusText(http.StatusNotFound),
-		})
+	record, replayed, err := s.signatureService.SignIdempotently(request.Context(), data.ID, data.Data, idempotencyKey)
+	if err != nil {
+		WriteServiceError(response, err)
 		return
 	}
+	if replayed {
+		response.Header().Set(IdempotentReplayedHeader, "true")
+	}
 
-	var dataToSign string
-	if s.storage.GetLastSignature() == "0" {
-		dataToSign = "" + data.Data +
-			strconv.Itoa(int(device.SignatureCounter)) +
-			base64.StdEncoding.EncodeToString([]byte(device.ID))
-	} else {
-		lastSignature := s.storage.GetLastSignature()
-		fmt.Println("last signature:", lastSignature)
-		if err != nil {
-			return
-		}
-		dataToSign = "" + data.Data +
-			strconv.Itoa(int(device.SignatureCounter)) +
-			base64.StdEncoding.EncodeToString([]byte(lastSignature))
-	}
-
-	keypair, err := device.Algorithm.Generate()
-	var signatureResponse *domain.SignatureResponse
-	if device.Algorithm.GetAlgorithm() == "RSA" {
-		rsaKeyPair, err := crypto.CastToRSAKeyPair(keypair)
-		if err != nil {
-			return
-		}
-		signature, err := crypto.SignRSA(rsaKeyPair, []byte(dataToSign))
-		if err != nil {
-			return
-		}
-		signatureResponse = &domain.SignatureResponse{
-			Signature:  base64.StdEncoding.EncodeToString(signature),
-			SignedData: string(signature),
-		}
-	} else if device.Algorithm.GetAlgorithm() == "ECC" {
-		eccKeyPair, err := crypto.CastToECCKeyPair(keypair)
-		if err != nil {
-			return
-		}
-		signature, err := crypto.SignECC(eccKeyPair, []byte(dataToSign))
-		if err != nil {
-			return
-		}
-		signatureResponse = &domain.SignatureResponse{
-			Signature:  base64.StdEncoding.EncodeToString(signature),
-			SignedData: string(signature),
-		}
-	}
-
-	if signatureResponse != nil {
-		s.storage.InsertSignature(signatureResponse.Signature)
-		WriteAPIResponse(response, http.StatusCreated, signatureResponse)
-	} else {
-		WriteInternalError(response)
+	signatureResponse := &domain.SignatureResponse{
+		Signature:  record.Signature,
+		SignedData: record.SignedData,
 	}
+	WriteAPIResponse(response, http.StatusCreated, signatureResponse)
 }
 
 func (s *Server) GetSignatureDevice(response http.ResponseWriter, request *http.Request) {
-	signatureService := domain.GetSignatureService()
-	signatureService.Mutex.Lock()
-	defer signatureService.Mutex.Unlock()
 	if request.Method != http.MethodGet {
 		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
 			http.StatusText(http.StatusMethodNotAllowed),
@@ -185,32 +92,18 @@ func (s *Server) GetSignatureDevice(response http.ResponseWriter, request *http.
 
 	id := queryParams.Get("id")
 
-	signatureDevice, err := persistence.GetSignatureDeviceStorage().GetSignatureDevice(id)
+	signatureDevice, err := s.signatureService.GetDevice(request.Context(), id)
 	if err != nil {
-		return
-	}
-	fmt.Println("device:", signatureDevice)
-
-	if signatureDevice == nil {
-		WriteErrorResponse(response, http.StatusNotFound, []string{
-			http.StatusText(http.StatusNotFound),
-		})
+		WriteServiceError(response, err)
 		return
 	}
 
-	signatureResponse := CreateSignatureDeviceResponse(
-		signatureDevice.ID,
-		signatureDevice.Algorithm.GetAlgorithm(),
-		*signatureDevice.Label,
-	)
+	signatureResponse := CreateSignatureDeviceResponse(signatureDevice)
 
 	WriteAPIResponse(response, http.StatusFound, signatureResponse)
 }
 
 func (s *Server) GetAllSignatureDevices(response http.ResponseWriter, request *http.Request) {
-	signatureService := domain.GetSignatureService()
-	signatureService.Mutex.Lock()
-	defer signatureService.Mutex.Unlock()
 	if request.Method != http.MethodGet {
 		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
 			http.StatusText(http.StatusMethodNotAllowed),
@@ -218,11 +111,11 @@ func (s *Server) GetAllSignatureDevices(response http.ResponseWriter, request *h
 		return
 	}
 
-	signatureDevices, err := persistence.GetSignatureDeviceStorage().GetAllSignatureDevices()
+	signatureDevices, err := s.signatureService.ListDevices(request.Context())
 	if err != nil {
+		WriteInternalError(response)
 		return
 	}
-	fmt.Println("list all devices:", signatureDevices)
 
 	if signatureDevices == nil {
 		WriteErrorResponse(response, http.StatusNotFound, []string{
@@ -235,21 +128,27 @@ func (s *Server) GetAllSignatureDevices(response http.ResponseWriter, request *h
 	for _, signatureDevice := range signatureDevices {
 		signatureResponse = append(
 			signatureResponse,
-			CreateSignatureDeviceResponse(
-				signatureDevice.ID,
-				signatureDevice.Algorithm.GetAlgorithm(),
-				*signatureDevice.Label,
-			),
+			CreateSignatureDeviceResponse(signatureDevice),
 		)
 	}
 
 	WriteAPIResponse(response, http.StatusFound, signatureResponse)
 }
 
-func CreateSignatureDeviceResponse(id string, algorithm string, label string) *domain.CreateSignatureDeviceResponse {
+func CreateSignatureDeviceResponse(device *domain.InternalSignatureDevice) *domain.CreateSignatureDeviceResponse {
+	var label string
+	if device.Label != nil {
+		label = *device.Label
+	}
 	return &domain.CreateSignatureDeviceResponse{
-		ID:        id,
-		Algorithm: algorithm,
-		Label:     label,
+		ID:              device.ID,
+		Algorithm:       device.Algorithm,
+		Label:           label,
+		Curve:           device.Curve,
+		KeySize:         device.KeySize,
+		SignatureScheme: device.SignatureScheme,
+		SaltLength:      device.SaltLength,
+		HashAlgorithm:   device.HashAlgorithm,
+		KeyBackend:      device.KeyBackend(),
 	}
 }
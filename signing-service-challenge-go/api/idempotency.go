@@ -0,0 +1,36 @@
+package api
+
+import (
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"net/http"
+)
+
+const (
+	// IdempotencyKeyHeader carries the client-supplied key that makes retries of a signing request safe.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks a response that repeats the result of an earlier request with the same key.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// readIdempotencyKey takes the idempotency key from the header or, if unset, from the request body.
+// It writes a 400 response if both are set to different keys or the key is too long.
+func readIdempotencyKey(response http.ResponseWriter, request *http.Request, bodyKey string) (string, bool) {
+	key := request.Header.Get(IdempotencyKeyHeader)
+	if key == "" {
+		key = bodyKey
+	} else if bodyKey != "" && bodyKey != key {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"the idempotency key of the header and the body differ",
+		})
+		return "", false
+	}
+
+	if len(key) > domain.MaxIdempotencyKeyLength {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			fmt.Sprintf("the idempotency key must not be longer than %d bytes", domain.MaxIdempotencyKeyLength),
+		})
+		return "", false
+	}
+	return key, true
+}
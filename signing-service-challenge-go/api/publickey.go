@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"net/http"
+	"strings"
+)
+
+// Media types supported by the public key export.
+const (
+	MediaTypePEM    = "application/x-pem-file"
+	MediaTypeDER    = "application/pkix-cert"
+	MediaTypeJWK    = "application/jwk+json"
+	MediaTypeJWKSet = "application/jwk-set+json"
+)
+
+// GetDevicePublicKey exports the public key of a device at /api/v0/devices/{id}/public-key.
+// The format is negotiated through the Accept header and defaults to PEM.
+func (s *Server) GetDevicePublicKey(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+
+	id, ok := strings.CutSuffix(strings.TrimPrefix(request.URL.Path, "/api/v0/devices/"), "/public-key")
+	if !ok || id == "" || strings.Contains(id, "/") {
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			http.StatusText(http.StatusNotFound),
+		})
+		return
+	}
+
+	s.writePublicKey(response, request, id)
+}
+
+// writePublicKey writes the public key of a device in the format negotiated through the Accept header.
+func (s *Server) writePublicKey(response http.ResponseWriter, request *http.Request, id string) {
+	mediaType, ok := negotiateMediaType(request.Header.Get("Accept"), MediaTypePEM, MediaTypeDER, MediaTypeJWK, "application/json")
+	if !ok {
+		WriteErrorResponse(response, http.StatusNotAcceptable, []string{
+			http.StatusText(http.StatusNotAcceptable),
+		})
+		return
+	}
+	if mediaType == "application/json" {
+		mediaType = MediaTypeJWK
+	}
+
+	device, err := s.signatureService.GetDevice(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	keys, err := s.signatureService.ListDeviceKeys(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	current := keys[len(keys)-1]
+
+	publicKey, err := device.DecodeKey(current.PublicKey)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+
+	var body []byte
+	switch mediaType {
+	case MediaTypePEM:
+		body, err = crypto.PublicKeyToPEM(publicKey)
+	case MediaTypeDER:
+		body, err = crypto.PublicKeyToDER(publicKey)
+	case MediaTypeJWK:
+		var jwk *crypto.JWK
+		jwk, err = crypto.PublicKeyToJWK(publicKey, current.KeyID(), device.SignatureOptions())
+		if err == nil {
+			body, err = json.Marshal(jwk)
+		}
+	}
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+
+	WriteContentResponse(response, http.StatusOK, mediaType, body)
+}
+
+// GetJWKS lists the public keys of all active devices as a JSON Web Key Set. Retired keys stay listed
+// so signatures made before a rotation can still be verified, the kid of each key is its DeviceKey.KeyID.
+func (s *Server) GetJWKS(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+
+	devices, err := s.signatureService.ListDevices(request.Context())
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+
+	keySet := crypto.JWKSet{Keys: make([]*crypto.JWK, 0, len(devices))}
+	for _, device := range devices {
+		if device.CurrentStatus() != domain.DeviceStatusActive {
+			continue
+		}
+		keys, err := s.signatureService.ListDeviceKeys(request.Context(), device.ID)
+		if err != nil {
+			WriteInternalError(response)
+			return
+		}
+		for _, key := range keys {
+			publicKey, err := device.DecodeKey(key.PublicKey)
+			if err != nil {
+				WriteInternalError(response)
+				return
+			}
+			jwk, err := crypto.PublicKeyToJWK(publicKey, key.KeyID(), device.SignatureOptions())
+			if err != nil {
+				WriteInternalError(response)
+				return
+			}
+			keySet.Keys = append(keySet.Keys, jwk)
+		}
+	}
+
+	body, err := json.Marshal(keySet)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+
+	WriteContentResponse(response, http.StatusOK, MediaTypeJWKSet, body)
+}
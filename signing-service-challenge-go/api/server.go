@@ -1,11 +1,18 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"errors"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 	"net/http"
+	"time"
 )
 
+// ShutdownTimeout is the time requests still running get to complete once the server shuts down.
+const ShutdownTimeout = 10 * time.Second
+
 // Response is the generic API response container.
 type Response struct {
 	Data interface{} `json:"data"`
@@ -18,35 +25,61 @@ type ErrorResponse struct {
 
 // Server manages HTTP requests and dispatches them to the appropriate services.
 type Server struct {
-	URL           string
-	listenAddress string
-	storage       persistence.Storage
+	URL              string
+	listenAddress    string
+	signatureService *domain.SignatureService
 }
 
 // NewServer is a factory to instantiate a new Server.
 func NewServer(
 	URL string,
 	listenAddress string,
-	storage persistence.Storage,
+	signatureService *domain.SignatureService,
 ) *Server {
 	return &Server{
-		URL:           URL,
-		listenAddress: listenAddress,
-		storage:       storage,
+		URL:              URL,
+		listenAddress:    listenAddress,
+		signatureService: signatureService,
+	}
+}
+
+// Run starts the Server with all registered HTTP routes. Once ctx is done, it stops accepting
+// connections and returns after the running requests completed or ShutdownTimeout passed.
+func (s *Server) Run(ctx context.Context) error {
+	server := &http.Server{Addr: s.listenAddress, Handler: s.Handler()}
+	shutdown := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		shutdown <- server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return <-shutdown
 }
 
-// Run registers all HandlerFuncs for the existing HTTP routes and starts the Server.
-func (s *Server) Run() error {
+// Handler registers all HandlerFuncs for the existing HTTP routes.
+func (s *Server) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.Handle("/api/v0/health", http.HandlerFunc(s.Health))
 	mux.HandleFunc("/api/v0/create-signature-device", s.CreateSignatureDevice)
 	mux.HandleFunc("/api/v0/sign-transaction", s.SignTransaction)
+	mux.HandleFunc("/api/v0/verify-signature", s.VerifySignature)
 	mux.HandleFunc("/api/v0/get-signature-device", s.GetSignatureDevice)
 	mux.HandleFunc("/api/v0/get-all-devices", s.GetAllSignatureDevices)
+	mux.HandleFunc("/api/v0/devices/", s.GetDevicePublicKey)
+	mux.HandleFunc("/api/v0/jwks", s.GetJWKS)
 
-	return http.ListenAndServe(s.listenAddress, mux)
+	mux.HandleFunc("/api/v1/devices", s.DevicesV1)
+	mux.HandleFunc("/api/v1/devices/", s.DevicesV1)
+	mux.HandleFunc("/api/v1/ca/", s.CAV1)
+
+	return mux
 }
 
 // WriteInternalError writes a default internal error message as an HTTP response.
@@ -58,6 +91,33 @@ func WriteInternalError(w http.ResponseWriter) {
 	}
 }
 
+// WriteServiceError maps the typed errors of the domain services to an HTTP error response.
+func WriteServiceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, crypto.ErrUnsupportedAlgorithm), errors.Is(err, domain.ErrNoCertificateAuthority):
+		WriteErrorResponse(w, http.StatusNotImplemented, []string{
+			http.StatusText(http.StatusNotImplemented),
+			err.Error(),
+		})
+	case errors.Is(err, crypto.ErrInvalidOptions), errors.Is(err, domain.ErrInvalidQuery),
+		errors.Is(err, domain.ErrReservedData), errors.Is(err, domain.ErrInvalidRevocationReason):
+		WriteErrorResponse(w, http.StatusBadRequest, []string{
+			err.Error(),
+		})
+	case errors.Is(err, domain.ErrNotFound):
+		WriteErrorResponse(w, http.StatusNotFound, []string{
+			http.StatusText(http.StatusNotFound),
+		})
+	case errors.Is(err, domain.ErrConflict), errors.Is(err, domain.ErrDeviceNotActive),
+		errors.Is(err, domain.ErrInvalidStatusTransition), errors.Is(err, domain.ErrIdempotencyKeyReused):
+		WriteErrorResponse(w, http.StatusConflict, []string{
+			err.Error(),
+		})
+	default:
+		WriteInternalError(w)
+	}
+}
+
 // WriteErrorResponse takes an HTTP status code and a slice of errors
 // and writes those as an HTTP error response in a structured format.
 func WriteErrorResponse(w http.ResponseWriter, code int, errors []string) {
@@ -94,3 +154,15 @@ func WriteAPIResponse(w http.ResponseWriter, code int, data interface{}) {
 
 	w.Write(bytes)
 }
+
+// WriteContentResponse takes an HTTP status code, a content type and a raw body
+// and writes those as an HTTP response without the generic response container.
+func WriteContentResponse(w http.ResponseWriter, code int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+
+	_, err := w.Write(body)
+	if err != nil {
+		return
+	}
+}
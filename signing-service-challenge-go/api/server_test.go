@@ -2,19 +2,27 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHealthHandlerRR(t *testing.T) {
 
-	s := NewServer("http://localhost", ":8080", &persistence.DeviceStorage{})
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(&persistence.DeviceStorage{}))
 
 	req, err := http.NewRequest(http.MethodGet, "/api/v0/health", nil)
 	if err != nil {
@@ -62,9 +70,25 @@ func TestHealthHandlerRR(t *testing.T) {
 	assert.Equal(t, "v0", version)
 }
 
+func TestServerRunStopsWhenContextIsDone(t *testing.T) {
+	s := NewServer("http://localhost", "localhost:0", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(ShutdownTimeout):
+		t.Fatal("server did not stop")
+	}
+}
+
 func TestCreateSignatureDeviceHandler(t *testing.T) {
-	storage := persistence.GetSignatureDeviceStorage()
-	s := NewServer("http://localhost", ":8080", storage)
+	storage := persistence.NewSignatureDeviceStorage()
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(storage))
 
 	body := []byte(`{
 		"algorithm": "RSA",
@@ -89,7 +113,7 @@ func TestCreateSignatureDeviceHandler(t *testing.T) {
 	bodyBytes, err := io.ReadAll(rr.Result().Body)
 
 	assert.Equal(t, http.StatusCreated, rr.Code)
-	var response map[string]map[string]string
+	var response map[string]map[string]interface{}
 	err = json.Unmarshal(bodyBytes, &response)
 	assert.NoError(t, err)
 	data, ok := response["data"]
@@ -108,21 +132,15 @@ func TestCreateSignatureDeviceHandler(t *testing.T) {
 	assert.Equal(t, "RSA", algorithm)
 	assert.Equal(t, "My device", label)
 
-	devices := domain.GetSignatureService().Devices
-
-	var device *domain.InternalSignatureDevice
-	for _, v := range devices {
-		device = v
-		break // Exit the loop after the first iteration
-	}
-
+	device, err := s.signatureService.GetDevice(context.Background(), data["id"].(string))
+	assert.NoError(t, err)
 	assert.Equal(t, int32(0), device.SignatureCounter)
 
 }
 
 func TestCreateTwoSignatureDeviceHandler(t *testing.T) {
-	storage := persistence.GetSignatureDeviceStorage()
-	s := NewServer("http://localhost", ":8080", storage)
+	storage := persistence.NewSignatureDeviceStorage()
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(storage))
 
 	body := []byte(`{
 		"algorithm": "RSA",
@@ -147,7 +165,7 @@ func TestCreateTwoSignatureDeviceHandler(t *testing.T) {
 	bodyBytes, err := io.ReadAll(rr.Result().Body)
 
 	assert.Equal(t, http.StatusCreated, rr.Code)
-	var response map[string]map[string]string
+	var response map[string]map[string]interface{}
 	err = json.Unmarshal(bodyBytes, &response)
 	assert.NoError(t, err)
 	data, ok := response["data"]
@@ -188,7 +206,7 @@ func TestCreateTwoSignatureDeviceHandler(t *testing.T) {
 	bodyBytes, err = io.ReadAll(rr.Result().Body)
 
 	assert.Equal(t, http.StatusCreated, rr.Code)
-	var response2 map[string]map[string]string
+	var response2 map[string]map[string]interface{}
 	err = json.Unmarshal(bodyBytes, &response2)
 	assert.NoError(t, err)
 	data, ok = response2["data"]
@@ -209,8 +227,8 @@ func TestCreateTwoSignatureDeviceHandler(t *testing.T) {
 }
 
 func TestSignTransactionHandler(t *testing.T) {
-	storage := persistence.GetSignatureDeviceStorage()
-	s := NewServer("http://localhost", ":8080", storage)
+	storage := persistence.NewSignatureDeviceStorage()
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(storage))
 
 	body := []byte(`{
 		"algorithm": "RSA",
@@ -236,7 +254,7 @@ func TestSignTransactionHandler(t *testing.T) {
 	bodyBytes, err := io.ReadAll(rr.Result().Body)
 
 	assert.Equal(t, http.StatusCreated, rr.Code)
-	var response map[string]map[string]string
+	var response map[string]map[string]interface{}
 	err = json.Unmarshal(bodyBytes, &response)
 	assert.NoError(t, err)
 	data, ok := response["data"]
@@ -260,7 +278,7 @@ func TestSignTransactionHandler(t *testing.T) {
 	assert.Equal(t, "My device", label)
 
 	transactionBody := []byte(`{
-		"id": "` + deviceId + `",
+		"id": "` + deviceId.(string) + `",
 		"label": "Another device"
 	}`)
 	req2, err2 := http.NewRequest(http.MethodPost, "/api/v0/sign-transaction", bytes.NewBuffer(transactionBody))
@@ -283,7 +301,7 @@ func TestSignTransactionHandler(t *testing.T) {
 	bodyBytes, err = io.ReadAll(rr.Result().Body)
 
 	assert.Equal(t, http.StatusCreated, rr.Code)
-	var response2 map[string]map[string]string
+	var response2 map[string]map[string]interface{}
 	err = json.Unmarshal(bodyBytes, &response2)
 	assert.NoError(t, err)
 	data, ok = response2["data"]
@@ -300,3 +318,306 @@ func TestSignTransactionHandler(t *testing.T) {
 	}
 
 }
+
+func postCreateDevice(t *testing.T, s *Server, body string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v0/create-signature-device", bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	s.CreateSignatureDevice(rr, req)
+
+	var response map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return rr.Code, response["data"]
+}
+
+func createDevice(t *testing.T, s *Server, algorithm string) string {
+	code, data := postCreateDevice(t, s, `{"algorithm": "`+algorithm+`", "label": "Chained device"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	return data["id"].(string)
+}
+
+func signTransaction(t *testing.T, s *Server, deviceID string, data string) map[string]string {
+	body := []byte(`{"id": "` + deviceID + `", "data": "` + data + `"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/v0/sign-transaction", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	s.SignTransaction(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var response map[string]map[string]string
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response["data"]
+}
+
+func TestSignTransactionChainsPerDevice(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	first := createDevice(t, s, "ECC")
+	second := createDevice(t, s, "RSA")
+
+	signed := signTransaction(t, s, first, "a")
+	assert.Equal(t, "0_a_"+base64.StdEncoding.EncodeToString([]byte(first)), signed["signed_data"])
+
+	// Signing with another device must not affect the chain of the first one.
+	other := signTransaction(t, s, second, "b")
+	assert.Equal(t, "0_b_"+base64.StdEncoding.EncodeToString([]byte(second)), other["signed_data"])
+
+	next := signTransaction(t, s, first, "c")
+	assert.Equal(t, "1_c_"+signed["signature"], next["signed_data"])
+
+	device, err := s.signatureService.GetDevice(context.Background(), first)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), device.SignatureCounter)
+	assert.Equal(t, next["signature"], device.LastSignature)
+}
+
+func TestSignTransactionUnknownDevice(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	body := []byte(`{"id": "unknown", "data": "a"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/v0/sign-transaction", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	s.SignTransaction(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestSignTransactionConcurrentlyKeepsChain(t *testing.T) {
+	storage, err := persistence.OpenSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	defer storage.Close()
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(storage))
+	id := createDevice(t, s, "ECC")
+
+	const signers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < signers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			signTransaction(t, s, id, "data")
+		}()
+	}
+	wg.Wait()
+
+	device, err := storage.GetSignatureDevice(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(signers), device.SignatureCounter)
+}
+
+func verifySignature(t *testing.T, s *Server, deviceID string, signedData string, signature string) bool {
+	body, err := json.Marshal(domain.VerifySignatureRequest{
+		ID:         deviceID,
+		SignedData: signedData,
+		Signature:  signature,
+	})
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/v0/verify-signature", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	s.VerifySignature(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var response map[string]map[string]bool
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	return response["data"]["valid"]
+}
+
+func TestVerifySignatureHandler(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	for _, algorithm := range []string{"RSA", "ECC", "ED25519"} {
+		deviceID := createDevice(t, s, algorithm)
+		signed := signTransaction(t, s, deviceID, "receipt")
+
+		assert.True(t, verifySignature(t, s, deviceID, signed["signed_data"], signed["signature"]))
+		assert.False(t, verifySignature(t, s, deviceID, signed["signed_data"]+"x", signed["signature"]))
+	}
+}
+
+func TestVerifySignatureHandlerUnknownDevice(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	body := []byte(`{"id": "unknown", "signed_data": "0_a_b", "signature": "c2ln"}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/v0/verify-signature", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	s.VerifySignature(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetDevicePublicKeyContentNegotiation(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+	deviceID := createDevice(t, s, "ECC")
+	path := "/api/v0/devices/" + deviceID + "/public-key"
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypePEM, rr.Header().Get("Content-Type"))
+	block, _ := pem.Decode(rr.Body.Bytes())
+	assert.NotNil(t, block)
+	assert.Equal(t, "PUBLIC KEY", block.Type)
+
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", MediaTypeDER)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, block.Bytes, rr.Body.Bytes())
+	_, err := x509.ParsePKIXPublicKey(rr.Body.Bytes())
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", MediaTypeJWK)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var jwk map[string]string
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &jwk))
+	assert.Equal(t, "EC", jwk["kty"])
+	assert.Equal(t, "P-384", jwk["crv"])
+	assert.Equal(t, "ES384", jwk["alg"])
+	assert.Equal(t, deviceID+":0", jwk["kid"])
+
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", "text/html, application/json")
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypeJWK, rr.Header().Get("Content-Type"))
+
+	req = httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotAcceptable, rr.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v0/devices/unknown/public-key", nil)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestGetJWKS(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+	deviceID := createDevice(t, s, "RSA")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v0/jwks", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var keySet struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &keySet))
+
+	var found map[string]string
+	for _, key := range keySet.Keys {
+		if key["kid"] == deviceID+":0" {
+			found = key
+		}
+	}
+	assert.NotNil(t, found)
+	assert.Equal(t, "RSA", found["kty"])
+	assert.Equal(t, "RS256", found["alg"])
+	assert.Equal(t, "AQAB", found["e"])
+
+	signTransaction(t, s, deviceID, "receipt")
+	_, _, _, err := s.signatureService.RotateKey(context.Background(), deviceID)
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v0/jwks", nil)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	keySet.Keys = nil
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &keySet))
+
+	kids := map[string]string{}
+	for _, key := range keySet.Keys {
+		kids[key["kid"]] = key["n"]
+	}
+	assert.Equal(t, found["n"], kids[deviceID+":0"])
+	assert.Contains(t, kids, deviceID+":2")
+	assert.NotEqual(t, found["n"], kids[deviceID+":2"])
+
+	_, err = s.signatureService.ChangeDeviceStatus(context.Background(), deviceID, domain.DeviceStatusSuspended, "")
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v0/jwks", nil)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	keySet.Keys = nil
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &keySet))
+	for _, key := range keySet.Keys {
+		assert.False(t, strings.HasPrefix(key["kid"], deviceID+":"))
+	}
+}
+
+func TestCreateSignatureDeviceKeyOptions(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	code, data := postCreateDevice(t, s, `{"algorithm": "ECC"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "P-384", data["curve"])
+	assert.Equal(t, "SHA-384", data["hash_algorithm"])
+
+	code, data = postCreateDevice(t, s, `{"algorithm": "ECC", "hash_algorithm": "SHA3-256"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "SHA3-256", data["hash_algorithm"])
+	deviceID := data["id"].(string)
+	signed := signTransaction(t, s, deviceID, "receipt")
+	assert.True(t, verifySignature(t, s, deviceID, signed["signed_data"], signed["signature"]))
+
+	code, data = postCreateDevice(t, s, `{"algorithm": "ECC", "curve": "P-256"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "P-256", data["curve"])
+	device, err := s.signatureService.GetDevice(context.Background(), data["id"].(string))
+	assert.NoError(t, err)
+	assert.Equal(t, "P-256", device.Curve)
+
+	code, data = postCreateDevice(t, s, `{"algorithm": "RSA"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, float64(2048), data["key_size"])
+
+	code, data = postCreateDevice(t, s, `{"algorithm": "RSA", "key_size": 3072}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, float64(3072), data["key_size"])
+}
+
+func TestCreateSignatureDeviceRejectsInvalidKeyOptions(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	for _, body := range []string{
+		`{"algorithm": "ECC", "curve": "P-224"}`,
+		`{"algorithm": "ECC", "key_size": 2048}`,
+		`{"algorithm": "RSA", "key_size": 1024}`,
+		`{"algorithm": "RSA", "curve": "P-256"}`,
+		`{"algorithm": "ED25519", "key_size": 2048}`,
+		`{"algorithm": "RSA", "signature_scheme": "RSA_OAEP"}`,
+		`{"algorithm": "ECC", "signature_scheme": "RSA_PSS"}`,
+		`{"algorithm": "RSA", "hash_algorithm": "MD5"}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/v0/create-signature-device", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		s.CreateSignatureDevice(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestCreateRSAPSSDeviceSignAndVerify(t *testing.T) {
+	s := NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage()))
+
+	code, data := postCreateDevice(t, s, `{"algorithm": "RSA", "signature_scheme": "RSA_PSS", "salt_length": 20}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "RSA_PSS", data["signature_scheme"])
+	assert.Equal(t, float64(20), data["salt_length"])
+
+	deviceID := data["id"].(string)
+	signed := signTransaction(t, s, deviceID, "receipt")
+	assert.True(t, verifySignature(t, s, deviceID, signed["signed_data"], signed["signature"]))
+
+	code, data = postCreateDevice(t, s, `{"algorithm": "RSA"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "RSA_PKCS1V15", data["signature_scheme"])
+}
@@ -0,0 +1,446 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const devicesPathV1 = "/api/v1/devices"
+
+// MediaTypeTar is the media type of the device export archive.
+const MediaTypeTar = "application/x-tar"
+
+// deviceTransitionsV1 maps the lifecycle actions of a device to the state they lead to.
+var deviceTransitionsV1 = map[string]string{
+	"activate":     domain.DeviceStatusActive,
+	"suspend":      domain.DeviceStatusSuspended,
+	"decommission": domain.DeviceStatusDecommissioned,
+}
+
+// DevicesV1 dispatches the resource-oriented routes of the v1 API below /api/v1/devices:
+//
+//	POST  /devices                               creates a device
+//	GET   /devices                               lists all devices
+//	GET   /devices/{id}                          retrieves a device
+//	PATCH /devices/{id}                          changes the label of a device
+//	GET   /devices/{id}/public-key               exports the public key of a device
+//	POST  /devices/{id}/signatures               signs data with a device
+//	GET   /devices/{id}/signatures               lists the signatures of a device page by page
+//	GET   /devices/{id}/signatures/{counter}     retrieves a single signature
+//	GET   /devices/{id}/audit                    checks the integrity of the signature chain
+//	GET   /devices/{id}/export                   downloads a tar archive of the device and its signatures
+//	POST  /devices/{id}/activate                 activates a suspended device
+//	POST  /devices/{id}/suspend                  suspends an active device, so that it stops signing
+//	POST  /devices/{id}/decommission             decommissions a device for good after signing its closing record
+//	GET   /devices/{id}/history                  lists the lifecycle state changes of a device
+//	POST  /devices/{id}/rotate-key               replaces the key pair of a device, signed by the previous key
+//	GET   /devices/{id}/keys                     lists the current and retired keys of a device
+//	GET   /devices/{id}/certificate              downloads the certificate of a device key with its chain
+//	POST  /devices/{id}/certificate              issues the missing certificate of the current key of a device
+//	POST  /devices/{id}/certificate/revoke       revokes the certificate of the current key of a device
+func (s *Server) DevicesV1(response http.ResponseWriter, request *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(request.URL.Path, devicesPathV1), "/")
+	if path == "" {
+		s.devicesV1(response, request)
+		return
+	}
+
+	segments := strings.Split(path, "/")
+	id := segments[0]
+	switch {
+	case len(segments) == 1:
+		s.deviceV1(response, request, id)
+	case len(segments) == 2 && segments[1] == "public-key":
+		if allowMethods(response, request, http.MethodGet) {
+			s.writePublicKey(response, request, id)
+		}
+	case len(segments) == 2 && segments[1] == "signatures":
+		s.signaturesV1(response, request, id)
+	case len(segments) == 2 && segments[1] == "audit":
+		if allowMethods(response, request, http.MethodGet) {
+			s.auditV1(response, request, id)
+		}
+	case len(segments) == 2 && segments[1] == "export":
+		if allowMethods(response, request, http.MethodGet) {
+			s.exportV1(response, request, id)
+		}
+	case len(segments) == 2 && deviceTransitionsV1[segments[1]] != "":
+		if allowMethods(response, request, http.MethodPost) {
+			s.changeDeviceStatusV1(response, request, id, deviceTransitionsV1[segments[1]])
+		}
+	case len(segments) == 2 && segments[1] == "history":
+		if allowMethods(response, request, http.MethodGet) {
+			s.historyV1(response, request, id)
+		}
+	case len(segments) == 2 && segments[1] == "rotate-key":
+		if allowMethods(response, request, http.MethodPost) {
+			s.rotateKeyV1(response, request, id)
+		}
+	case len(segments) == 2 && segments[1] == "keys":
+		if allowMethods(response, request, http.MethodGet) {
+			s.keysV1(response, request, id)
+		}
+	case len(segments) == 2 && segments[1] == "certificate":
+		s.certificateV1(response, request, id)
+	case len(segments) == 3 && segments[1] == "signatures":
+		s.signatureV1(response, request, id, segments[2])
+	case len(segments) == 3 && segments[1] == "certificate" && segments[2] == "revoke":
+		if allowMethods(response, request, http.MethodPost) {
+			s.revokeCertificateV1(response, request, id)
+		}
+	default:
+		WriteErrorResponse(response, http.StatusNotFound, []string{
+			http.StatusText(http.StatusNotFound),
+		})
+	}
+}
+
+// devicesV1 handles the device collection.
+func (s *Server) devicesV1(response http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case http.MethodGet:
+		devices, err := s.signatureService.ListDevices(request.Context())
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+
+		deviceResponses := make([]*domain.SignatureDeviceResponse, 0, len(devices))
+		for _, device := range devices {
+			deviceResponses = append(deviceResponses, SignatureDeviceResponse(device))
+		}
+		WriteAPIResponse(response, http.StatusOK, deviceResponses)
+	case http.MethodPost:
+		var data domain.CreateSignatureDeviceRequest
+		if !readJSONBody(response, request, &data) {
+			return
+		}
+
+		device, err := s.signatureService.CreateDevice(request.Context(), data)
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+
+		response.Header().Set("Location", devicesPathV1+"/"+device.ID)
+		WriteAPIResponse(response, http.StatusCreated, SignatureDeviceResponse(device))
+	default:
+		allowMethods(response, request, http.MethodGet, http.MethodPost)
+	}
+}
+
+// deviceV1 handles a single device.
+func (s *Server) deviceV1(response http.ResponseWriter, request *http.Request, id string) {
+	switch request.Method {
+	case http.MethodGet:
+		device, err := s.signatureService.GetDevice(request.Context(), id)
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		WriteAPIResponse(response, http.StatusOK, SignatureDeviceResponse(device))
+	case http.MethodPatch:
+		var data domain.UpdateSignatureDeviceRequest
+		if !readJSONBody(response, request, &data) {
+			return
+		}
+		if data.Label == nil {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{
+				"label is required",
+			})
+			return
+		}
+
+		device, err := s.signatureService.UpdateDeviceLabel(request.Context(), id, data.Label)
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		WriteAPIResponse(response, http.StatusOK, SignatureDeviceResponse(device))
+	default:
+		allowMethods(response, request, http.MethodGet, http.MethodPatch)
+	}
+}
+
+// signaturesV1 handles the signature collection of a device.
+func (s *Server) signaturesV1(response http.ResponseWriter, request *http.Request, id string) {
+	switch request.Method {
+	case http.MethodGet:
+		query := request.URL.Query()
+		filter, err := parseSignatureFilter(query)
+		if err != nil {
+			WriteErrorResponse(response, http.StatusBadRequest, []string{
+				err.Error(),
+			})
+			return
+		}
+
+		page, err := s.signatureService.ListSignatures(request.Context(), id, filter, query.Get("cursor"))
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		WriteAPIResponse(response, http.StatusOK, page)
+	case http.MethodPost:
+		var data domain.CreateSignatureRequest
+		if !readJSONBody(response, request, &data) {
+			return
+		}
+
+		idempotencyKey, ok := readIdempotencyKey(response, request, data.IdempotencyKey)
+		if !ok {
+			return
+		}
+
+		record, replayed, err := s.signatureService.SignIdempotently(request.Context(), id, data.Data, idempotencyKey)
+		if err != nil {
+			WriteServiceError(response, err)
+			return
+		}
+		if replayed {
+			response.Header().Set(IdempotentReplayedHeader, "true")
+		}
+
+		response.Header().Set("Location", fmt.Sprintf("%s/%s/signatures/%d", devicesPathV1, id, record.Counter))
+		WriteAPIResponse(response, http.StatusCreated, record)
+	default:
+		allowMethods(response, request, http.MethodGet, http.MethodPost)
+	}
+}
+
+// signatureV1 handles a single signature of a device.
+func (s *Server) signatureV1(response http.ResponseWriter, request *http.Request, id string, counterParam string) {
+	if !allowMethods(response, request, http.MethodGet) {
+		return
+	}
+
+	counter, err := strconv.ParseInt(counterParam, 10, 32)
+	if err != nil || counter < 0 {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"signature counter must be a non-negative integer",
+		})
+		return
+	}
+
+	record, err := s.signatureService.GetSignature(request.Context(), id, int32(counter))
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, record)
+}
+
+// auditV1 re-verifies the signature chain of a device. The report is returned with 200 OK
+// whether the chain is intact or not, its valid field tells the result.
+func (s *Server) auditV1(response http.ResponseWriter, request *http.Request, id string) {
+	report, err := s.signatureService.Audit(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, report)
+}
+
+// changeDeviceStatusV1 moves a device to another lifecycle state. The request body with a reason is optional.
+func (s *Server) changeDeviceStatusV1(response http.ResponseWriter, request *http.Request, id string, status string) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+	var data domain.DeviceStatusChangeRequest
+	if len(body) > 0 && json.Unmarshal(body, &data) != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"failed to parse JSON body",
+		})
+		return
+	}
+
+	device, err := s.signatureService.ChangeDeviceStatus(request.Context(), id, status, data.Reason)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, SignatureDeviceResponse(device))
+}
+
+// historyV1 lists the lifecycle state changes of a device.
+func (s *Server) historyV1(response http.ResponseWriter, request *http.Request, id string) {
+	history, err := s.signatureService.GetDeviceHistory(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, history)
+}
+
+// rotateKeyV1 replaces the key pair of a device and returns the device, its new key and the key transition record.
+func (s *Server) rotateKeyV1(response http.ResponseWriter, request *http.Request, id string) {
+	device, key, record, err := s.signatureService.RotateKey(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	keyResponse, err := device.KeyResponse(key)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+	WriteAPIResponse(response, http.StatusOK, &domain.KeyRotationResponse{
+		Device:        SignatureDeviceResponse(device),
+		Key:           keyResponse,
+		KeyTransition: record,
+	})
+}
+
+// keysV1 lists the keys of a device with the signature counters they signed, the current key is the last one.
+func (s *Server) keysV1(response http.ResponseWriter, request *http.Request, id string) {
+	device, err := s.signatureService.GetDevice(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+	keys, err := s.signatureService.ListDeviceKeys(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	keyResponses := make([]*domain.DeviceKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		keyResponse, err := device.KeyResponse(key)
+		if err != nil {
+			WriteInternalError(response)
+			return
+		}
+		keyResponses = append(keyResponses, keyResponse)
+	}
+	WriteAPIResponse(response, http.StatusOK, keyResponses)
+}
+
+// exportV1 streams the export archive of a device. Once the archive has started, errors can only
+// be signaled by aborting the response, which leaves the archive without its end marker.
+func (s *Server) exportV1(response http.ResponseWriter, request *http.Request, id string) {
+	export, err := s.signatureService.Export(request.Context(), id)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	response.Header().Set("Content-Type", MediaTypeTar)
+	response.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "device-" + export.DeviceID() + ".tar",
+	}))
+	response.WriteHeader(http.StatusOK)
+
+	err = export.WriteTar(request.Context(), response)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// parseSignatureFilter reads the filter of the signature listing from the query parameters
+// from_counter, to_counter, since, until (RFC 3339) and limit.
+func parseSignatureFilter(query url.Values) (domain.SignatureFilter, error) {
+	var filter domain.SignatureFilter
+	var err error
+
+	filter.FromCounter, err = parseCounterParam(query, "from_counter")
+	if err != nil {
+		return filter, err
+	}
+	filter.ToCounter, err = parseCounterParam(query, "to_counter")
+	if err != nil {
+		return filter, err
+	}
+
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+	} {
+		if value := query.Get(param.name); value != "" {
+			*param.value, err = time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", param.name)
+			}
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 {
+			return filter, errors.New("limit must be a positive integer")
+		}
+	}
+	return filter, nil
+}
+
+// parseCounterParam reads an optional signature counter from the query parameters.
+func parseCounterParam(query url.Values, name string) (*int32, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	counter, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || counter < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	counter32 := int32(counter)
+	return &counter32, nil
+}
+
+// SignatureDeviceResponse converts a device into its v1 resource representation.
+func SignatureDeviceResponse(device *domain.InternalSignatureDevice) *domain.SignatureDeviceResponse {
+	return &domain.SignatureDeviceResponse{
+		CreateSignatureDeviceResponse: CreateSignatureDeviceResponse(device),
+		Status:                        device.CurrentStatus(),
+		SignatureCounter:              device.SignatureCounter,
+	}
+}
+
+// allowMethods reports whether the request uses one of the given methods.
+// Otherwise it writes a 405 response listing the allowed methods.
+func allowMethods(response http.ResponseWriter, request *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if request.Method == method {
+			return true
+		}
+	}
+
+	response.Header().Set("Allow", strings.Join(methods, ", "))
+	WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+		http.StatusText(http.StatusMethodNotAllowed),
+	})
+	return false
+}
+
+// readJSONBody decodes the JSON request body into data and writes a 400 response if that fails.
+func readJSONBody(response http.ResponseWriter, request *http.Request, data interface{}) bool {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		WriteInternalError(response)
+		return false
+	}
+
+	err = json.Unmarshal(body, data)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"failed to parse JSON body",
+		})
+		return false
+	}
+	return true
+}
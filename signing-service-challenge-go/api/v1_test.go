@@ -0,0 +1,406 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newV1TestServer() http.Handler {
+	return NewServer("http://localhost", ":8080", domain.NewSignatureService(persistence.NewSignatureDeviceStorage())).Handler()
+}
+
+// requestV1 sends a request to the handler and decodes the data of the response into data, if given.
+func requestV1(t *testing.T, handler http.Handler, method string, path string, body string, data interface{}) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if data != nil {
+		response := Response{Data: data}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+	}
+	return rr
+}
+
+func TestV1DeviceLifecycle(t *testing.T) {
+	handler := newV1TestServer()
+
+	var created domain.SignatureDeviceResponse
+	rr := requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC", "label": "Till 1"}`, &created)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "/api/v1/devices/"+created.ID, rr.Header().Get("Location"))
+	assert.Equal(t, "Till 1", created.Label)
+	assert.Equal(t, int32(0), created.SignatureCounter)
+	assert.Equal(t, domain.KeyBackendSoftware, created.KeyBackend)
+
+	var device domain.SignatureDeviceResponse
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+created.ID, "", &device)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, created, device)
+
+	rr = requestV1(t, handler, http.MethodPatch, "/api/v1/devices/"+created.ID, `{"label": "Till 2"}`, &device)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Till 2", device.Label)
+
+	var devices []*domain.SignatureDeviceResponse
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices", "", &devices)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "Till 2", devices[0].Label)
+}
+
+func TestV1ListDevicesEmpty(t *testing.T) {
+	var devices []*domain.SignatureDeviceResponse
+	rr := requestV1(t, newV1TestServer(), http.MethodGet, "/api/v1/devices", "", &devices)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, devices)
+	assert.NotNil(t, devices)
+}
+
+func TestV1Signatures(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "RSA"}`, &device)
+	signaturesPath := "/api/v1/devices/" + device.ID + "/signatures"
+
+	var first domain.SignatureRecord
+	rr := requestV1(t, handler, http.MethodPost, signaturesPath, `{"data": "a"}`, &first)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, signaturesPath+"/0", rr.Header().Get("Location"))
+	assert.Equal(t, int32(0), first.Counter)
+	assert.Equal(t, "0_a_"+base64.StdEncoding.EncodeToString([]byte(device.ID)), first.SignedData)
+
+	var second domain.SignatureRecord
+	rr = requestV1(t, handler, http.MethodPost, signaturesPath, `{"data": "b"}`, &second)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, signaturesPath+"/1", rr.Header().Get("Location"))
+	assert.Equal(t, "1_b_"+first.Signature, second.SignedData)
+
+	var page domain.SignaturePage
+	rr = requestV1(t, handler, http.MethodGet, signaturesPath, "", &page)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, page.NextCursor)
+	if assert.Len(t, page.Signatures, 2) {
+		assert.Equal(t, first, *page.Signatures[0])
+		assert.Equal(t, second, *page.Signatures[1])
+	}
+
+	var record domain.SignatureRecord
+	rr = requestV1(t, handler, http.MethodGet, signaturesPath+"/1", "", &record)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(1), record.Counter)
+	assert.Equal(t, second, record)
+	assert.Equal(t, "b", record.DataToBeSigned)
+	assert.Equal(t, "RSA", record.Algorithm)
+
+	var updated domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+device.ID, "", &updated)
+	assert.Equal(t, int32(2), updated.SignatureCounter)
+}
+
+func TestV1ListSignaturesPagination(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ED25519"}`, &device)
+	signaturesPath := "/api/v1/devices/" + device.ID + "/signatures"
+	start := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+	for i := 0; i < 7; i++ {
+		rr := requestV1(t, handler, http.MethodPost, signaturesPath, `{"data": "receipt"}`, nil)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+
+	// Walks the counter range 1 to 5 in pages of two.
+	var counters []int32
+	query := "?from_counter=1&to_counter=5&limit=2"
+	for pages := 0; ; pages++ {
+		var page domain.SignaturePage
+		rr := requestV1(t, handler, http.MethodGet, signaturesPath+query, "", &page)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		for _, record := range page.Signatures {
+			counters = append(counters, record.Counter)
+		}
+		if page.NextCursor == "" || pages > 5 {
+			break
+		}
+		query = "?from_counter=1&to_counter=5&limit=2&cursor=" + page.NextCursor
+	}
+	assert.Equal(t, []int32{1, 2, 3, 4, 5}, counters)
+
+	var page domain.SignaturePage
+	requestV1(t, handler, http.MethodGet, signaturesPath+"?since="+start, "", &page)
+	assert.Len(t, page.Signatures, 7)
+	requestV1(t, handler, http.MethodGet, signaturesPath+"?until="+start, "", &page)
+	assert.Empty(t, page.Signatures)
+
+	for _, query := range []string{"?limit=0", "?limit=501", "?from_counter=x", "?since=yesterday", "?cursor=%21"} {
+		rr := requestV1(t, handler, http.MethodGet, signaturesPath+query, "", nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+}
+
+func TestV1Audit(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC"}`, &device)
+	for _, data := range []string{"a", "b"} {
+		requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/signatures", `{"data": "`+data+`"}`, nil)
+	}
+
+	var report domain.AuditReport
+	rr := requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+device.ID+"/audit", "", &report)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 2, report.CheckedSignatures)
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices/unknown/audit", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/audit", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestV1Export(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "RSA"}`, &device)
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/signatures", `{"data": "a"}`, nil)
+
+	rr := requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+device.ID+"/export", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypeTar, rr.Header().Get("Content-Type"))
+	assert.Equal(t, `attachment; filename=device-`+device.ID+`.tar`, rr.Header().Get("Content-Disposition"))
+
+	var names []string
+	archive := tar.NewReader(rr.Body)
+	for header, err := archive.Next(); err == nil; header, err = archive.Next() {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"device.json", "public_key.pem", "keys.json", "signatures.jsonl", "manifest.json", "manifest.sig"}, names)
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices/unknown/export", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/export", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+}
+
+func TestV1DeviceLifecycleTransitions(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC"}`, &device)
+	devicePath := "/api/v1/devices/" + device.ID
+	assert.Equal(t, domain.DeviceStatusActive, device.Status)
+
+	rr := requestV1(t, handler, http.MethodPost, devicePath+"/suspend", `{"reason": "maintenance"}`, &device)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, domain.DeviceStatusSuspended, device.Status)
+
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/signatures", `{"data": "a"}`, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "device is not active")
+	rr = requestV1(t, handler, http.MethodPost, "/api/v0/sign-transaction", `{"id": "`+device.ID+`", "data": "a"}`, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/activate", "", &device)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, domain.DeviceStatusActive, device.Status)
+
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/decommission", "", &device)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, domain.DeviceStatusDecommissioned, device.Status)
+	assert.Equal(t, int32(1), device.SignatureCounter)
+
+	var closing domain.SignatureRecord
+	rr = requestV1(t, handler, http.MethodGet, devicePath+"/signatures/0", "", &closing)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, domain.SignatureKindClosing, closing.Kind)
+
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/activate", "", nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	var history []*domain.DeviceStatusChange
+	rr = requestV1(t, handler, http.MethodGet, devicePath+"/history", "", &history)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, history, 3)
+	assert.Equal(t, "maintenance", history[0].Reason)
+
+	rr = requestV1(t, handler, http.MethodGet, devicePath+"/suspend", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/suspend", `{`, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/unknown/suspend", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices/unknown/history", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestV1RotateKey(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC"}`, &device)
+	devicePath := "/api/v1/devices/" + device.ID
+
+	var before domain.SignatureRecord
+	requestV1(t, handler, http.MethodPost, devicePath+"/signatures", `{"data": "before"}`, &before)
+
+	var rotation domain.KeyRotationResponse
+	rr := requestV1(t, handler, http.MethodPost, devicePath+"/rotate-key", "", &rotation)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, int32(2), rotation.Device.SignatureCounter)
+	assert.Equal(t, 2, rotation.Key.Version)
+	assert.Equal(t, int32(2), rotation.Key.FromCounter)
+	assert.Contains(t, rotation.Key.PublicKey, "-----BEGIN PUBLIC KEY-----")
+	assert.Equal(t, domain.SignatureKindKeyTransition, rotation.KeyTransition.Kind)
+	assert.Equal(t, int32(1), rotation.KeyTransition.Counter)
+
+	var keys []*domain.DeviceKeyResponse
+	rr = requestV1(t, handler, http.MethodGet, devicePath+"/keys", "", &keys)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, int32(1), *keys[0].ToCounter)
+		assert.Equal(t, rotation.Key.PublicKey, keys[1].PublicKey)
+	}
+
+	// Signatures of the retired key still verify.
+	var verification domain.VerifySignatureResponse
+	rr = requestV1(t, handler, http.MethodPost, "/api/v0/verify-signature", `{"id": "`+device.ID+`", "signed_data": "`+
+		before.SignedData+`", "signature": "`+before.Signature+`"}`, &verification)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, verification.Valid)
+
+	var report domain.AuditReport
+	requestV1(t, handler, http.MethodGet, devicePath+"/audit", "", &report)
+	assert.True(t, report.Valid)
+
+	rr = requestV1(t, handler, http.MethodGet, devicePath+"/rotate-key", "", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/unknown/rotate-key", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodGet, "/api/v1/devices/unknown/keys", "", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = requestV1(t, handler, http.MethodPost, devicePath+"/signatures", `{"data": "KEY_TRANSITION_forged"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestIdempotentSignTransaction(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.CreateSignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v0/create-signature-device", `{"algorithm": "ECC"}`, &device)
+	body := `{"id": "` + device.ID + `", "data": "receipt"}`
+
+	signWithKey := func(key string, body string, data interface{}) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v0/sign-transaction", bytes.NewBufferString(body))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if data != nil {
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &Response{Data: data}))
+		}
+		return rr
+	}
+
+	var original, retry domain.SignatureResponse
+	rr := signWithKey("key-1", body, &original)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Empty(t, rr.Header().Get(IdempotentReplayedHeader))
+
+	rr = signWithKey("key-1", body, &retry)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "true", rr.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, original, retry)
+
+	rr = signWithKey("key-1", `{"id": "`+device.ID+`", "data": "other"}`, nil)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	rr = signWithKey("key-2", `{"id": "`+device.ID+`", "data": "receipt", "idempotency_key": "key-3"}`, nil)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// The key can also be sent in the body, also to the v1 API.
+	rr = requestV1(t, handler, http.MethodPost, "/api/v0/sign-transaction", `{"id": "`+device.ID+`", "data": "receipt", "idempotency_key": "key-1"}`, &retry)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, original, retry)
+
+	var record domain.SignatureRecord
+	rr = requestV1(t, handler, http.MethodPost, "/api/v1/devices/"+device.ID+"/signatures", `{"data": "receipt", "idempotency_key": "key-1"}`, &record)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, int32(0), record.Counter)
+	assert.Equal(t, "key-1", record.IdempotencyKey)
+}
+
+func TestV1Errors(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC"}`, &device)
+	devicePath := "/api/v1/devices/" + device.ID
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodPost, "/api/v1/devices", `{"algorithm": "DSA"}`, http.StatusNotImplemented},
+		{http.MethodPost, "/api/v1/devices", `{"algorithm": "RSA", "key_size": 1024}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/devices", `{`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/devices", `{"algorithm": "ECC", "key_backend": "pkcs11"}`, http.StatusBadRequest},
+		{http.MethodDelete, "/api/v1/devices", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/v1/devices/unknown", "", http.StatusNotFound},
+		{http.MethodPatch, "/api/v1/devices/unknown", `{"label": "x"}`, http.StatusNotFound},
+		{http.MethodPatch, devicePath, `{}`, http.StatusBadRequest},
+		{http.MethodPut, devicePath, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/devices/unknown/signatures", `{"data": "a"}`, http.StatusNotFound},
+		{http.MethodGet, "/api/v1/devices/unknown/signatures", "", http.StatusNotFound},
+		{http.MethodGet, devicePath + "/signatures/0", "", http.StatusNotFound},
+		{http.MethodGet, devicePath + "/signatures/-1", "", http.StatusBadRequest},
+		{http.MethodGet, devicePath + "/signatures/abc", "", http.StatusBadRequest},
+		{http.MethodGet, devicePath + "/unknown", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		rr := requestV1(t, handler, test.method, test.path, test.body, nil)
+		assert.Equal(t, test.code, rr.Code, "%s %s", test.method, test.path)
+	}
+
+	rr := requestV1(t, handler, http.MethodPut, devicePath, "", nil)
+	assert.Equal(t, "GET, PATCH", rr.Header().Get("Allow"))
+}
+
+func TestV1PublicKey(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.SignatureDeviceResponse
+	requestV1(t, handler, http.MethodPost, "/api/v1/devices", `{"algorithm": "ED25519"}`, &device)
+
+	rr := requestV1(t, handler, http.MethodGet, "/api/v1/devices/"+device.ID+"/public-key", "", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, MediaTypePEM, rr.Header().Get("Content-Type"))
+}
+
+func TestV0RoutesStillWork(t *testing.T) {
+	handler := newV1TestServer()
+
+	var device domain.CreateSignatureDeviceResponse
+	rr := requestV1(t, handler, http.MethodPost, "/api/v0/create-signature-device", `{"algorithm": "ECC", "label": "Till"}`, &device)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	var signature domain.SignatureResponse
+	rr = requestV1(t, handler, http.MethodPost, "/api/v0/sign-transaction", `{"id": "`+device.ID+`", "data": "a"}`, &signature)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.NotEmpty(t, signature.Signature)
+
+	rr = requestV1(t, handler, http.MethodGet, "/api/v0/get-signature-device?id="+device.ID, "", nil)
+	assert.Equal(t, http.StatusFound, rr.Code)
+}
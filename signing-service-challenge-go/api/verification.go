@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"io"
+	"net/http"
+)
+
+// VerifySignature checks a signature that was created by one of the signature devices
+// against the public key stored with that device.
+func (s *Server) VerifySignature(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		WriteErrorResponse(response, http.StatusMethodNotAllowed, []string{
+			http.StatusText(http.StatusMethodNotAllowed),
+		})
+		return
+	}
+
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		WriteInternalError(response)
+		return
+	}
+
+	var data domain.VerifySignatureRequest
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		http.Error(response, "Failed to parse JSON body", http.StatusBadRequest)
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(data.Signature)
+	if err != nil {
+		WriteErrorResponse(response, http.StatusBadRequest, []string{
+			"signature is not base64 encoded",
+		})
+		return
+	}
+
+	valid, err := s.signatureService.VerifySignature(request.Context(), data.ID, data.SignedData, signature)
+	if err != nil {
+		WriteServiceError(response, err)
+		return
+	}
+
+	WriteAPIResponse(response, http.StatusOK, domain.VerifySignatureResponse{Valid: valid})
+}
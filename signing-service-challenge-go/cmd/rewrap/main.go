@@ -0,0 +1,130 @@
+// Command rewrap seals the private keys of all signature devices with the primary key-encryption key.
+//
+// The key-encryption keys are read like the service reads them, from SIGNING_SERVICE_KEK or the file
+// named by SIGNING_SERVICE_KEK_FILE, or from -kek-file. Private keys stored in the clear are sealed,
+// keys sealed with an older key-encryption key get their data key re-wrapped with the primary one.
+//
+//	rewrap -storage sqlite -sqlite-path signing-service.db [-kek-file keks.txt]
+//	rewrap -storage file -file-dir signing-service-data [-kek-file keks.txt]
+//
+// To rotate the key-encryption key without downtime:
+//
+//  1. Put the new key first and keep the old one, e.g. "kek-2:...,kek-1:...", and restart the service.
+//     New devices are sealed with kek-2, existing ones still open with kek-1. The keys of the certificate
+//     authority are re-wrapped with kek-2 when the service starts.
+//  2. Run rewrap. SQLite databases can be re-wrapped while the service is running. The file storage is
+//     locked by the process holding it, so rewrap refuses to run on it while the service is up: stop
+//     the service, run rewrap and start the service again.
+//  3. Once no device is reported as skipped, drop kek-1 from the keyring and restart the service.
+//
+// A key changed by another process while rewrap runs is reported and left for the next run.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"io"
+	"os"
+)
+
+// Environment variables shared with the service.
+const (
+	KEKEnv     = "SIGNING_SERVICE_KEK"
+	KEKFileEnv = "SIGNING_SERVICE_KEK_FILE"
+)
+
+// Exit codes of rewrap.
+const (
+	ExitOK     = 0
+	ExitFailed = 1
+	ExitUsage  = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdout, os.Stderr))
+}
+
+func run(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("rewrap", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	backend := flags.String("storage", "", "storage backend holding the devices, file or sqlite")
+	sqlitePath := flags.String("sqlite-path", "signing-service.db", "database file of the sqlite backend")
+	fileDir := flags.String("file-dir", "signing-service-data", "data directory of the file backend")
+	kekFile := flags.String("kek-file", "", "file holding the key-encryption keys, overrides "+KEKEnv+" and "+KEKFileEnv)
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: rewrap -storage file|sqlite [options]")
+		flags.PrintDefaults()
+		return ExitUsage
+	}
+
+	spec, path := getenv(KEKEnv), getenv(KEKFileEnv)
+	if *kekFile != "" {
+		spec, path = "", *kekFile
+	}
+	keyring, err := crypto.LoadKeyring(spec, path)
+	if err != nil {
+		fmt.Fprintln(stderr, "error: invalid key-encryption keys:", err)
+		return ExitUsage
+	}
+	if keyring == nil {
+		fmt.Fprintf(stderr, "error: no key-encryption keys, set %s or %s\n", KEKEnv, KEKFileEnv)
+		return ExitUsage
+	}
+
+	storage, err := openStorage(*backend, *sqlitePath, *fileDir)
+	if errors.Is(err, persistence.ErrStorageInUse) {
+		fmt.Fprintln(stderr, "error:", err)
+		fmt.Fprintln(stderr, "stop the service, run rewrap and start the service again")
+		return ExitFailed
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return ExitUsage
+	}
+	defer storage.Close()
+
+	service := domain.NewSignatureService(storage, domain.WithKeyring(keyring))
+	report, err := service.RewrapPrivateKeys(context.Background())
+	if report != nil {
+		fmt.Fprintf(stdout, "%d re-wrapped, %d sealed, %d already sealed with %s\n",
+			report.Rewrapped, report.Sealed, report.Unchanged, keyring.PrimaryID())
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "FAIL:", err)
+		return ExitFailed
+	}
+	if len(report.Skipped) > 0 {
+		fmt.Fprintf(stderr, "FAIL: the keys of %d devices changed concurrently, run rewrap again: %v\n",
+			len(report.Skipped), report.Skipped)
+		return ExitFailed
+	}
+	return ExitOK
+}
+
+// closableStorage is a storage that holds files open.
+type closableStorage interface {
+	persistence.Storage
+	Close() error
+}
+
+func openStorage(backend string, sqlitePath string, fileDir string) (closableStorage, error) {
+	switch backend {
+	case "sqlite":
+		return persistence.OpenSQLiteStorage(sqlitePath)
+	case "file":
+		return persistence.OpenFileStorage(fileDir, persistence.DefaultSnapshotInterval)
+	case "":
+		return nil, errors.New("-storage is required, in-memory devices cannot be re-wrapped offline")
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
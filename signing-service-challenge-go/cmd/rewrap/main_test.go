@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var (
+	kek1 = "kek-1:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, crypto.KeyEncryptionKeySize))
+	kek2 = "kek-2:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, crypto.KeyEncryptionKeySize))
+)
+
+func runRewrap(env map[string]string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, func(name string) string { return env[name] }, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// createDevice creates a device in the SQLite database, sealed if a keyring is given.
+func createDevice(t *testing.T, path string, keyring string) string {
+	storage, err := persistence.OpenSQLiteStorage(path)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	var options []domain.ServiceOption
+	if keyring != "" {
+		parsed, err := crypto.ParseKeyring(keyring)
+		assert.NoError(t, err)
+		options = append(options, domain.WithKeyring(parsed))
+	}
+	device, err := domain.NewSignatureService(storage, options...).
+		CreateDevice(context.Background(), domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	return device.ID
+}
+
+func TestRewrapsSQLiteDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-service.db")
+	plain := createDevice(t, path, "")
+	sealed := createDevice(t, path, kek1)
+
+	code, stdout, stderr := runRewrap(map[string]string{KEKEnv: kek2 + "," + kek1}, "-storage", "sqlite", "-sqlite-path", path)
+	assert.Equal(t, ExitOK, code, stderr)
+	assert.Equal(t, "1 re-wrapped, 1 sealed, 0 already sealed with kek-2\n", stdout)
+
+	// The old key-encryption key is no longer needed.
+	storage, err := persistence.OpenSQLiteStorage(path)
+	assert.NoError(t, err)
+	defer storage.Close()
+	keyring, err := crypto.ParseKeyring(kek2)
+	assert.NoError(t, err)
+	service := domain.NewSignatureService(storage, domain.WithKeyring(keyring))
+	for _, id := range []string{plain, sealed} {
+		_, err = service.Sign(context.Background(), id, "after rotation")
+		assert.NoError(t, err)
+	}
+}
+
+func TestRewrapReadsKeyEncryptionKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	kekFile := filepath.Join(dir, "keks.txt")
+	assert.NoError(t, os.WriteFile(kekFile, []byte(kek2+"\n"+kek1+"\n"), 0o600))
+	fileDir := filepath.Join(dir, "data")
+
+	storage, err := persistence.OpenFileStorage(fileDir, 0)
+	assert.NoError(t, err)
+	_, err = domain.NewSignatureService(storage).CreateDevice(context.Background(), domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Close())
+
+	code, stdout, stderr := runRewrap(map[string]string{KEKEnv: kek1}, "-storage", "file", "-file-dir", fileDir, "-kek-file", kekFile)
+	assert.Equal(t, ExitOK, code, stderr)
+	assert.Equal(t, "0 re-wrapped, 1 sealed, 0 already sealed with kek-2\n", stdout)
+
+	code, stdout, _ = runRewrap(map[string]string{KEKFileEnv: kekFile}, "-storage", "file", "-file-dir", fileDir)
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "0 re-wrapped, 0 sealed, 1 already sealed with kek-2\n", stdout)
+}
+
+func TestRewrapRefusesFileStorageInUse(t *testing.T) {
+	fileDir := filepath.Join(t.TempDir(), "data")
+	storage, err := persistence.OpenFileStorage(fileDir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	code, _, stderr := runRewrap(map[string]string{KEKEnv: kek1}, "-storage", "file", "-file-dir", fileDir)
+	assert.Equal(t, ExitFailed, code)
+	assert.Contains(t, stderr, "file storage is in use")
+	assert.Contains(t, stderr, "stop the service")
+}
+
+func TestRewrapUsageErrors(t *testing.T) {
+	code, _, stderr := runRewrap(nil, "-storage", "sqlite")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "no key-encryption keys")
+
+	code, _, stderr = runRewrap(map[string]string{KEKEnv: kek1})
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "-storage is required")
+
+	code, _, stderr = runRewrap(map[string]string{KEKEnv: "kek-1:c2hvcnQ="}, "-storage", "sqlite")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "must be 32 bytes long")
+}
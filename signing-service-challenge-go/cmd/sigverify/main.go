@@ -0,0 +1,249 @@
+// Command sigverify verifies an exported signature log of a signature device offline.
+//
+// The log is read as JSON Lines, one signature record per line in counter order, such as the
+// signatures.jsonl of the archive served by GET /api/v1/devices/{id}/export. The public key is the
+// PEM encoded key the device was created with, either in the format written by the key marshalers or
+// as a standard "PUBLIC KEY" block. Alternatively -keys reads it from the keys.json of the archive.
+// The public_key.pem of the archive only verifies the log if the key of the device was never rotated.
+//
+//	sigverify -log signatures.jsonl (-public-key device.pem | -keys keys.json) [-device-id ID]
+//	          [-algorithm ECC] [-scheme RSA_PSS] [-hash SHA-256] [-salt-length 32]
+//
+// Every signature is verified against the public key and the signature chain is checked: counters
+// have to be contiguous from 0 and every signed_data has to reference the previous signature.
+// The records following a key transition record are verified against the public key it carries.
+// sigverify stops at the first violation, prints a diagnostic naming the line and the counter
+// and exits with status 1. Invalid arguments or unreadable input exit with status 2.
+package main
+
+import (
+	"bufio"
+	stdcrypto "crypto"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"io"
+	"os"
+)
+
+// Exit codes of sigverify.
+const (
+	ExitOK        = 0
+	ExitViolation = 1
+	ExitUsage     = 2
+)
+
+// maxLineSize limits the size of a single signature record in the log.
+const maxLineSize = 1 << 20
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+type config struct {
+	logPath       string
+	publicKeyPath string
+	keysPath      string
+	deviceID      string
+	algorithm     string
+	options       crypto.SignatureOptions
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sigverify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	var cfg config
+	flags.StringVar(&cfg.logPath, "log", "", "signature log in JSON Lines format, - reads from stdin")
+	flags.StringVar(&cfg.publicKeyPath, "public-key", "", "PEM encoded public key the device was created with")
+	flags.StringVar(&cfg.keysPath, "keys", "", "keys.json of an export archive, instead of -public-key")
+	flags.StringVar(&cfg.deviceID, "device-id", "", "ID of the device, defaults to the device_id of the first record")
+	flags.StringVar(&cfg.algorithm, "algorithm", "", "signature algorithm, defaults to the algorithm of the first record")
+	flags.StringVar(&cfg.options.Scheme, "scheme", "", "RSA signature scheme (RSA_PKCS1V15 or RSA_PSS)")
+	flags.StringVar(&cfg.options.Hash, "hash", "", "hash algorithm of the signatures, defaults per algorithm")
+	flags.IntVar(&cfg.options.SaltLength, "salt-length", 0, "salt length of RSA-PSS signatures")
+	if err := flags.Parse(args); err != nil {
+		return ExitUsage
+	}
+	if cfg.logPath == "" || (cfg.publicKeyPath == "") == (cfg.keysPath == "") || flags.NArg() > 0 {
+		fmt.Fprintln(stderr, "usage: sigverify -log FILE (-public-key FILE | -keys FILE) [options]")
+		flags.PrintDefaults()
+		return ExitUsage
+	}
+
+	publicKey, err := readPublicKey(&cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, "error:", err)
+		return ExitUsage
+	}
+
+	log := stdin
+	if cfg.logPath != "-" {
+		file, err := os.Open(cfg.logPath)
+		if err != nil {
+			fmt.Fprintln(stderr, "error:", err)
+			return ExitUsage
+		}
+		defer file.Close()
+		log = file
+	}
+
+	checked, err := verifyLog(log, publicKey, &cfg)
+	if err != nil {
+		var violation *violationError
+		if errors.As(err, &violation) {
+			fmt.Fprintln(stderr, "FAIL:", err)
+			return ExitViolation
+		}
+		fmt.Fprintln(stderr, "error:", err)
+		return ExitUsage
+	}
+
+	fmt.Fprintf(stdout, "OK: %d signatures verified for device %s\n", checked, cfg.deviceID)
+	return ExitOK
+}
+
+// violationError is a record of the log that breaks the signature chain.
+type violationError struct {
+	line      int
+	violation *domain.ChainViolation
+}
+
+func (e *violationError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.violation)
+}
+
+// verifyLog checks all records of the log and returns the number of verified signatures.
+// The device ID and algorithm of the configuration are filled in from the first record if empty.
+func verifyLog(log io.Reader, publicKeyBytes []byte, cfg *config) (int32, error) {
+	scanner := bufio.NewScanner(log)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	var chain *domain.ChainVerifier
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record domain.SignatureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return 0, fmt.Errorf("line %d: invalid signature record: %w", line, err)
+		}
+
+		if chain == nil {
+			if cfg.deviceID == "" {
+				cfg.deviceID = record.DeviceID
+			}
+			if cfg.algorithm == "" {
+				cfg.algorithm = record.Algorithm
+			}
+			verifier, err := newVerifier(cfg, publicKeyBytes)
+			if err != nil {
+				return 0, err
+			}
+			chain = domain.NewChainVerifier(cfg.deviceID, verifier)
+			chain.FollowKeyTransitions(func(publicKey stdcrypto.PublicKey) (crypto.Verifier, error) {
+				return newKeyVerifier(cfg, publicKey)
+			})
+		}
+
+		if record.DeviceID != cfg.deviceID {
+			return 0, &violationError{line: line, violation: &domain.ChainViolation{
+				Counter: record.Counter,
+				Reason:  domain.ViolationDeviceStateMismatch,
+				Message: fmt.Sprintf("record belongs to device %q instead of %q", record.DeviceID, cfg.deviceID),
+			}}
+		}
+		if record.Algorithm != "" && record.Algorithm != cfg.algorithm {
+			return 0, &violationError{line: line, violation: &domain.ChainViolation{
+				Counter: record.Counter,
+				Reason:  domain.ViolationDeviceStateMismatch,
+				Message: fmt.Sprintf("record was signed with %s instead of %s", record.Algorithm, cfg.algorithm),
+			}}
+		}
+		if violation := chain.Verify(&record); violation != nil {
+			return 0, &violationError{line: line, violation: violation}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("line %d: %w", line+1, err)
+	}
+	if chain == nil {
+		if cfg.deviceID == "" {
+			return 0, errors.New("signature log is empty and no -device-id was given")
+		}
+		return 0, nil
+	}
+	return chain.Checked(), nil
+}
+
+// readPublicKey reads the PEM encoded public key the device was created with, from -public-key
+// or as the first key of -keys.
+func readPublicKey(cfg *config) ([]byte, error) {
+	if cfg.publicKeyPath != "" {
+		return os.ReadFile(cfg.publicKeyPath)
+	}
+
+	data, err := os.ReadFile(cfg.keysPath)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*domain.DeviceKeyResponse
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid keys file: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("keys file holds no key")
+	}
+	return []byte(keys[0].PublicKey), nil
+}
+
+// newVerifier parses the public key and creates the verifier for the configured algorithm and options.
+func newVerifier(cfg *config, publicKeyBytes []byte) (crypto.Verifier, error) {
+	if cfg.algorithm == "" {
+		return nil, errors.New("the algorithm is unknown, pass -algorithm")
+	}
+	algorithm, err := crypto.LookupAlgorithm(cfg.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := crypto.ParsePublicKeyPEM(algorithm, publicKeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return newKeyVerifier(cfg, publicKey)
+}
+
+// newKeyVerifier creates the verifier of a parsed public key for the configured algorithm and options.
+func newKeyVerifier(cfg *config, publicKey stdcrypto.PublicKey) (crypto.Verifier, error) {
+	algorithm, err := crypto.LookupAlgorithm(cfg.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	options := cfg.options
+	if algorithm.NewSignatureOptions != nil {
+		keyOptions, err := crypto.PublicKeyOptions(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		options, err = algorithm.NewSignatureOptions(keyOptions, options)
+		if err != nil {
+			return nil, err
+		}
+	} else if options != (crypto.SignatureOptions{}) {
+		return nil, fmt.Errorf("%w: %s does not support signature options", crypto.ErrInvalidOptions, algorithm.Name)
+	}
+
+	verifier, err := algorithm.NewVerifier(publicKey, options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return verifier, nil
+}
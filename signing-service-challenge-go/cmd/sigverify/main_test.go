@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exportDevice signs count transactions with a new device and writes its signature log and public key.
+func exportDevice(t *testing.T, request domain.CreateSignatureDeviceRequest, count int) (string, string, []*domain.SignatureRecord) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage)
+
+	device, err := service.CreateDevice(ctx, request)
+	assert.NoError(t, err)
+
+	records := make([]*domain.SignatureRecord, 0, count)
+	for i := 0; i < count; i++ {
+		record, err := service.Sign(ctx, device.ID, "transaction")
+		assert.NoError(t, err)
+		records = append(records, record)
+	}
+
+	internal, err := storage.GetSignatureDevice(ctx, device.ID)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	publicKeyPath := filepath.Join(dir, "device.pem")
+	assert.NoError(t, os.WriteFile(publicKeyPath, internal.PublicKey, 0o600))
+	return writeLog(t, dir, records), publicKeyPath, records
+}
+
+func writeLog(t *testing.T, dir string, records []*domain.SignatureRecord) string {
+	var log bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		assert.NoError(t, err)
+		log.Write(append(line, '\n'))
+	}
+
+	logPath := filepath.Join(dir, "signatures.jsonl")
+	assert.NoError(t, os.WriteFile(logPath, log.Bytes(), 0o600))
+	return logPath
+}
+
+func runSigverify(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestVerifiesSignatureLog(t *testing.T) {
+	requests := map[string]domain.CreateSignatureDeviceRequest{
+		"ECC":     {Algorithm: "ECC"},
+		"RSA":     {Algorithm: "RSA"},
+		"RSA-PSS": {Algorithm: "RSA", SignatureScheme: "RSA_PSS", HashAlgorithm: "SHA-512"},
+		"ED25519": {Algorithm: "ED25519"},
+	}
+	for name, request := range requests {
+		t.Run(name, func(t *testing.T) {
+			logPath, publicKeyPath, records := exportDevice(t, request, 3)
+
+			args := []string{"-log", logPath, "-public-key", publicKeyPath}
+			if request.SignatureScheme != "" {
+				args = append(args, "-scheme", request.SignatureScheme, "-hash", request.HashAlgorithm)
+			}
+			code, stdout, stderr := runSigverify(args...)
+			assert.Equal(t, ExitOK, code, stderr)
+			assert.Equal(t, "OK: 3 signatures verified for device "+records[0].DeviceID+"\n", stdout)
+		})
+	}
+}
+
+func TestVerifiesSignatureLogAcrossKeyRotations(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage)
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "RSA"})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = service.Sign(ctx, device.ID, "transaction")
+		assert.NoError(t, err)
+		device, _, _, err = service.RotateKey(ctx, device.ID)
+		assert.NoError(t, err)
+	}
+	_, err = service.Sign(ctx, device.ID, "transaction")
+	assert.NoError(t, err)
+
+	records, err := storage.ListSignatures(ctx, device.ID, domain.SignatureFilter{})
+	assert.NoError(t, err)
+	keys, err := service.ListDeviceKeys(ctx, device.ID)
+	assert.NoError(t, err)
+	keyResponses := make([]*domain.DeviceKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		keyResponse, err := device.KeyResponse(key)
+		assert.NoError(t, err)
+		keyResponses = append(keyResponses, keyResponse)
+	}
+	keysFile, err := json.Marshal(keyResponses)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	logPath := writeLog(t, dir, records)
+	keysPath := filepath.Join(dir, "keys.json")
+	assert.NoError(t, os.WriteFile(keysPath, keysFile, 0o600))
+	currentKeyPath := filepath.Join(dir, "public_key.pem")
+	assert.NoError(t, os.WriteFile(currentKeyPath, []byte(keyResponses[2].PublicKey), 0o600))
+
+	code, stdout, stderr := runSigverify("-log", logPath, "-keys", keysPath)
+	assert.Equal(t, ExitOK, code, stderr)
+	assert.Equal(t, "OK: 5 signatures verified for device "+device.ID+"\n", stdout)
+
+	// The current key only verifies the records signed after the last rotation.
+	code, _, stderr = runSigverify("-log", logPath, "-public-key", currentKeyPath)
+	assert.Equal(t, ExitViolation, code)
+	assert.Contains(t, stderr, "FAIL: line 1: signature 0: invalid_signature")
+}
+
+func TestReportsFirstViolation(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(records []*domain.SignatureRecord) []*domain.SignatureRecord
+		want   string
+	}{
+		{
+			name: "missing record",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				return append(records[:1], records[2:]...)
+			},
+			want: "line 2: signature 2: counter_gap: expected signature counter 1",
+		},
+		{
+			name: "altered data",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[1].DataToBeSigned = "altered"
+				return records
+			},
+			want: "line 2: signature 1: signed_data_mismatch",
+		},
+		{
+			name: "forged signature",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[2].Signature = records[1].Signature
+				return records
+			},
+			want: "line 3: signature 2: invalid_signature",
+		},
+		{
+			name: "foreign device",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[1].DeviceID = "other"
+				return records
+			},
+			want: "line 2: signature 1: device_state_mismatch",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logPath, publicKeyPath, records := exportDevice(t, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"}, 3)
+			logPath = writeLog(t, filepath.Dir(logPath), test.tamper(records))
+
+			code, stdout, stderr := runSigverify("-log", logPath, "-public-key", publicKeyPath)
+			assert.Equal(t, ExitViolation, code)
+			assert.Empty(t, stdout)
+			assert.Contains(t, stderr, "FAIL: "+test.want)
+		})
+	}
+}
+
+func TestRejectsWrongPublicKey(t *testing.T) {
+	logPath, _, _ := exportDevice(t, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"}, 1)
+	_, otherPublicKeyPath, _ := exportDevice(t, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"}, 0)
+
+	code, _, stderr := runSigverify("-log", logPath, "-public-key", otherPublicKeyPath)
+	assert.Equal(t, ExitViolation, code)
+	assert.Contains(t, stderr, "FAIL: line 1: signature 0: invalid_signature")
+}
+
+func TestUsageErrors(t *testing.T) {
+	logPath, publicKeyPath, _ := exportDevice(t, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"}, 1)
+
+	code, _, _ := runSigverify("-log", logPath)
+	assert.Equal(t, ExitUsage, code)
+	code, _, _ = runSigverify("-log", logPath, "-public-key", publicKeyPath, "-keys", publicKeyPath)
+	assert.Equal(t, ExitUsage, code)
+
+	code, _, stderr := runSigverify("-log", logPath, "-public-key", publicKeyPath, "-hash", "SHA-512")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "does not support signature options")
+
+	assert.NoError(t, os.WriteFile(logPath, []byte("not json\n"), 0o600))
+	code, _, stderr = runSigverify("-log", logPath, "-public-key", publicKeyPath)
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "line 1: invalid signature record")
+}
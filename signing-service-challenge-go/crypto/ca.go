@@ -0,0 +1,393 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Validity periods of the certificates issued by a CertificateAuthority.
+const (
+	RootCertificateValidity         = 20 * 365 * 24 * time.Hour
+	IntermediateCertificateValidity = 10 * 365 * 24 * time.Hour
+	DefaultCertificateValidity      = 2 * 365 * 24 * time.Hour
+	// CRLValidity is the time until the next update announced by a certificate revocation list.
+	CRLValidity = 24 * time.Hour
+)
+
+// Files of a certificate authority directory. The root key is only needed to issue a new intermediate
+// certificate and can be moved offline once the directory has been created.
+const (
+	RootCertificateFile         = "root.pem"
+	RootKeyFile                 = "root-key.pem"
+	IntermediateCertificateFile = "intermediate.pem"
+	IntermediateKeyFile         = "intermediate-key.pem"
+)
+
+// PEM block types of the private keys in a certificate authority directory. A sealed private key holds
+// the SealedKey of the PKCS #8 encoded key, sealed with the name of its file as associated data.
+const (
+	privateKeyBlockType       = "PRIVATE KEY"
+	sealedPrivateKeyBlockType = "SEALED PRIVATE KEY"
+)
+
+// DefaultCertificateAuthorityName is the organization of the certificate authority if none is configured.
+const DefaultCertificateAuthorityName = "Signing Service"
+
+// oidCRLReason identifies the reason code extension of a revoked certificate entry (RFC 5280, 5.3.1).
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// CertificateAuthorityConfig configures a CertificateAuthority. An empty Dir keeps the root and
+// intermediate keys in memory only. A non-empty CRLURL is added as the CRL distribution point of issued
+// certificates. With a Keyring, the keys in Dir are sealed like the private keys of the devices.
+type CertificateAuthorityConfig struct {
+	Dir     string
+	Name    string
+	CRLURL  string
+	Keyring *Keyring
+}
+
+// CertificateAuthority is a two-tier certificate authority. The intermediate key issues the certificates
+// and revocation lists, the root certificate is the trust anchor.
+type CertificateAuthority struct {
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	key          crypto.Signer
+	crlURL       string
+}
+
+// CertificateRequest describes a certificate to be issued for a public key.
+type CertificateRequest struct {
+	PublicKey    crypto.PublicKey
+	SerialNumber *big.Int
+	Subject      pkix.Name
+	NotBefore    time.Time
+	NotAfter     time.Time
+}
+
+// RevokedCertificate is an entry of a certificate revocation list. The reason code is one of RFC 5280.
+type RevokedCertificate struct {
+	SerialNumber *big.Int
+	RevokedAt    time.Time
+	ReasonCode   int
+}
+
+// OpenCertificateAuthority loads the certificate authority from its directory. If the directory holds
+// no intermediate certificate yet, a new root and intermediate key pair is generated and written to it.
+// With a keyring, keys found in the clear are sealed and keys sealed with an older key-encryption key
+// are re-wrapped with the primary one, so the previous key-encryption key can be dropped afterwards.
+// Sealed keys cannot be opened without a keyring.
+func OpenCertificateAuthority(config CertificateAuthorityConfig) (*CertificateAuthority, error) {
+	if config.Name == "" {
+		config.Name = DefaultCertificateAuthorityName
+	}
+	if config.Dir == "" {
+		return newCertificateAuthority(config, nil)
+	}
+
+	_, err := os.Stat(filepath.Join(config.Dir, IntermediateCertificateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(config.Dir, 0o700)
+		if err != nil {
+			return nil, err
+		}
+		return newCertificateAuthority(config, writePEMFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &CertificateAuthority{crlURL: config.CRLURL}
+	ca.root, err = readCertificateFile(filepath.Join(config.Dir, RootCertificateFile))
+	if err != nil {
+		return nil, err
+	}
+	ca.intermediate, err = readCertificateFile(filepath.Join(config.Dir, IntermediateCertificateFile))
+	if err != nil {
+		return nil, err
+	}
+	ca.key, err = openKeyFile(config.Dir, IntermediateKeyFile, config.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	// The root key may have been moved offline.
+	_, err = openKeyFile(config.Dir, RootKeyFile, config.Keyring)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if !ca.key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(ca.intermediate.PublicKey) {
+		return nil, errors.New("the intermediate key does not match the intermediate certificate")
+	}
+	err = ca.intermediate.CheckSignatureFrom(ca.root)
+	if err != nil {
+		return nil, fmt.Errorf("the intermediate certificate is not issued by the root certificate: %w", err)
+	}
+	return ca, nil
+}
+
+// newCertificateAuthority generates the root and intermediate key pairs and certificates.
+// The certificates and keys are passed to write, if given, with the name of their file.
+func newCertificateAuthority(config CertificateAuthorityConfig, write func(path string, block *pem.Block) error) (*CertificateAuthority, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{config.Name}, CommonName: config.Name + " Root CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(RootCertificateValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	root, err := createCertificate(rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := createCertificate(&x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{Organization: []string{config.Name}, CommonName: config.Name + " Device CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(IntermediateCertificateValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}, root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if write != nil {
+		for _, file := range []struct {
+			name string
+			key  *ecdsa.PrivateKey
+			cert *x509.Certificate
+		}{
+			{RootKeyFile, rootKey, nil},
+			{RootCertificateFile, nil, root},
+			{IntermediateKeyFile, intermediateKey, nil},
+			{IntermediateCertificateFile, nil, intermediate},
+		} {
+			block := &pem.Block{Type: "CERTIFICATE"}
+			if file.key != nil {
+				der, err := x509.MarshalPKCS8PrivateKey(file.key)
+				if err != nil {
+					return nil, err
+				}
+				block, err = encodeKeyBlock(der, file.name, config.Keyring)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				block.Bytes = file.cert.Raw
+			}
+			// The intermediate certificate is written last, it marks the directory as complete.
+			err = write(filepath.Join(config.Dir, file.name), block)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &CertificateAuthority{
+		root:         root,
+		intermediate: intermediate,
+		key:          intermediateKey,
+		crlURL:       config.CRLURL,
+	}, nil
+}
+
+// Issue creates a certificate for the public key of the request, signed by the intermediate key.
+// The certificate can be used to verify signatures, the result is DER encoded.
+func (ca *CertificateAuthority) Issue(request CertificateRequest) ([]byte, error) {
+	template := &x509.Certificate{
+		SerialNumber:          request.SerialNumber,
+		Subject:               request.Subject,
+		NotBefore:             request.NotBefore,
+		NotAfter:              request.NotAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment,
+		BasicConstraintsValid: true,
+	}
+	if ca.crlURL != "" {
+		template.CRLDistributionPoints = []string{ca.crlURL}
+	}
+	if template.NotAfter.After(ca.intermediate.NotAfter) {
+		template.NotAfter = ca.intermediate.NotAfter
+	}
+
+	certificate, err := createCertificate(template, ca.intermediate, request.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return certificate.Raw, nil
+}
+
+// Chain returns the DER encoded intermediate and root certificates, in this order.
+func (ca *CertificateAuthority) Chain() [][]byte {
+	return [][]byte{ca.intermediate.Raw, ca.root.Raw}
+}
+
+// Root returns the root certificate, the trust anchor of the issued certificates.
+func (ca *CertificateAuthority) Root() *x509.Certificate {
+	return ca.root
+}
+
+// CreateCRL creates a DER encoded certificate revocation list of the revoked certificates, signed by
+// the intermediate key. The CRL number is derived from the time of the update, so it increases with
+// every list.
+func (ca *CertificateAuthority) CreateCRL(revoked []RevokedCertificate, thisUpdate time.Time) ([]byte, error) {
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, certificate := range revoked {
+		reason, err := asn1.Marshal(asn1.Enumerated(certificate.ReasonCode))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, pkix.RevokedCertificate{
+			SerialNumber:   certificate.SerialNumber,
+			RevocationTime: certificate.RevokedAt.UTC(),
+			Extensions:     []pkix.Extension{{Id: oidCRLReason, Value: reason}},
+		})
+	}
+
+	return x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(thisUpdate.UnixNano()),
+		ThisUpdate:          thisUpdate.UTC(),
+		NextUpdate:          thisUpdate.UTC().Add(CRLValidity),
+		RevokedCertificates: entries,
+	}, ca.intermediate, ca.key)
+}
+
+func createCertificate(template *x509.Certificate, parent *x509.Certificate, publicKey crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func writePEMFile(path string, block *pem.Block) error {
+	return os.WriteFile(path, pem.EncodeToMemory(block), 0o600)
+}
+
+// replacePEMFile replaces the file through a temporary file, so that it is never left half written.
+func replacePEMFile(path string, block *pem.Block) error {
+	err := writePEMFile(path+".tmp", block)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func readPEMFile(path string, blockTypes ...string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block != nil {
+		for _, blockType := range blockTypes {
+			if block.Type == blockType {
+				return block, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s holds no %s PEM block", path, blockTypes[0])
+}
+
+func readCertificateFile(path string) (*x509.Certificate, error) {
+	block, err := readPEMFile(path, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// encodeKeyBlock encodes the PKCS #8 private key stored in the named file, sealed if a keyring is given.
+func encodeKeyBlock(der []byte, name string, keyring *Keyring) (*pem.Block, error) {
+	if keyring == nil {
+		return &pem.Block{Type: privateKeyBlockType, Bytes: der}, nil
+	}
+	sealed, _, err := keyring.Seal(der, []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: sealedPrivateKeyBlockType, Bytes: sealed}, nil
+}
+
+// openKeyFile reads the named private key file of the directory. With a keyring, a key in the clear is
+// sealed and a key sealed with an older key-encryption key is re-wrapped, and the file is replaced.
+func openKeyFile(dir string, name string, keyring *Keyring) (crypto.Signer, error) {
+	path := filepath.Join(dir, name)
+	block, err := readPEMFile(path, privateKeyBlockType, sealedPrivateKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+
+	der := block.Bytes
+	var replacement *pem.Block
+	switch {
+	case block.Type == privateKeyBlockType && keyring != nil:
+		replacement, err = encodeKeyBlock(der, name, keyring)
+		if err != nil {
+			return nil, err
+		}
+	case block.Type == sealedPrivateKeyBlockType:
+		if keyring == nil {
+			return nil, fmt.Errorf("%s is sealed and no key-encryption keys are configured", path)
+		}
+		der, err = keyring.Open(block.Bytes, []byte(name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var envelope SealedKey
+		err = json.Unmarshal(block.Bytes, &envelope)
+		if err != nil {
+			return nil, err
+		}
+		if envelope.KeyEncryptionKeyID != keyring.PrimaryID() {
+			rewrapped, _, err := keyring.Rewrap(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			replacement = &pem.Block{Type: sealedPrivateKeyBlockType, Bytes: rewrapped}
+		}
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s holds no signing key", path)
+	}
+	if replacement != nil {
+		err = replacePEMFile(path, replacement)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signer, nil
+}
@@ -0,0 +1,182 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateAuthorityIssuesVerifiableCertificates(t *testing.T) {
+	ca, err := OpenCertificateAuthority(CertificateAuthorityConfig{CRLURL: "http://localhost/crl"})
+	assert.NoError(t, err)
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	now := time.Now().UTC().Truncate(time.Second)
+	der, err := ca.Issue(CertificateRequest{
+		PublicKey:    publicKey,
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "till 1", SerialNumber: "device-1"},
+		NotBefore:    now,
+		NotAfter:     now.Add(RootCertificateValidity),
+	})
+	assert.NoError(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	assert.Equal(t, "till 1", certificate.Subject.CommonName)
+	assert.Equal(t, "device-1", certificate.Subject.SerialNumber)
+	assert.Equal(t, big.NewInt(42), certificate.SerialNumber)
+	assert.Equal(t, publicKey, certificate.PublicKey)
+	assert.Equal(t, []string{"http://localhost/crl"}, certificate.CRLDistributionPoints)
+	assert.False(t, certificate.IsCA)
+	// Certificates do not outlive the intermediate certificate.
+	assert.False(t, certificate.NotAfter.After(now.Add(IntermediateCertificateValidity)))
+
+	chain := ca.Chain()
+	assert.Len(t, chain, 2)
+	intermediate, err := x509.ParseCertificate(chain[0])
+	assert.NoError(t, err)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(intermediate)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Root())
+	_, err = certificate.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	assert.NoError(t, err)
+}
+
+func TestCertificateAuthorityWithoutCRLURL(t *testing.T) {
+	ca, err := OpenCertificateAuthority(CertificateAuthorityConfig{})
+	assert.NoError(t, err)
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	now := time.Now()
+	der, err := ca.Issue(CertificateRequest{
+		PublicKey:    publicKey,
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "till 1"},
+		NotBefore:    now,
+		NotAfter:     now.Add(DefaultCertificateValidity),
+	})
+	assert.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	assert.Empty(t, certificate.CRLDistributionPoints)
+}
+
+func TestOpenCertificateAuthorityReloadsItsKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	created, err := OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Name: "Test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Test Root CA", created.Root().Subject.CommonName)
+
+	info, err := os.Stat(filepath.Join(dir, IntermediateKeyFile))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	reopened, err := OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Name: "Test"})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Chain(), reopened.Chain())
+
+	// An intermediate key that does not belong to the certificate is refused.
+	other, err := OpenCertificateAuthority(CertificateAuthorityConfig{Dir: filepath.Join(t.TempDir(), "other")})
+	assert.NoError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(other.key)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, IntermediateKeyFile), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600)
+	assert.NoError(t, err)
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir})
+	assert.Error(t, err)
+}
+
+func TestOpenCertificateAuthoritySealsItsKeys(t *testing.T) {
+	keyBlockType := func(dir string, name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		block, _ := pem.Decode(data)
+		assert.NotNil(t, block)
+		return block.Type
+	}
+	previous, err := NewKeyring(newTestKeyEncryptionKey(t, "kek-1", 1))
+	assert.NoError(t, err)
+	keyring, err := NewKeyring(newTestKeyEncryptionKey(t, "kek-2", 2), newTestKeyEncryptionKey(t, "kek-1", 1))
+	assert.NoError(t, err)
+	rotated, err := NewKeyring(newTestKeyEncryptionKey(t, "kek-2", 2))
+	assert.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "ca")
+	created, err := OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: previous})
+	assert.NoError(t, err)
+	assert.Equal(t, "SEALED PRIVATE KEY", keyBlockType(dir, RootKeyFile))
+	assert.Equal(t, "SEALED PRIVATE KEY", keyBlockType(dir, IntermediateKeyFile))
+
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir})
+	assert.ErrorContains(t, err, "no key-encryption keys")
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: rotated})
+	assert.ErrorIs(t, err, ErrUnknownKeyEncryptionKey)
+
+	// Opening with the new primary key-encryption key re-wraps the keys, the old one can be dropped then.
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: keyring})
+	assert.NoError(t, err)
+	reopened, err := OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: rotated})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Chain(), reopened.Chain())
+
+	// Keys stored in the clear are sealed once a keyring is configured.
+	dir = filepath.Join(t.TempDir(), "clear")
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir})
+	assert.NoError(t, err)
+	assert.Equal(t, "PRIVATE KEY", keyBlockType(dir, IntermediateKeyFile))
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: rotated})
+	assert.NoError(t, err)
+	assert.Equal(t, "SEALED PRIVATE KEY", keyBlockType(dir, RootKeyFile))
+	assert.Equal(t, "SEALED PRIVATE KEY", keyBlockType(dir, IntermediateKeyFile))
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: rotated})
+	assert.NoError(t, err)
+
+	// The root key may be moved offline.
+	assert.NoError(t, os.Remove(filepath.Join(dir, RootKeyFile)))
+	_, err = OpenCertificateAuthority(CertificateAuthorityConfig{Dir: dir, Keyring: rotated})
+	assert.NoError(t, err)
+}
+
+func TestCertificateAuthorityCreatesCRL(t *testing.T) {
+	ca, err := OpenCertificateAuthority(CertificateAuthorityConfig{})
+	assert.NoError(t, err)
+
+	revokedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	der, err := ca.CreateCRL([]RevokedCertificate{
+		{SerialNumber: big.NewInt(7), RevokedAt: revokedAt, ReasonCode: 1},
+	}, revokedAt.Add(time.Hour))
+	assert.NoError(t, err)
+
+	crl, err := x509.ParseRevocationList(der)
+	assert.NoError(t, err)
+	intermediate, err := x509.ParseCertificate(ca.Chain()[0])
+	assert.NoError(t, err)
+	assert.NoError(t, crl.CheckSignatureFrom(intermediate))
+	assert.Equal(t, revokedAt.Add(time.Hour+CRLValidity), crl.NextUpdate)
+	if assert.Len(t, crl.RevokedCertificates, 1) {
+		entry := crl.RevokedCertificates[0]
+		assert.Equal(t, big.NewInt(7), entry.SerialNumber)
+		assert.Equal(t, revokedAt, entry.RevocationTime)
+		var reason asn1.Enumerated
+		_, err = asn1.Unmarshal(entry.Extensions[0].Value, &reason)
+		assert.NoError(t, err)
+		assert.Equal(t, asn1.Enumerated(1), reason)
+	}
+}
@@ -1,27 +1,84 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 )
 
+func init() {
+	RegisterAlgorithm(&Algorithm{
+		Name:                "ECC",
+		NewGenerator:        newECCGenerator,
+		NewSignatureOptions: newECCSignatureOptions,
+		Marshaler:           eccKeyMarshaler{},
+		NewSigner: func(keyPair interface{}, options SignatureOptions) (Signer, error) {
+			eccKeyPair, err := CastToECCKeyPair(keyPair)
+			if err != nil {
+				return nil, err
+			}
+			hash, err := LookupHash(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			return &ECCSigner{KeyPair: eccKeyPair, Hash: hash}, nil
+		},
+		NewVerifier: func(publicKey crypto.PublicKey, options SignatureOptions) (Verifier, error) {
+			eccPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+			if !ok {
+				return nil, errors.New("public key is not an ECC public key")
+			}
+			hash, err := LookupHash(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			return &ECCVerifier{PublicKey: eccPublicKey, Hash: hash}, nil
+		},
+	})
+}
+
 // ECCKeyPair is a DTO that holds ECC private and public keys.
 type ECCKeyPair struct {
 	Public  *ecdsa.PublicKey
 	Private *ecdsa.PrivateKey
 }
 
-// ECCGenerator generates an ECC key pair.
-type ECCGenerator struct{}
+// DefaultECCCurve is the name of the curve used when none is requested.
+const DefaultECCCurve = "P-384"
+
+// ECCCurves maps the allowed curve names to their implementation.
+var ECCCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// ECCCurveHashes maps the curve names to the digest algorithm matching their security level.
+var ECCCurveHashes = map[string]string{
+	"P-256": HashSHA256,
+	"P-384": HashSHA384,
+	"P-521": HashSHA512,
+}
+
+// ECCGenerator generates an ECC key pair on the given curve, P-384 if unset.
+type ECCGenerator struct {
+	Curve elliptic.Curve
+}
 
 // Generate generates a new ECCKeyPair.
 func (g *ECCGenerator) Generate() (interface{}, error) {
+	curve := g.Curve
+	if curve == nil {
+		curve = ECCCurves[DefaultECCCurve]
+	}
+
 	// Security has been ignored for the sake of simplicity.
-	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		return nil, err
 	}
@@ -36,6 +93,33 @@ func (g *ECCGenerator) GetAlgorithm() string {
 	return "ECC"
 }
 
+func newECCGenerator(options KeyOptions) (KeyPairGenerator, KeyOptions, error) {
+	if options.KeySize != 0 {
+		return nil, options, fmt.Errorf("%w: ECC does not support a key size", ErrInvalidOptions)
+	}
+	if options.Curve == "" {
+		options.Curve = DefaultECCCurve
+	}
+	curve, ok := ECCCurves[options.Curve]
+	if !ok {
+		return nil, options, fmt.Errorf("%w: unsupported ECC curve %s, allowed are P-256, P-384, P-521",
+			ErrInvalidOptions, options.Curve)
+	}
+	return &ECCGenerator{Curve: curve}, options, nil
+}
+
+// newECCSignatureOptions only allows to select the digest algorithm, which defaults per curve.
+func newECCSignatureOptions(keyOptions KeyOptions, options SignatureOptions) (SignatureOptions, error) {
+	if options.Scheme != "" || options.SaltLength != 0 {
+		return options, fmt.Errorf("%w: ECC does not support a signature scheme or salt length", ErrInvalidOptions)
+	}
+	if options.Hash == "" {
+		options.Hash = ECCCurveHashes[keyOptions.Curve]
+	}
+	_, err := LookupHash(options.Hash)
+	return options, err
+}
+
 // ECCMarshaler can encode and decode an ECC key pair.
 type ECCMarshaler struct{}
 
@@ -52,7 +136,7 @@ func (m ECCMarshaler) Encode(keyPair ECCKeyPair) ([]byte, []byte, error) {
 		return nil, nil, err
 	}
 
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&keyPair.Public)
+	encodedPublic, err := m.EncodePublic(keyPair.Public)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -62,17 +146,28 @@ func (m ECCMarshaler) Encode(keyPair ECCKeyPair) ([]byte, []byte, error) {
 		Bytes: privateKeyBytes,
 	})
 
-	encodedPublic := pem.EncodeToMemory(&pem.Block{
+	return encodedPublic, encodedPrivate, nil
+}
+
+// EncodePublic encodes an ECC public key to be written on disk.
+func (m ECCMarshaler) EncodePublic(publicKey *ecdsa.PublicKey) ([]byte, error) {
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "PUBLIC_KEY",
 		Bytes: publicKeyBytes,
-	})
-
-	return encodedPublic, encodedPrivate, nil
+	}), nil
 }
 
 // Decode assembles an ECCKeyPair from an encoded private key.
 func (m ECCMarshaler) Decode(privateKeyBytes []byte) (*ECCKeyPair, error) {
 	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode ECC private key")
+	}
 	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -84,6 +179,24 @@ func (m ECCMarshaler) Decode(privateKeyBytes []byte) (*ECCKeyPair, error) {
 	}, nil
 }
 
+// DecodePublic parses an encoded ECC public key.
+func (m ECCMarshaler) DecodePublic(publicKeyBytes []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode ECC public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	eccPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an ECC public key")
+	}
+	return eccPublicKey, nil
+}
+
 func CastToECCKeyPair(keyPair interface{}) (*ECCKeyPair, error) {
 	ekp, ok := keyPair.(*ECCKeyPair)
 	if !ok {
@@ -91,3 +204,30 @@ func CastToECCKeyPair(keyPair interface{}) (*ECCKeyPair, error) {
 	}
 	return ekp, nil
 }
+
+// eccKeyMarshaler adapts the ECCMarshaler to the KeyMarshaler interface.
+type eccKeyMarshaler struct{}
+
+func (eccKeyMarshaler) Encode(keyPair interface{}) ([]byte, []byte, error) {
+	eccKeyPair, err := CastToECCKeyPair(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewECCMarshaler().Encode(*eccKeyPair)
+}
+
+func (eccKeyMarshaler) Decode(privateKeyBytes []byte) (interface{}, error) {
+	return NewECCMarshaler().Decode(privateKeyBytes)
+}
+
+func (eccKeyMarshaler) DecodePublic(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	return NewECCMarshaler().DecodePublic(publicKeyBytes)
+}
+
+func (eccKeyMarshaler) EncodePublic(publicKey crypto.PublicKey) ([]byte, error) {
+	eccPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an ECC public key")
+	}
+	return NewECCMarshaler().EncodePublic(eccPublicKey)
+}
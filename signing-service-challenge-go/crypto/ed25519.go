@@ -0,0 +1,185 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+func init() {
+	RegisterAlgorithm(&Algorithm{
+		Name:         "ED25519",
+		NewGenerator: newED25519Generator,
+		Marshaler:    ED25519Marshaler{},
+		NewSigner: func(keyPair interface{}, options SignatureOptions) (Signer, error) {
+			ed25519KeyPair, err := CastToED25519KeyPair(keyPair)
+			if err != nil {
+				return nil, err
+			}
+			return &ED25519Signer{KeyPair: ed25519KeyPair}, nil
+		},
+		NewVerifier: func(publicKey crypto.PublicKey, options SignatureOptions) (Verifier, error) {
+			ed25519PublicKey, ok := publicKey.(ed25519.PublicKey)
+			if !ok {
+				return nil, errors.New("public key is not an Ed25519 public key")
+			}
+			return &ED25519Verifier{PublicKey: ed25519PublicKey}, nil
+		},
+	})
+}
+
+// ED25519KeyPair is a DTO that holds Ed25519 private and public keys.
+type ED25519KeyPair struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// ED25519Generator generates an Ed25519 key pair.
+type ED25519Generator struct{}
+
+// Generate generates a new ED25519KeyPair.
+func (g *ED25519Generator) Generate() (interface{}, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ED25519KeyPair{
+		Public:  public,
+		Private: private,
+	}, nil
+}
+
+func (g *ED25519Generator) GetAlgorithm() string {
+	return "ED25519"
+}
+
+func newED25519Generator(options KeyOptions) (KeyPairGenerator, KeyOptions, error) {
+	if options.KeySize != 0 {
+		return nil, options, fmt.Errorf("%w: Ed25519 does not support a key size", ErrInvalidOptions)
+	}
+	if options.Curve != "" && options.Curve != "Ed25519" {
+		return nil, options, fmt.Errorf("%w: Ed25519 only supports the Ed25519 curve", ErrInvalidOptions)
+	}
+	options.Curve = "Ed25519"
+	return &ED25519Generator{}, options, nil
+}
+
+// ED25519Marshaler can encode and decode an Ed25519 key pair.
+// The private key is encoded as PKCS#8 and the public key as PKIX.
+type ED25519Marshaler struct{}
+
+// Encode takes an ED25519KeyPair and encodes it to be written on disk.
+// It returns the public and the private key as a byte slice.
+func (m ED25519Marshaler) Encode(keyPair interface{}) ([]byte, []byte, error) {
+	ed25519KeyPair, err := CastToED25519KeyPair(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(ed25519KeyPair.Private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encodedPublic, err := m.EncodePublic(ed25519KeyPair.Public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encodedPrivate := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyBytes,
+	})
+
+	return encodedPublic, encodedPrivate, nil
+}
+
+// EncodePublic encodes an Ed25519 public key to be written on disk.
+func (m ED25519Marshaler) EncodePublic(publicKey crypto.PublicKey) ([]byte, error) {
+	ed25519PublicKey, ok := publicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 public key")
+	}
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(ed25519PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyBytes,
+	}), nil
+}
+
+// Decode assembles an ED25519KeyPair from an encoded private key.
+func (m ED25519Marshaler) Decode(privateKeyBytes []byte) (interface{}, error) {
+	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode Ed25519 private key")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519PrivateKey, ok := privateKey.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an Ed25519 private key")
+	}
+	return &ED25519KeyPair{
+		Private: ed25519PrivateKey,
+		Public:  ed25519PrivateKey.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+// DecodePublic parses an encoded Ed25519 public key.
+func (m ED25519Marshaler) DecodePublic(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode Ed25519 public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519PublicKey, ok := publicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an Ed25519 public key")
+	}
+	return ed25519PublicKey, nil
+}
+
+func CastToED25519KeyPair(keyPair interface{}) (*ED25519KeyPair, error) {
+	ekp, ok := keyPair.(*ED25519KeyPair)
+	if !ok {
+		return nil, errors.New("failed to cast to ED25519KeyPair")
+	}
+	return ekp, nil
+}
+
+// ED25519Signer signs data with an Ed25519 private key.
+// Ed25519 hashes internally, so the secured data is signed as is without pre-hashing.
+type ED25519Signer struct {
+	KeyPair *ED25519KeyPair
+}
+
+// Sign signs the raw data using Ed25519.
+func (s *ED25519Signer) Sign(dataToBeSigned []byte) ([]byte, error) {
+	return ed25519.Sign(s.KeyPair.Private, dataToBeSigned), nil
+}
+
+// ED25519Verifier verifies signatures created by ED25519Signer.
+type ED25519Verifier struct {
+	PublicKey ed25519.PublicKey
+}
+
+// Verify checks the signature of the raw data against the Ed25519 public key.
+func (v *ED25519Verifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	return ed25519.Verify(v.PublicKey, signedData, signature), nil
+}
@@ -0,0 +1,249 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// KeyEncryptionKeySize is the size of a key-encryption key and of the data keys in bytes, selecting AES-256.
+const KeyEncryptionKeySize = 32
+
+// sealedKeyVersion is the version of the SealedKey format.
+const sealedKeyVersion = 1
+
+// ErrUnknownKeyEncryptionKey is returned when a sealed key references a key-encryption key that is not in the keyring.
+var ErrUnknownKeyEncryptionKey = errors.New("unknown key-encryption key")
+
+// KeyEncryptionKey is a master key identified by an ID, which wraps the data keys sealing the private keys.
+type KeyEncryptionKey struct {
+	ID  string
+	key []byte
+}
+
+// NewKeyEncryptionKey creates a key-encryption key from KeyEncryptionKeySize random bytes.
+func NewKeyEncryptionKey(id string, key []byte) (*KeyEncryptionKey, error) {
+	if id == "" || strings.ContainsAny(id, ":,\n") {
+		return nil, fmt.Errorf("invalid key-encryption key ID %q", id)
+	}
+	if len(key) != KeyEncryptionKeySize {
+		return nil, fmt.Errorf("key-encryption key %s must be %d bytes long", id, KeyEncryptionKeySize)
+	}
+	return &KeyEncryptionKey{ID: id, key: append([]byte(nil), key...)}, nil
+}
+
+// SealedKey is the envelope of a sealed private key. The private key is encrypted with a random data key,
+// which is itself encrypted with the key-encryption key. Both are encrypted with AES-GCM and carry their nonce
+// in front of the ciphertext. Rotating the key-encryption key only re-wraps the data key.
+type SealedKey struct {
+	Version             int    `json:"version"`
+	KeyEncryptionKeyID  string `json:"kek_id"`
+	WrappedDataKey      string `json:"wrapped_data_key"`
+	EncryptedPrivateKey string `json:"encrypted_private_key"`
+}
+
+// Keyring holds the key-encryption keys. New keys are sealed with the primary key,
+// the others are only kept to open keys sealed before the primary key was rotated.
+type Keyring struct {
+	primary *KeyEncryptionKey
+	keys    map[string]*KeyEncryptionKey
+}
+
+// NewKeyring creates a keyring that seals with the primary key and opens with all given keys.
+func NewKeyring(primary *KeyEncryptionKey, previous ...*KeyEncryptionKey) (*Keyring, error) {
+	keyring := &Keyring{
+		primary: primary,
+		keys:    map[string]*KeyEncryptionKey{primary.ID: primary},
+	}
+	for _, key := range previous {
+		if _, exists := keyring.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key-encryption key %s", key.ID)
+		}
+		keyring.keys[key.ID] = key
+	}
+	return keyring, nil
+}
+
+// ParseKeyring reads a keyring from entries of the form <id>:<base64 encoded key> separated by commas
+// or new lines. The first entry is the primary key.
+func ParseKeyring(spec string) (*Keyring, error) {
+	var keys []*KeyEncryptionKey
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, errors.New("key-encryption keys must be given as <id>:<base64 encoded key>")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key-encryption key %s is not base64 encoded", id)
+		}
+		kek, err := NewKeyEncryptionKey(id, key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, kek)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key-encryption key given")
+	}
+	return NewKeyring(keys[0], keys[1:]...)
+}
+
+// LoadKeyring reads the keyring from the spec or, if it is empty, from the file at path, both in the
+// format of ParseKeyring. It returns nil if neither is given, which leaves private keys unsealed.
+func LoadKeyring(spec string, path string) (*Keyring, error) {
+	if spec == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(data)
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	return ParseKeyring(spec)
+}
+
+// PrimaryID returns the ID of the key-encryption key new keys are sealed with.
+func (k *Keyring) PrimaryID() string {
+	return k.primary.ID
+}
+
+// Seal encrypts the private key under a new data key wrapped by the primary key-encryption key.
+// The associated data, such as the device ID, has to be given again to open the key.
+// It returns the sealed key together with the ID of the key-encryption key.
+func (k *Keyring) Seal(privateKey []byte, associatedData []byte) ([]byte, string, error) {
+	dataKey := make([]byte, KeyEncryptionKeySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	encryptedPrivateKey, err := sealAESGCM(dataKey, privateKey, associatedData)
+	if err != nil {
+		return nil, "", err
+	}
+	wrappedDataKey, err := sealAESGCM(k.primary.key, dataKey, []byte(k.primary.ID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	sealed, err := json.Marshal(SealedKey{
+		Version:             sealedKeyVersion,
+		KeyEncryptionKeyID:  k.primary.ID,
+		WrappedDataKey:      base64.StdEncoding.EncodeToString(wrappedDataKey),
+		EncryptedPrivateKey: base64.StdEncoding.EncodeToString(encryptedPrivateKey),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return sealed, k.primary.ID, nil
+}
+
+// Open decrypts a sealed private key with the associated data it was sealed with.
+func (k *Keyring) Open(sealed []byte, associatedData []byte) ([]byte, error) {
+	envelope, dataKey, err := k.unwrap(sealed)
+	if err != nil {
+		return nil, err
+	}
+	encryptedPrivateKey, err := base64.StdEncoding.DecodeString(envelope.EncryptedPrivateKey)
+	if err != nil {
+		return nil, errors.New("sealed key is malformed")
+	}
+	privateKey, err := openAESGCM(dataKey, encryptedPrivateKey, associatedData)
+	if err != nil {
+		return nil, errors.New("failed to open sealed key")
+	}
+	return privateKey, nil
+}
+
+// Rewrap wraps the data key of a sealed private key with the primary key-encryption key.
+// The encrypted private key itself is left as it is.
+func (k *Keyring) Rewrap(sealed []byte) ([]byte, string, error) {
+	envelope, dataKey, err := k.unwrap(sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	wrappedDataKey, err := sealAESGCM(k.primary.key, dataKey, []byte(k.primary.ID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	envelope.KeyEncryptionKeyID = k.primary.ID
+	envelope.WrappedDataKey = base64.StdEncoding.EncodeToString(wrappedDataKey)
+	rewrapped, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, "", err
+	}
+	return rewrapped, k.primary.ID, nil
+}
+
+// unwrap parses the envelope and decrypts its data key.
+func (k *Keyring) unwrap(sealed []byte) (*SealedKey, []byte, error) {
+	var envelope SealedKey
+	err := json.Unmarshal(sealed, &envelope)
+	if err != nil || envelope.Version != sealedKeyVersion {
+		return nil, nil, errors.New("sealed key is malformed")
+	}
+
+	kek, ok := k.keys[envelope.KeyEncryptionKeyID]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownKeyEncryptionKey, envelope.KeyEncryptionKeyID)
+	}
+	wrappedDataKey, err := base64.StdEncoding.DecodeString(envelope.WrappedDataKey)
+	if err != nil {
+		return nil, nil, errors.New("sealed key is malformed")
+	}
+	dataKey, err := openAESGCM(kek.key, wrappedDataKey, []byte(kek.ID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap data key with key-encryption key %s", kek.ID)
+	}
+	return &envelope, dataKey, nil
+}
+
+// sealAESGCM encrypts the plaintext and returns the random nonce followed by the ciphertext.
+func sealAESGCM(key []byte, plaintext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, associatedData), nil
+}
+
+// openAESGCM decrypts a ciphertext created by sealAESGCM.
+func openAESGCM(key []byte, ciphertext []byte, associatedData []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, associatedData)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+// JWK is the JSON Web Key (RFC 7517) representation of a public key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set holding the public keys of multiple devices.
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+// PublicKeyToDER encodes a public key as a DER encoded PKIX SubjectPublicKeyInfo.
+func PublicKeyToDER(publicKey crypto.PublicKey) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(publicKey)
+}
+
+// PublicKeyToPEM encodes a public key as a standard "PUBLIC KEY" PEM block,
+// which can be read by common tooling such as openssl.
+func PublicKeyToPEM(publicKey crypto.PublicKey) ([]byte, error) {
+	der, err := PublicKeyToDER(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	}), nil
+}
+
+// PublicKeyToJWK converts a public key into a JWK identified by the given key ID.
+// The "alg" member is only set if the signature options match a registered JWS algorithm.
+func PublicKeyToJWK(publicKey crypto.PublicKey, kid string, options SignatureOptions) (*JWK, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwsAlgorithm(publicKey, options),
+			N:   encodeBase64URL(key.N.Bytes()),
+			E:   encodeBase64URL(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwsAlgorithm(publicKey, options),
+			Crv: key.Curve.Params().Name,
+			X:   encodeBase64URL(key.X.FillBytes(make([]byte, size))),
+			Y:   encodeBase64URL(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return &JWK{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: "EdDSA",
+			Crv: "Ed25519",
+			X:   encodeBase64URL(key),
+		}, nil
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+}
+
+// PublicKeyOptions derives the key options a public key was generated with.
+func PublicKeyOptions(publicKey crypto.PublicKey) (KeyOptions, error) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return KeyOptions{KeySize: key.N.BitLen()}, nil
+	case *ecdsa.PublicKey:
+		return KeyOptions{Curve: key.Curve.Params().Name}, nil
+	case ed25519.PublicKey:
+		return KeyOptions{Curve: "Ed25519"}, nil
+	default:
+		return KeyOptions{}, errors.New("unsupported public key type")
+	}
+}
+
+// ParsePublicKeyPEM parses a PEM encoded public key, either in the format of the algorithm's
+// key marshaler or as a standard "PUBLIC KEY" block as written by PublicKeyToPEM.
+func ParsePublicKeyPEM(algorithm *Algorithm, publicKeyBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block != nil && block.Type == "PUBLIC KEY" {
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return algorithm.Marshaler.DecodePublic(publicKeyBytes)
+}
+
+// jwsAlgorithm returns the JWS algorithm (RFC 7518) for a public key used with the signature options,
+// or an empty string if the combination has no registered name.
+func jwsAlgorithm(publicKey crypto.PublicKey, options SignatureOptions) string {
+	hash := options.Hash
+	if hash == "" {
+		hash = HashSHA256
+	}
+	suffix := map[string]string{HashSHA256: "256", HashSHA384: "384", HashSHA512: "512"}[hash]
+	if suffix == "" {
+		return ""
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if options.Scheme != RSASchemePSS {
+			return "RS" + suffix
+		}
+		if hashFunc, err := LookupHash(hash); err == nil && options.SaltLength == hashFunc.Size() {
+			return "PS" + suffix
+		}
+	case *ecdsa.PublicKey:
+		curves := map[string]string{"256": "P-256", "384": "P-384", "512": "P-521"}
+		if key.Curve.Params().Name == curves[suffix] {
+			return "ES" + suffix
+		}
+	}
+	return ""
+}
+
+func encodeBase64URL(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
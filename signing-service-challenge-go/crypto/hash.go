@@ -0,0 +1,46 @@
+package crypto
+
+import (
+	"crypto"
+	"fmt"
+
+	// Registers crypto.SHA3_256.
+	_ "golang.org/x/crypto/sha3"
+)
+
+// Names of the digest algorithms that can be selected for a device.
+const (
+	HashSHA256   = "SHA-256"
+	HashSHA384   = "SHA-384"
+	HashSHA512   = "SHA-512"
+	HashSHA3_256 = "SHA3-256"
+)
+
+// Hashes maps the allowed digest algorithm names to their implementation.
+var Hashes = map[string]crypto.Hash{
+	HashSHA256:   crypto.SHA256,
+	HashSHA384:   crypto.SHA384,
+	HashSHA512:   crypto.SHA512,
+	HashSHA3_256: crypto.SHA3_256,
+}
+
+// LookupHash retrieves the digest algorithm by its name.
+// Devices created before the digest became selectable have no name stored and use SHA-256.
+func LookupHash(name string) (crypto.Hash, error) {
+	if name == "" {
+		return crypto.SHA256, nil
+	}
+	hash, ok := Hashes[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: unsupported hash algorithm %s, allowed are %s, %s, %s, %s",
+			ErrInvalidOptions, name, HashSHA256, HashSHA384, HashSHA512, HashSHA3_256)
+	}
+	return hash, nil
+}
+
+// Digest hashes the data with the given digest algorithm.
+func Digest(hash crypto.Hash, data []byte) []byte {
+	hashed := hash.New()
+	hashed.Write(data)
+	return hashed.Sum(nil)
+}
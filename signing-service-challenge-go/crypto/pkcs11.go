@@ -0,0 +1,526 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DefaultPKCS11Sessions is the number of sessions opened with the token. It limits how many
+// signatures the token creates in parallel.
+const DefaultPKCS11Sessions = 4
+
+// pkcs11KeyIDSize is the size of the random CKA_ID identifying a key pair in the token.
+const pkcs11KeyIDSize = 16
+
+// ErrPKCS11KeyNotFound is returned when the token holds no private key for a key handle.
+var ErrPKCS11KeyNotFound = errors.New("key not found in PKCS#11 token")
+
+// eccCurveOIDs maps the curve names to the object identifiers passed as CKA_EC_PARAMS.
+var eccCurveOIDs = map[string]asn1.ObjectIdentifier{
+	"P-256": {1, 2, 840, 10045, 3, 1, 7},
+	"P-384": {1, 3, 132, 0, 34},
+	"P-521": {1, 3, 132, 0, 35},
+}
+
+// digestInfoOIDs maps the digest algorithms to the object identifiers of the DigestInfo
+// signed with RSA PKCS#1 v1.5.
+var digestInfoOIDs = map[crypto.Hash]asn1.ObjectIdentifier{
+	crypto.SHA256: {2, 16, 840, 1, 101, 3, 4, 2, 1},
+	crypto.SHA384: {2, 16, 840, 1, 101, 3, 4, 2, 2},
+	crypto.SHA512: {2, 16, 840, 1, 101, 3, 4, 2, 3},
+}
+
+// pssMechanisms maps the digest algorithms to the hash mechanism and mask generation function of RSA-PSS.
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+// PKCS11Config selects the token of a PKCS#11 module holding the device keys.
+type PKCS11Config struct {
+	// ModulePath is the shared library implementing PKCS#11, such as libsofthsm2.so.
+	ModulePath string
+	TokenLabel string
+	PIN        string
+	// Sessions defaults to DefaultPKCS11Sessions.
+	Sessions int
+	// Module is used instead of loading the module from ModulePath if set, such as a fake token in tests.
+	Module PKCS11Module
+}
+
+// PKCS11Module is the part of the PKCS#11 API the provider uses. It is implemented by the *pkcs11.Ctx
+// of a loaded module.
+type PKCS11Module interface {
+	Initialize() error
+	Finalize() error
+	Destroy()
+	GetSlotList(tokenPresent bool) ([]uint, error)
+	GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error)
+	OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error)
+	CloseSession(session pkcs11.SessionHandle) error
+	Login(session pkcs11.SessionHandle, userType uint, pin string) error
+	GenerateKeyPair(session pkcs11.SessionHandle, mechanisms []*pkcs11.Mechanism, public []*pkcs11.Attribute, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error)
+	GetAttributeValue(session pkcs11.SessionHandle, object pkcs11.ObjectHandle, attributes []*pkcs11.Attribute) ([]*pkcs11.Attribute, error)
+	FindObjectsInit(session pkcs11.SessionHandle, template []*pkcs11.Attribute) error
+	FindObjects(session pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error)
+	FindObjectsFinal(session pkcs11.SessionHandle) error
+	SignInit(session pkcs11.SessionHandle, mechanisms []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error
+	Sign(session pkcs11.SessionHandle, message []byte) ([]byte, error)
+	DestroyObject(session pkcs11.SessionHandle, object pkcs11.ObjectHandle) error
+}
+
+// PKCS11KeyHandle references a key pair in a PKCS#11 token. It is stored on the device instead of
+// the private key, which never leaves the token. The string form follows the PKCS#11 URI scheme
+// of RFC 7512, e.g. pkcs11:token=signing;id=%8a%01...
+type PKCS11KeyHandle struct {
+	Token string
+	ID    []byte
+}
+
+// String encodes the handle as a PKCS#11 URI.
+func (h PKCS11KeyHandle) String() string {
+	var id strings.Builder
+	for _, b := range h.ID {
+		fmt.Fprintf(&id, "%%%02x", b)
+	}
+	return "pkcs11:token=" + url.PathEscape(h.Token) + ";id=" + id.String()
+}
+
+// ParsePKCS11KeyHandle parses a handle created by PKCS11KeyHandle.String.
+func ParsePKCS11KeyHandle(handle string) (*PKCS11KeyHandle, error) {
+	path, ok := strings.CutPrefix(handle, "pkcs11:")
+	if !ok {
+		return nil, fmt.Errorf("invalid PKCS#11 key handle %q", handle)
+	}
+
+	parsed := &PKCS11KeyHandle{}
+	for _, attribute := range strings.Split(path, ";") {
+		name, value, _ := strings.Cut(attribute, "=")
+		value, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PKCS#11 key handle %q: %w", handle, err)
+		}
+		switch name {
+		case "token":
+			parsed.Token = value
+		case "id":
+			parsed.ID = []byte(value)
+		}
+	}
+	if parsed.Token == "" || len(parsed.ID) == 0 {
+		return nil, fmt.Errorf("invalid PKCS#11 key handle %q: token and id are required", handle)
+	}
+	return parsed, nil
+}
+
+// PKCS11Provider generates key pairs in a PKCS#11 token and signs with them.
+// It keeps a pool of sessions logged in as the user, as a session only runs one operation at a time.
+type PKCS11Provider struct {
+	ctx      PKCS11Module
+	token    string
+	sessions chan pkcs11.SessionHandle
+	opened   []pkcs11.SessionHandle
+	close    sync.Once
+}
+
+// OpenPKCS11 loads the module, finds the token by its label and logs in with the PIN.
+func OpenPKCS11(config PKCS11Config) (*PKCS11Provider, error) {
+	if (config.ModulePath == "" && config.Module == nil) || config.TokenLabel == "" {
+		return nil, errors.New("the PKCS#11 module and token label are required")
+	}
+	if config.Sessions <= 0 {
+		config.Sessions = DefaultPKCS11Sessions
+	}
+
+	ctx := config.Module
+	if ctx == nil {
+		loaded := pkcs11.New(config.ModulePath)
+		if loaded == nil {
+			return nil, fmt.Errorf("failed to load PKCS#11 module %s", config.ModulePath)
+		}
+		ctx = loaded
+	}
+	err := ctx.Initialize()
+	if err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module %s: %w", config.ModulePath, err)
+	}
+
+	p := &PKCS11Provider{
+		ctx:      ctx,
+		token:    config.TokenLabel,
+		sessions: make(chan pkcs11.SessionHandle, config.Sessions),
+	}
+	slot, err := p.findSlot()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	for i := 0; i < config.Sessions; i++ {
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("failed to open PKCS#11 session: %w", err)
+		}
+		p.opened = append(p.opened, session)
+		p.sessions <- session
+	}
+
+	// The login applies to all sessions of the application with the token.
+	err = ctx.Login(p.opened[0], pkcs11.CKU_USER, config.PIN)
+	if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		p.Close()
+		return nil, fmt.Errorf("failed to log in to PKCS#11 token %s: %w", config.TokenLabel, err)
+	}
+	return p, nil
+}
+
+// Close closes the sessions and unloads the module. Operations still running fail.
+func (p *PKCS11Provider) Close() error {
+	var err error
+	p.close.Do(func() {
+		for _, session := range p.opened {
+			p.ctx.CloseSession(session)
+		}
+		err = p.ctx.Finalize()
+		p.ctx.Destroy()
+	})
+	return err
+}
+
+// Token returns the label of the token holding the keys.
+func (p *PKCS11Provider) Token() string {
+	return p.token
+}
+
+func (p *PKCS11Provider) findSlot() (uint, error) {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err == nil && info.Label == p.token {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("PKCS#11 token %s not found", p.token)
+}
+
+// withSession runs fn with a session taken from the pool, waiting for one to become free.
+func (p *PKCS11Provider) withSession(fn func(session pkcs11.SessionHandle) error) error {
+	session := <-p.sessions
+	defer func() { p.sessions <- session }()
+	return fn(session)
+}
+
+// GenerateKeyPair generates a key pair of the algorithm in the token, labelled with the given label.
+// The options are validated and defaulted like for keys generated in software. The returned key pair
+// holds the encoded public key and the handle of the private key instead of the private key itself.
+func (p *PKCS11Provider) GenerateKeyPair(algorithm *Algorithm, keyOptions KeyOptions, signatureOptions SignatureOptions, label string) (*EncodedKeyPair, error) {
+	_, keyOptions, signatureOptions, err := algorithm.resolveOptions(keyOptions, signatureOptions)
+	if err != nil {
+		return nil, err
+	}
+	_, err = newPKCS11Mechanism(algorithm.Name, signatureOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var mechanism uint
+	var keyAttributes []*pkcs11.Attribute
+	switch algorithm.Name {
+	case "ECC":
+		params, err := asn1.Marshal(eccCurveOIDs[keyOptions.Curve])
+		if err != nil {
+			return nil, err
+		}
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		keyAttributes = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+		}
+	case "RSA":
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		keyAttributes = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, keyOptions.KeySize),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s keys cannot be generated in a PKCS#11 token", ErrUnsupportedAlgorithm, algorithm.Name)
+	}
+
+	id := make([]byte, pkcs11KeyIDSize)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+	publicTemplate := append([]*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}, keyAttributes...)
+	privateTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+
+	var publicKey crypto.PublicKey
+	err = p.withSession(func(session pkcs11.SessionHandle) error {
+		publicHandle, _, err := p.ctx.GenerateKeyPair(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)},
+			publicTemplate, privateTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to generate key pair in PKCS#11 token: %w", err)
+		}
+		publicKey, err = p.readPublicKey(session, publicHandle, algorithm.Name, keyOptions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPublicKey, err := algorithm.Marshaler.EncodePublic(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedKeyPair{
+		PublicKey:        encodedPublicKey,
+		KeyHandle:        PKCS11KeyHandle{Token: p.token, ID: id}.String(),
+		KeyOptions:       keyOptions,
+		SignatureOptions: signatureOptions,
+	}, nil
+}
+
+// readPublicKey reads the public key of a key pair generated in the token.
+func (p *PKCS11Provider) readPublicKey(session pkcs11.SessionHandle, object pkcs11.ObjectHandle, algorithm string, keyOptions KeyOptions) (crypto.PublicKey, error) {
+	if algorithm == "ECC" {
+		attributes, err := p.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key from PKCS#11 token: %w", err)
+		}
+		// The point is a DER encoded OCTET STRING, some tokens return it unwrapped.
+		point := attributes[0].Value
+		var unwrapped []byte
+		if rest, err := asn1.Unmarshal(point, &unwrapped); err == nil && len(rest) == 0 {
+			point = unwrapped
+		}
+		curve := ECCCurves[keyOptions.Curve]
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("PKCS#11 token returned an invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	attributes, err := p.ctx.GetAttributeValue(session, object, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key from PKCS#11 token: %w", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attributes[0].Value),
+		E: int(new(big.Int).SetBytes(attributes[1].Value).Int64()),
+	}, nil
+}
+
+// Signer creates the Signer for a key pair in the token.
+func (p *PKCS11Provider) Signer(algorithm *Algorithm, keyHandle string, options SignatureOptions) (Signer, error) {
+	handle, err := ParsePKCS11KeyHandle(keyHandle)
+	if err != nil {
+		return nil, err
+	}
+	if handle.Token != p.token {
+		return nil, fmt.Errorf("%w: the key is kept in token %s, not %s", ErrPKCS11KeyNotFound, handle.Token, p.token)
+	}
+	mechanism, err := newPKCS11Mechanism(algorithm.Name, options)
+	if err != nil {
+		return nil, err
+	}
+	return &PKCS11Signer{provider: p, id: handle.ID, mechanism: mechanism}, nil
+}
+
+// PKCS11Signer signs with a private key kept in a PKCS#11 token. The digest is computed outside of
+// the token and the signatures are encoded like the ones of the software signers, so they are
+// checked by the same verifiers.
+type PKCS11Signer struct {
+	provider  *PKCS11Provider
+	id        []byte
+	mechanism *pkcs11Mechanism
+}
+
+// Sign signs the digest of the data in the token.
+func (s *PKCS11Signer) Sign(dataToBeSigned []byte) ([]byte, error) {
+	input, err := s.mechanism.input(dataToBeSigned)
+	if err != nil {
+		return nil, err
+	}
+
+	var signature []byte
+	err = s.provider.withSession(func(session pkcs11.SessionHandle) error {
+		key, err := s.provider.findPrivateKey(session, s.id)
+		if err != nil {
+			return err
+		}
+		err = s.provider.ctx.SignInit(session, []*pkcs11.Mechanism{pkcs11.NewMechanism(s.mechanism.mechanism, s.mechanism.params)}, key)
+		if err != nil {
+			return err
+		}
+		signature, err = s.provider.ctx.Sign(session, input)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %w", err)
+	}
+	return s.mechanism.output(signature)
+}
+
+// DestroyKeyPair deletes the private and public key of a key pair from the token, such as one that was
+// generated for a device but never stored. It returns ErrPKCS11KeyNotFound if the token holds no such keys.
+func (p *PKCS11Provider) DestroyKeyPair(keyHandle string) error {
+	handle, err := ParsePKCS11KeyHandle(keyHandle)
+	if err != nil {
+		return err
+	}
+	if handle.Token != p.token {
+		return fmt.Errorf("%w: the key is kept in token %s, not %s", ErrPKCS11KeyNotFound, handle.Token, p.token)
+	}
+
+	return p.withSession(func(session pkcs11.SessionHandle) error {
+		// A key pair consists of a private and a public key object.
+		objects, err := p.findObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, handle.ID)}, 2)
+		if err != nil {
+			return err
+		}
+		if len(objects) == 0 {
+			return ErrPKCS11KeyNotFound
+		}
+		for _, object := range objects {
+			err = p.ctx.DestroyObject(session, object)
+			if err != nil {
+				return fmt.Errorf("failed to destroy key in PKCS#11 token: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (p *PKCS11Provider) findPrivateKey(session pkcs11.SessionHandle, id []byte) (pkcs11.ObjectHandle, error) {
+	objects, err := p.findObjects(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(objects) == 0 {
+		return 0, ErrPKCS11KeyNotFound
+	}
+	return objects[0], nil
+}
+
+// findObjects finds up to max objects of the token matching the template.
+func (p *PKCS11Provider) findObjects(session pkcs11.SessionHandle, template []*pkcs11.Attribute, max int) ([]pkcs11.ObjectHandle, error) {
+	err := p.ctx.FindObjectsInit(session, template)
+	if err != nil {
+		return nil, err
+	}
+	objects, _, err := p.ctx.FindObjects(session, max)
+	finalErr := p.ctx.FindObjectsFinal(session)
+	if err != nil {
+		return nil, err
+	}
+	if finalErr != nil {
+		return nil, finalErr
+	}
+	return objects, nil
+}
+
+// pkcs11Mechanism describes how the token signs for an algorithm and its signature options.
+type pkcs11Mechanism struct {
+	hash      crypto.Hash
+	mechanism uint
+	params    []byte
+}
+
+func newPKCS11Mechanism(algorithm string, options SignatureOptions) (*pkcs11Mechanism, error) {
+	hash, err := LookupHash(options.Hash)
+	if err != nil {
+		return nil, err
+	}
+	m := &pkcs11Mechanism{hash: hash}
+	switch {
+	case algorithm == "ECC":
+		m.mechanism = pkcs11.CKM_ECDSA
+	case algorithm == "RSA" && options.Scheme == RSASchemePSS:
+		mechanisms, ok := pssMechanisms[hash]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s with %s is not supported by PKCS#11 tokens", ErrInvalidOptions, RSASchemePSS, options.Hash)
+		}
+		m.mechanism = pkcs11.CKM_RSA_PKCS_PSS
+		m.params = pkcs11.NewPSSParams(mechanisms[0], mechanisms[1], uint(options.SaltLength))
+	case algorithm == "RSA":
+		m.mechanism = pkcs11.CKM_RSA_PKCS
+	default:
+		return nil, fmt.Errorf("%w: %s keys cannot be used with a PKCS#11 token", ErrUnsupportedAlgorithm, algorithm)
+	}
+	return m, nil
+}
+
+// input returns what the token signs: the digest, wrapped in a DigestInfo for RSA PKCS#1 v1.5.
+func (m *pkcs11Mechanism) input(data []byte) ([]byte, error) {
+	digest := Digest(m.hash, data)
+	if m.mechanism != pkcs11.CKM_RSA_PKCS {
+		return digest, nil
+	}
+	return asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		Digest    []byte
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: digestInfoOIDs[m.hash], Parameters: asn1.NullRawValue},
+		Digest:    digest,
+	})
+}
+
+// output converts the raw r || s of an ECDSA signature to ASN.1 like ecdsa.SignASN1.
+func (m *pkcs11Mechanism) output(signature []byte) ([]byte, error) {
+	if m.mechanism != pkcs11.CKM_ECDSA {
+		return signature, nil
+	}
+	if len(signature) == 0 || len(signature)%2 != 0 {
+		return nil, errors.New("PKCS#11 token returned an invalid ECDSA signature")
+	}
+	half := len(signature) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(signature[:half]),
+		S: new(big.Int).SetBytes(signature[half:]),
+	})
+}
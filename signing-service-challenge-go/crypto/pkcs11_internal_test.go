@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// The mechanisms are checked without a token by doing the token's part in software.
+
+func TestPKCS11MechanismRSAPKCS1v15SignsDigestInfo(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	for _, hash := range []string{HashSHA256, HashSHA384, HashSHA512} {
+		mechanism, err := newPKCS11Mechanism("RSA", SignatureOptions{Scheme: RSASchemePKCS1v15, Hash: hash})
+		assert.NoError(t, err)
+		input, err := mechanism.input([]byte("data"))
+		assert.NoError(t, err)
+
+		// CKM_RSA_PKCS pads and signs the input as it is.
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, 0, input)
+		assert.NoError(t, err)
+		verifier := &RSAVerifier{PublicKey: &key.PublicKey, Scheme: RSASchemePKCS1v15, Hash: Hashes[hash]}
+		valid, err := verifier.Verify([]byte("data"), signature)
+		assert.NoError(t, err)
+		assert.True(t, valid, hash)
+	}
+}
+
+func TestPKCS11MechanismECDSAEncodesASN1(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	mechanism, err := newPKCS11Mechanism("ECC", SignatureOptions{Hash: HashSHA384})
+	assert.NoError(t, err)
+	input, err := mechanism.input([]byte("data"))
+	assert.NoError(t, err)
+
+	// CKM_ECDSA returns r and s of the size of the curve order concatenated.
+	r, s, err := ecdsa.Sign(rand.Reader, key, input)
+	assert.NoError(t, err)
+	raw := make([]byte, 96)
+	r.FillBytes(raw[:48])
+	s.FillBytes(raw[48:])
+
+	signature, err := mechanism.output(raw)
+	assert.NoError(t, err)
+	verifier := &ECCVerifier{PublicKey: &key.PublicKey, Hash: crypto.SHA384}
+	valid, err := verifier.Verify([]byte("data"), signature)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	_, err = mechanism.output(raw[:95])
+	assert.Error(t, err)
+}
@@ -0,0 +1,449 @@
+package pkcs11test
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/miekg/pkcs11"
+	"math/big"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// fakeSlot is the only slot of the fake token.
+const fakeSlot = 1
+
+// littleEndian tells how the PKCS#11 bindings encode CK_ULONG values, which use the native byte order.
+var littleEndian = pkcs11.NewAttribute(0, uint(1)).Value[0] == 1
+
+// fakeCurves maps the object identifiers passed as CKA_EC_PARAMS to the curves.
+var fakeCurves = map[string]elliptic.Curve{
+	"1.2.840.10045.3.1.7": elliptic.P256(),
+	"1.3.132.0.34":        elliptic.P384(),
+	"1.3.132.0.35":        elliptic.P521(),
+}
+
+// fakeHashes maps the hash mechanisms of RSA-PSS to the digest algorithms.
+var fakeHashes = map[uint]stdcrypto.Hash{
+	pkcs11.CKM_SHA256: stdcrypto.SHA256,
+	pkcs11.CKM_SHA384: stdcrypto.SHA384,
+	pkcs11.CKM_SHA512: stdcrypto.SHA512,
+}
+
+// NewToken returns the configuration of a SoftHSM2 token if SoftHSM2 is installed, and of a fake
+// token otherwise, so that tests of the PKCS#11 backend always run.
+func NewToken(t testing.TB) crypto.PKCS11Config {
+	t.Helper()
+	if _, ok := Module(); ok {
+		return NewSoftHSM(t)
+	}
+	return NewFakeToken(t)
+}
+
+// NewFakeToken returns the configuration of a token emulated in memory. It generates EC and RSA key
+// pairs in software and signs with the mechanisms the provider uses, with the same PIN and label as
+// the tokens created by NewSoftHSM.
+func NewFakeToken(t testing.TB) crypto.PKCS11Config {
+	t.Helper()
+	return crypto.PKCS11Config{
+		TokenLabel: TokenLabel,
+		PIN:        PIN,
+		Module: &fakeModule{
+			objects:  make(map[pkcs11.ObjectHandle]*fakeObject),
+			sessions: make(map[pkcs11.SessionHandle]*fakeSession),
+		},
+	}
+}
+
+// fakeModule implements crypto.PKCS11Module for a single token.
+type fakeModule struct {
+	mutex       sync.Mutex
+	initialized bool
+	loggedIn    bool
+	objects     map[pkcs11.ObjectHandle]*fakeObject
+	sessions    map[pkcs11.SessionHandle]*fakeSession
+	next        uint
+}
+
+// fakeObject is a key object of the token, its attributes are kept as encoded by the bindings.
+type fakeObject struct {
+	attributes map[uint][]byte
+	key        interface{}
+}
+
+// fakeSession holds the state of the find and sign operations of a session.
+type fakeSession struct {
+	found         []pkcs11.ObjectHandle
+	signMechanism *pkcs11.Mechanism
+	signKey       *fakeObject
+}
+
+func (m *fakeModule) Initialize() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.initialized {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)
+	}
+	m.initialized = true
+	return nil
+}
+
+func (m *fakeModule) Finalize() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.initialized {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	m.initialized = false
+	m.loggedIn = false
+	m.sessions = make(map[pkcs11.SessionHandle]*fakeSession)
+	return nil
+}
+
+func (m *fakeModule) Destroy() {}
+
+func (m *fakeModule) GetSlotList(tokenPresent bool) ([]uint, error) {
+	return []uint{fakeSlot}, nil
+}
+
+func (m *fakeModule) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	if slotID != fakeSlot {
+		return pkcs11.TokenInfo{}, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	return pkcs11.TokenInfo{Label: TokenLabel}, nil
+}
+
+func (m *fakeModule) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if slotID != fakeSlot {
+		return 0, pkcs11.Error(pkcs11.CKR_SLOT_ID_INVALID)
+	}
+	m.next++
+	session := pkcs11.SessionHandle(m.next)
+	m.sessions[session] = &fakeSession{}
+	return session, nil
+}
+
+func (m *fakeModule) CloseSession(session pkcs11.SessionHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.session(session); err != nil {
+		return err
+	}
+	delete(m.sessions, session)
+	return nil
+}
+
+func (m *fakeModule) Login(session pkcs11.SessionHandle, userType uint, pin string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, err := m.session(session); err != nil {
+		return err
+	}
+	if userType != pkcs11.CKU_USER || pin != PIN {
+		return pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)
+	}
+	if m.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)
+	}
+	m.loggedIn = true
+	return nil
+}
+
+func (m *fakeModule) GenerateKeyPair(session pkcs11.SessionHandle, mechanisms []*pkcs11.Mechanism, public []*pkcs11.Attribute, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.loggedInSession(session); err != nil {
+		return 0, 0, err
+	}
+	if len(mechanisms) != 1 {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	publicObject := &fakeObject{attributes: attributeMap(public)}
+	privateObject := &fakeObject{attributes: attributeMap(private)}
+
+	switch mechanisms[0].Mechanism {
+	case pkcs11.CKM_EC_KEY_PAIR_GEN:
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(publicObject.attributes[pkcs11.CKA_EC_PARAMS], &oid); err != nil {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCONSISTENT)
+		}
+		curve, ok := fakeCurves[oid.String()]
+		if !ok {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_CURVE_NOT_SUPPORTED)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return 0, 0, err
+		}
+		point, err := asn1.Marshal(elliptic.Marshal(curve, key.X, key.Y))
+		if err != nil {
+			return 0, 0, err
+		}
+		publicObject.attributes[pkcs11.CKA_EC_POINT] = point
+		publicObject.key = &key.PublicKey
+		privateObject.key = key
+	case pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN:
+		bits, ok := publicObject.attributes[pkcs11.CKA_MODULUS_BITS]
+		if !ok {
+			return 0, 0, pkcs11.Error(pkcs11.CKR_TEMPLATE_INCOMPLETE)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, int(decodeUint(bits)))
+		if err != nil {
+			return 0, 0, err
+		}
+		publicObject.attributes[pkcs11.CKA_MODULUS] = key.N.Bytes()
+		publicObject.attributes[pkcs11.CKA_PUBLIC_EXPONENT] = big.NewInt(int64(key.E)).Bytes()
+		publicObject.key = &key.PublicKey
+		privateObject.key = key
+	default:
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	return m.addObject(publicObject), m.addObject(privateObject), nil
+}
+
+func (m *fakeModule) GetAttributeValue(session pkcs11.SessionHandle, object pkcs11.ObjectHandle, attributes []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.loggedInSession(session); err != nil {
+		return nil, err
+	}
+	stored, ok := m.objects[object]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	if stored.attributes[pkcs11.CKA_CLASS] != nil && decodeUint(stored.attributes[pkcs11.CKA_CLASS]) == pkcs11.CKO_PRIVATE_KEY {
+		// Private keys are sensitive and never leave the token.
+		return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_SENSITIVE)
+	}
+
+	values := make([]*pkcs11.Attribute, len(attributes))
+	for i, attribute := range attributes {
+		value, ok := stored.attributes[attribute.Type]
+		if !ok {
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+		values[i] = pkcs11.NewAttribute(attribute.Type, value)
+	}
+	return values, nil
+}
+
+func (m *fakeModule) FindObjectsInit(session pkcs11.SessionHandle, template []*pkcs11.Attribute) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.loggedInSession(session); err != nil {
+		return err
+	}
+	state := m.sessions[session]
+	if state.found != nil {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+
+	state.found = []pkcs11.ObjectHandle{}
+	for handle, object := range m.objects {
+		if object.matches(template) {
+			state.found = append(state.found, handle)
+		}
+	}
+	sort.Slice(state.found, func(i, j int) bool { return state.found[i] < state.found[j] })
+	return nil
+}
+
+func (m *fakeModule) FindObjects(session pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state, err := m.session(session)
+	if err != nil {
+		return nil, false, err
+	}
+	if state.found == nil {
+		return nil, false, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	if max > len(state.found) {
+		max = len(state.found)
+	}
+	objects := state.found[:max]
+	state.found = state.found[max:]
+	return objects, false, nil
+}
+
+func (m *fakeModule) FindObjectsFinal(session pkcs11.SessionHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	state, err := m.session(session)
+	if err != nil {
+		return err
+	}
+	if state.found == nil {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	state.found = nil
+	return nil
+}
+
+func (m *fakeModule) SignInit(session pkcs11.SessionHandle, mechanisms []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.loggedInSession(session); err != nil {
+		return err
+	}
+	if len(mechanisms) != 1 {
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+	object, ok := m.objects[key]
+	if !ok {
+		return pkcs11.Error(pkcs11.CKR_KEY_HANDLE_INVALID)
+	}
+	state := m.sessions[session]
+	if state.signMechanism != nil {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+	state.signMechanism = mechanisms[0]
+	state.signKey = object
+	return nil
+}
+
+func (m *fakeModule) Sign(session pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	m.mutex.Lock()
+	state, err := m.session(session)
+	if err != nil {
+		m.mutex.Unlock()
+		return nil, err
+	}
+	mechanism, object := state.signMechanism, state.signKey
+	if mechanism == nil {
+		m.mutex.Unlock()
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+	// Like C_Sign, a call finishes the operation, whether it succeeds or not.
+	state.signMechanism, state.signKey = nil, nil
+	m.mutex.Unlock()
+
+	switch key := object.key.(type) {
+	case *ecdsa.PrivateKey:
+		if mechanism.Mechanism != pkcs11.CKM_ECDSA {
+			return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, message)
+		if err != nil {
+			return nil, err
+		}
+		// The signature is r || s, each padded to the size of the curve.
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature, nil
+	case *rsa.PrivateKey:
+		switch mechanism.Mechanism {
+		case pkcs11.CKM_RSA_PKCS:
+			// The message is the DigestInfo, which is signed as is.
+			return rsa.SignPKCS1v15(rand.Reader, key, 0, message)
+		case pkcs11.CKM_RSA_PKCS_PSS:
+			hash, saltLength, err := decodePSSParams(mechanism.Parameter)
+			if err != nil {
+				return nil, err
+			}
+			return rsa.SignPSS(rand.Reader, key, hash, message, &rsa.PSSOptions{SaltLength: saltLength, Hash: hash})
+		}
+		return nil, pkcs11.Error(pkcs11.CKR_KEY_TYPE_INCONSISTENT)
+	}
+	return nil, pkcs11.Error(pkcs11.CKR_KEY_FUNCTION_NOT_PERMITTED)
+}
+
+func (m *fakeModule) DestroyObject(session pkcs11.SessionHandle, object pkcs11.ObjectHandle) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.loggedInSession(session); err != nil {
+		return err
+	}
+	if _, ok := m.objects[object]; !ok {
+		return pkcs11.Error(pkcs11.CKR_OBJECT_HANDLE_INVALID)
+	}
+	delete(m.objects, object)
+	return nil
+}
+
+// session returns the state of an open session. Callers must hold the mutex.
+func (m *fakeModule) session(session pkcs11.SessionHandle) (*fakeSession, error) {
+	if !m.initialized {
+		return nil, pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+	state, ok := m.sessions[session]
+	if !ok {
+		return nil, pkcs11.Error(pkcs11.CKR_SESSION_HANDLE_INVALID)
+	}
+	return state, nil
+}
+
+// loggedInSession checks that the session is open and the user is logged in. Callers must hold the mutex.
+func (m *fakeModule) loggedInSession(session pkcs11.SessionHandle) error {
+	if _, err := m.session(session); err != nil {
+		return err
+	}
+	if !m.loggedIn {
+		return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+	}
+	return nil
+}
+
+// addObject stores an object and returns its handle. Callers must hold the mutex.
+func (m *fakeModule) addObject(object *fakeObject) pkcs11.ObjectHandle {
+	m.next++
+	handle := pkcs11.ObjectHandle(m.next)
+	m.objects[handle] = object
+	return handle
+}
+
+// matches tells whether the object has all attributes of the template with the same value.
+func (o *fakeObject) matches(template []*pkcs11.Attribute) bool {
+	for _, attribute := range template {
+		value, ok := o.attributes[attribute.Type]
+		if !ok || !bytes.Equal(value, attribute.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func attributeMap(attributes []*pkcs11.Attribute) map[uint][]byte {
+	values := make(map[uint][]byte, len(attributes))
+	for _, attribute := range attributes {
+		values[attribute.Type] = attribute.Value
+	}
+	return values
+}
+
+// decodeUint decodes a CK_ULONG value encoded by the bindings.
+func decodeUint(value []byte) uint {
+	var x uint64
+	for i := range value {
+		b := value[i]
+		if littleEndian {
+			b = value[len(value)-1-i]
+		}
+		x = x<<8 | uint64(b)
+	}
+	return uint(x)
+}
+
+// decodePSSParams decodes the CK_RSA_PKCS_PSS_PARAMS of pkcs11.NewPSSParams, three CK_ULONG values
+// holding the hash mechanism, the mask generation function and the salt length.
+func decodePSSParams(params []byte) (stdcrypto.Hash, int, error) {
+	if len(params) == 0 || len(params)%3 != 0 {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+	size := len(params) / 3
+	hash, ok := fakeHashes[decodeUint(params[:size])]
+	if !ok {
+		return 0, 0, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+	return hash, int(decodeUint(params[2*size:])), nil
+}
@@ -0,0 +1,124 @@
+// Package pkcs11test provides PKCS#11 tokens for tests of the PKCS#11 signer backend, SoftHSM2 tokens
+// if SoftHSM2 is installed and a fake token emulated in memory otherwise.
+package pkcs11test
+
+import (
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/miekg/pkcs11"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ModuleEnv overrides the location of the SoftHSM2 library.
+const ModuleEnv = "SOFTHSM2_MODULE"
+
+// Credentials of the tokens created by NewSoftHSM.
+const (
+	TokenLabel = "signing-service-test"
+	PIN        = "1234"
+	SOPIN      = "5678"
+)
+
+// modulePaths are the locations the SoftHSM2 library is installed to by common package managers.
+var modulePaths = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// Module returns the path of the SoftHSM2 library and whether it is installed.
+func Module() (string, bool) {
+	if module := os.Getenv(ModuleEnv); module != "" {
+		return module, true
+	}
+	for _, path := range modulePaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// NewSoftHSM initializes a fresh SoftHSM2 token in a temporary directory and returns the configuration
+// to open it. The test is skipped if SoftHSM2 is not installed. Only one token can be open at a time,
+// as SoftHSM2 reads its configuration once per initialization of the library.
+func NewSoftHSM(t testing.TB) crypto.PKCS11Config {
+	t.Helper()
+	module, ok := Module()
+	if !ok {
+		t.Skipf("SoftHSM2 is not installed, set %s to the path of libsofthsm2.so", ModuleEnv)
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "softhsm2.conf")
+	content := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\nlog.level = ERROR\n", tokens)
+	if err := os.WriteFile(config, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", config)
+
+	if err := initToken(module); err != nil {
+		t.Fatalf("failed to initialize SoftHSM2 token: %v", err)
+	}
+	return crypto.PKCS11Config{
+		ModulePath: module,
+		TokenLabel: TokenLabel,
+		PIN:        PIN,
+	}
+}
+
+// initToken initializes the free slot of SoftHSM2 with the test token and sets the user PIN.
+func initToken(module string) error {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return fmt.Errorf("failed to load %s", module)
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		return err
+	}
+	defer ctx.Finalize()
+
+	slots, err := ctx.GetSlotList(false)
+	if err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		return fmt.Errorf("no free slot")
+	}
+	if err := ctx.InitToken(slots[0], SOPIN, TokenLabel); err != nil {
+		return err
+	}
+
+	// SoftHSM2 moves an initialized token to a new slot.
+	slots, err = ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != TokenLabel {
+			continue
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return err
+		}
+		defer ctx.CloseSession(session)
+		if err := ctx.Login(session, pkcs11.CKU_SO, SOPIN); err != nil {
+			return err
+		}
+		defer ctx.Logout(session)
+		return ctx.InitPIN(session, PIN)
+	}
+	return fmt.Errorf("token %s not found after initialization", TokenLabel)
+}
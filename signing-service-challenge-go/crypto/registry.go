@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// KeyMarshaler can encode and decode the key pairs of an algorithm to be written to a storage.
+type KeyMarshaler interface {
+	// Encode returns the public and the private key as a byte slice.
+	Encode(keyPair interface{}) ([]byte, []byte, error)
+	// Decode assembles the key pair from an encoded private key.
+	Decode(privateKeyBytes []byte) (interface{}, error)
+	// DecodePublic parses an encoded public key.
+	DecodePublic(publicKeyBytes []byte) (crypto.PublicKey, error)
+	// EncodePublic encodes a public key on its own, such as one of a key pair kept in an HSM.
+	EncodePublic(publicKey crypto.PublicKey) ([]byte, error)
+}
+
+// ErrInvalidOptions is returned when the key or signature options are not allowed for an algorithm.
+var ErrInvalidOptions = errors.New("invalid options")
+
+// ErrUnsupportedAlgorithm is returned when no algorithm has been registered under a name.
+var ErrUnsupportedAlgorithm = errors.New("unsupported algorithm")
+
+// KeyOptions holds the optional parameters for generating a key pair.
+type KeyOptions struct {
+	Curve   string
+	KeySize int
+}
+
+// SignatureOptions holds the optional parameters of the signature scheme used with a key pair.
+type SignatureOptions struct {
+	Scheme     string
+	SaltLength int
+	Hash       string
+}
+
+// EncodedKeyPair holds an encoded key pair together with the options it was generated with.
+// Key pairs generated in a hardware security module carry the KeyHandle of the private key instead of PrivateKey.
+type EncodedKeyPair struct {
+	PublicKey        []byte
+	PrivateKey       []byte
+	KeyHandle        string
+	KeyOptions       KeyOptions
+	SignatureOptions SignatureOptions
+}
+
+// Algorithm bundles everything needed to create keys, sign and verify with one signature algorithm.
+// Algorithms register themselves with RegisterAlgorithm, so that adding a new one only requires a single file.
+type Algorithm struct {
+	Name string
+	// NewGenerator validates the key options against the allowed values, applies the defaults
+	// and returns the generator together with the effective options.
+	NewGenerator func(options KeyOptions) (KeyPairGenerator, KeyOptions, error)
+	// NewSignatureOptions validates the signature options for keys generated with the given key options
+	// and applies the defaults. Algorithms without configurable signature schemes leave it nil.
+	NewSignatureOptions func(keyOptions KeyOptions, options SignatureOptions) (SignatureOptions, error)
+	Marshaler           KeyMarshaler
+	NewSigner           func(keyPair interface{}, options SignatureOptions) (Signer, error)
+	NewVerifier         func(publicKey crypto.PublicKey, options SignatureOptions) (Verifier, error)
+}
+
+var (
+	algorithmsMutex sync.RWMutex
+	algorithms      = make(map[string]*Algorithm)
+)
+
+// RegisterAlgorithm makes an algorithm available under its name.
+// It panics if an algorithm with the same name has already been registered.
+func RegisterAlgorithm(algorithm *Algorithm) {
+	algorithmsMutex.Lock()
+	defer algorithmsMutex.Unlock()
+
+	if _, exists := algorithms[algorithm.Name]; exists {
+		panic(fmt.Sprintf("algorithm %s is already registered", algorithm.Name))
+	}
+	algorithms[algorithm.Name] = algorithm
+}
+
+// LookupAlgorithm retrieves a registered algorithm by its name.
+func LookupAlgorithm(name string) (*Algorithm, error) {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+
+	algorithm, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, name)
+	}
+	return algorithm, nil
+}
+
+// AlgorithmNames lists the names of all registered algorithms in alphabetical order.
+func AlgorithmNames() []string {
+	algorithmsMutex.RLock()
+	defer algorithmsMutex.RUnlock()
+
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GenerateKeyPair generates a new key pair with the given options and encodes it to be written to a storage.
+func (a *Algorithm) GenerateKeyPair(keyOptions KeyOptions, signatureOptions SignatureOptions) (*EncodedKeyPair, error) {
+	generator, keyOptions, signatureOptions, err := a.resolveOptions(keyOptions, signatureOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := generator.Generate()
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, privateKey, err := a.Marshaler.Encode(keyPair)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncodedKeyPair{
+		PublicKey:        publicKey,
+		PrivateKey:       privateKey,
+		KeyOptions:       keyOptions,
+		SignatureOptions: signatureOptions,
+	}, nil
+}
+
+// resolveOptions validates the key and signature options and applies the defaults.
+func (a *Algorithm) resolveOptions(keyOptions KeyOptions, signatureOptions SignatureOptions) (KeyPairGenerator, KeyOptions, SignatureOptions, error) {
+	generator, keyOptions, err := a.NewGenerator(keyOptions)
+	if err != nil {
+		return nil, keyOptions, signatureOptions, err
+	}
+
+	if a.NewSignatureOptions != nil {
+		signatureOptions, err = a.NewSignatureOptions(keyOptions, signatureOptions)
+		if err != nil {
+			return nil, keyOptions, signatureOptions, err
+		}
+	} else if signatureOptions != (SignatureOptions{}) {
+		return nil, keyOptions, signatureOptions, fmt.Errorf("%w: %s does not support signature options", ErrInvalidOptions, a.Name)
+	}
+	return generator, keyOptions, signatureOptions, nil
+}
+
+// Signer creates the Signer for an encoded private key.
+func (a *Algorithm) Signer(privateKeyBytes []byte, options SignatureOptions) (Signer, error) {
+	keyPair, err := a.Marshaler.Decode(privateKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return a.NewSigner(keyPair, options)
+}
+
+// Verifier creates the Verifier for an encoded public key.
+func (a *Algorithm) Verifier(publicKeyBytes []byte, options SignatureOptions) (Verifier, error) {
+	publicKey, err := a.Marshaler.DecodePublic(publicKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return a.NewVerifier(publicKey, options)
+}
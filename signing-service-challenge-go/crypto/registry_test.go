@@ -0,0 +1,193 @@
+package crypto
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAlgorithmNames(t *testing.T) {
+	assert.Subset(t, AlgorithmNames(), []string{"ECC", "ED25519", "RSA"})
+}
+
+func TestLookupUnknownAlgorithm(t *testing.T) {
+	_, err := LookupAlgorithm("UNKNOWN")
+	assert.Error(t, err)
+}
+
+func TestRegisterAlgorithmTwicePanics(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterAlgorithm(&Algorithm{Name: "RSA"})
+	})
+}
+
+func TestGenerateSignVerifyRoundTrip(t *testing.T) {
+	for _, name := range []string{"RSA", "ECC", "ED25519"} {
+		algorithm, err := LookupAlgorithm(name)
+		assert.NoError(t, err)
+
+		keyPair, err := algorithm.GenerateKeyPair(KeyOptions{}, SignatureOptions{})
+		assert.NoError(t, err)
+
+		signer, err := algorithm.Signer(keyPair.PrivateKey, keyPair.SignatureOptions)
+		assert.NoError(t, err)
+		signature, err := signer.Sign([]byte("0_data_ZGV2aWNl"))
+		assert.NoError(t, err)
+
+		verifier, err := algorithm.Verifier(keyPair.PublicKey, keyPair.SignatureOptions)
+		assert.NoError(t, err)
+		valid, err := verifier.Verify([]byte("0_data_ZGV2aWNl"), signature)
+		assert.NoError(t, err)
+		assert.True(t, valid, name)
+
+		valid, err = verifier.Verify([]byte("0_tampered_ZGV2aWNl"), signature)
+		assert.NoError(t, err)
+		assert.False(t, valid, name)
+	}
+}
+
+func TestSignerInvalidPEM(t *testing.T) {
+	for _, name := range []string{"RSA", "ECC", "ED25519"} {
+		algorithm, err := LookupAlgorithm(name)
+		assert.NoError(t, err)
+
+		_, err = algorithm.Signer([]byte("not a key"), SignatureOptions{})
+		assert.Error(t, err)
+	}
+}
+
+func TestGenerateKeyPairOptions(t *testing.T) {
+	ecc, err := LookupAlgorithm("ECC")
+	assert.NoError(t, err)
+	for _, curve := range []string{"P-256", "P-384", "P-521"} {
+		keyPair, err := ecc.GenerateKeyPair(KeyOptions{Curve: curve}, SignatureOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, curve, keyPair.KeyOptions.Curve)
+
+		decoded, err := ecc.Marshaler.Decode(keyPair.PrivateKey)
+		assert.NoError(t, err)
+		assert.Equal(t, curve, decoded.(*ECCKeyPair).Private.Curve.Params().Name)
+	}
+
+	rsa, err := LookupAlgorithm("RSA")
+	assert.NoError(t, err)
+	keyPair, err := rsa.GenerateKeyPair(KeyOptions{KeySize: 3072}, SignatureOptions{})
+	assert.NoError(t, err)
+	decoded, err := rsa.Marshaler.Decode(keyPair.PrivateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 3072, decoded.(*RSAKeyPair).Private.N.BitLen())
+
+	keyPair, err = rsa.GenerateKeyPair(KeyOptions{}, SignatureOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRSAKeySize, keyPair.KeyOptions.KeySize)
+}
+
+func TestGenerateKeyPairRejectsInvalidOptions(t *testing.T) {
+	ecc, _ := LookupAlgorithm("ECC")
+	_, err := ecc.GenerateKeyPair(KeyOptions{Curve: "P-224"}, SignatureOptions{})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+
+	rsa, _ := LookupAlgorithm("RSA")
+	_, err = rsa.GenerateKeyPair(KeyOptions{KeySize: 1024}, SignatureOptions{})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+}
+
+func TestRSAPSSSignVerify(t *testing.T) {
+	algorithm, err := LookupAlgorithm("RSA")
+	assert.NoError(t, err)
+
+	for _, saltLength := range []int{0, 20} {
+		keyPair, err := algorithm.GenerateKeyPair(KeyOptions{}, SignatureOptions{Scheme: RSASchemePSS, SaltLength: saltLength})
+		assert.NoError(t, err)
+		assert.Equal(t, RSASchemePSS, keyPair.SignatureOptions.Scheme)
+		assert.NotZero(t, keyPair.SignatureOptions.SaltLength)
+
+		signer, err := algorithm.Signer(keyPair.PrivateKey, keyPair.SignatureOptions)
+		assert.NoError(t, err)
+		signature, err := signer.Sign([]byte("0_data_ZGV2aWNl"))
+		assert.NoError(t, err)
+
+		verifier, err := algorithm.Verifier(keyPair.PublicKey, keyPair.SignatureOptions)
+		assert.NoError(t, err)
+		valid, err := verifier.Verify([]byte("0_data_ZGV2aWNl"), signature)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+
+		// A PSS signature must not pass as PKCS#1 v1.5.
+		pkcs1Verifier, err := algorithm.Verifier(keyPair.PublicKey, SignatureOptions{Scheme: RSASchemePKCS1v15})
+		assert.NoError(t, err)
+		valid, err = pkcs1Verifier.Verify([]byte("0_data_ZGV2aWNl"), signature)
+		assert.NoError(t, err)
+		assert.False(t, valid)
+	}
+}
+
+func TestSignatureOptionsValidation(t *testing.T) {
+	rsa, _ := LookupAlgorithm("RSA")
+	keyPair, err := rsa.GenerateKeyPair(KeyOptions{}, SignatureOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, RSASchemePKCS1v15, keyPair.SignatureOptions.Scheme)
+
+	for _, options := range []SignatureOptions{
+		{Scheme: "RSA_OAEP"},
+		{Scheme: RSASchemePKCS1v15, SaltLength: 32},
+		{Scheme: RSASchemePKCS1v15, Hash: HashSHA3_256},
+		{Scheme: RSASchemePSS, SaltLength: 1000},
+	} {
+		_, err = rsa.GenerateKeyPair(KeyOptions{}, options)
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+
+	ecc, _ := LookupAlgorithm("ECC")
+	_, err = ecc.GenerateKeyPair(KeyOptions{}, SignatureOptions{Scheme: RSASchemePSS})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+}
+
+func TestHashAlgorithmDefaultsPerCurve(t *testing.T) {
+	ecc, _ := LookupAlgorithm("ECC")
+	for curve, hash := range map[string]string{"P-256": HashSHA256, "P-384": HashSHA384, "P-521": HashSHA512} {
+		keyPair, err := ecc.GenerateKeyPair(KeyOptions{Curve: curve}, SignatureOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, hash, keyPair.SignatureOptions.Hash)
+	}
+
+	rsa, _ := LookupAlgorithm("RSA")
+	keyPair, err := rsa.GenerateKeyPair(KeyOptions{}, SignatureOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, HashSHA256, keyPair.SignatureOptions.Hash)
+}
+
+func TestSignVerifyWithSelectedHash(t *testing.T) {
+	for _, name := range []string{"RSA", "ECC"} {
+		algorithm, _ := LookupAlgorithm(name)
+		for hash := range Hashes {
+			options := SignatureOptions{Hash: hash}
+			if name == "RSA" && hash == HashSHA3_256 {
+				options.Scheme = RSASchemePSS
+			}
+			keyPair, err := algorithm.GenerateKeyPair(KeyOptions{}, options)
+			assert.NoError(t, err)
+			assert.Equal(t, hash, keyPair.SignatureOptions.Hash)
+
+			signer, err := algorithm.Signer(keyPair.PrivateKey, keyPair.SignatureOptions)
+			assert.NoError(t, err)
+			signature, err := signer.Sign([]byte("0_data_ZGV2aWNl"))
+			assert.NoError(t, err)
+
+			verifier, err := algorithm.Verifier(keyPair.PublicKey, keyPair.SignatureOptions)
+			assert.NoError(t, err)
+			valid, err := verifier.Verify([]byte("0_data_ZGV2aWNl"), signature)
+			assert.NoError(t, err)
+			assert.True(t, valid, name+" "+hash)
+		}
+	}
+}
+
+func TestUnsupportedHashAlgorithm(t *testing.T) {
+	rsa, _ := LookupAlgorithm("RSA")
+	_, err := rsa.GenerateKeyPair(KeyOptions{}, SignatureOptions{Hash: "MD5"})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+
+	ed25519, _ := LookupAlgorithm("ED25519")
+	_, err = ed25519.GenerateKeyPair(KeyOptions{}, SignatureOptions{Hash: HashSHA256})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+}
@@ -1,24 +1,87 @@
 package crypto
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 )
 
+func init() {
+	RegisterAlgorithm(&Algorithm{
+		Name:                "RSA",
+		NewGenerator:        newRSAGenerator,
+		NewSignatureOptions: newRSASignatureOptions,
+		Marshaler:           rsaKeyMarshaler{},
+		NewSigner: func(keyPair interface{}, options SignatureOptions) (Signer, error) {
+			rsaKeyPair, err := CastToRSAKeyPair(keyPair)
+			if err != nil {
+				return nil, err
+			}
+			hash, err := LookupHash(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			return &RSASigner{
+				KeyPair:    rsaKeyPair,
+				Scheme:     options.Scheme,
+				SaltLength: options.SaltLength,
+				Hash:       hash,
+			}, nil
+		},
+		NewVerifier: func(publicKey crypto.PublicKey, options SignatureOptions) (Verifier, error) {
+			rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+			if !ok {
+				return nil, errors.New("public key is not an RSA public key")
+			}
+			hash, err := LookupHash(options.Hash)
+			if err != nil {
+				return nil, err
+			}
+			return &RSAVerifier{
+				PublicKey:  rsaPublicKey,
+				Scheme:     options.Scheme,
+				SaltLength: options.SaltLength,
+				Hash:       hash,
+			}, nil
+		},
+	})
+}
+
 // RSAKeyPair is a DTO that holds RSA private and public keys.
 type RSAKeyPair struct {
 	Public  *rsa.PublicKey
 	Private *rsa.PrivateKey
 }
 
-type RSAGenerator struct{}
+// Signature schemes supported for RSA keys.
+const (
+	RSASchemePKCS1v15 = "RSA_PKCS1V15"
+	RSASchemePSS      = "RSA_PSS"
+)
+
+// DefaultRSAKeySize is the key size in bits used when none is requested.
+const DefaultRSAKeySize = 2048
+
+// RSAKeySizes lists the allowed RSA key sizes in bits.
+var RSAKeySizes = []int{2048, 3072, 4096}
+
+// RSAGenerator generates an RSA key pair of the given size, DefaultRSAKeySize if unset.
+type RSAGenerator struct {
+	KeySize int
+}
 
 // Generate can generate a new RSAKeyPair.
 func (g *RSAGenerator) Generate() (interface{}, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	keySize := g.KeySize
+	if keySize == 0 {
+		keySize = DefaultRSAKeySize
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keySize)
 	if err != nil {
 		return nil, err
 	}
@@ -32,28 +95,87 @@ func (g *RSAGenerator) GetAlgorithm() string {
 	return "RSA"
 }
 
+func newRSAGenerator(options KeyOptions) (KeyPairGenerator, KeyOptions, error) {
+	if options.Curve != "" {
+		return nil, options, fmt.Errorf("%w: RSA does not support a curve", ErrInvalidOptions)
+	}
+	if options.KeySize == 0 {
+		options.KeySize = DefaultRSAKeySize
+	}
+	for _, keySize := range RSAKeySizes {
+		if options.KeySize == keySize {
+			return &RSAGenerator{KeySize: keySize}, options, nil
+		}
+	}
+	return nil, options, fmt.Errorf("%w: unsupported RSA key size %d, allowed are %v",
+		ErrInvalidOptions, options.KeySize, RSAKeySizes)
+}
+
+// newRSASignatureOptions defaults to PKCS#1 v1.5 with SHA-256. For PSS the salt length defaults to the
+// hash length and is limited by the key size. SHA3-256 is only available with PSS, as crypto/rsa
+// before Go 1.24 has no DigestInfo prefix for it.
+func newRSASignatureOptions(keyOptions KeyOptions, options SignatureOptions) (SignatureOptions, error) {
+	if options.Scheme == "" {
+		options.Scheme = RSASchemePKCS1v15
+	}
+	if options.Hash == "" {
+		options.Hash = HashSHA256
+	}
+	hash, err := LookupHash(options.Hash)
+	if err != nil {
+		return options, err
+	}
+
+	switch options.Scheme {
+	case RSASchemePKCS1v15:
+		if options.SaltLength != 0 {
+			return options, fmt.Errorf("%w: salt length is only supported by %s", ErrInvalidOptions, RSASchemePSS)
+		}
+		if options.Hash == HashSHA3_256 {
+			return options, fmt.Errorf("%w: %s is only supported by %s", ErrInvalidOptions, HashSHA3_256, RSASchemePSS)
+		}
+	case RSASchemePSS:
+		if options.SaltLength == 0 {
+			options.SaltLength = hash.Size()
+		}
+		maxSaltLength := keyOptions.KeySize/8 - hash.Size() - 2
+		if options.SaltLength < 0 || options.SaltLength > maxSaltLength {
+			return options, fmt.Errorf("%w: salt length must be between 1 and %d", ErrInvalidOptions, maxSaltLength)
+		}
+	default:
+		return options, fmt.Errorf("%w: unsupported RSA signature scheme %s, allowed are %s, %s",
+			ErrInvalidOptions, options.Scheme, RSASchemePKCS1v15, RSASchemePSS)
+	}
+	return options, nil
+}
+
 // Marshal takes an RSAKeyPair and encodes it to be written on disk.
 // It returns the public and the private key as a byte slice.
 func (g *RSAGenerator) Marshal(keyPair RSAKeyPair) ([]byte, []byte, error) {
 	privateKeyBytes := x509.MarshalPKCS1PrivateKey(keyPair.Private)
-	publicKeyBytes := x509.MarshalPKCS1PublicKey(keyPair.Public)
 
 	encodedPrivate := pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA_PRIVATE_KEY",
 		Bytes: privateKeyBytes,
 	})
 
-	encodePublic := pem.EncodeToMemory(&pem.Block{
+	return g.MarshalPublic(keyPair.Public), encodedPrivate, nil
+}
+
+// MarshalPublic encodes an RSA public key to be written on disk.
+func (g *RSAGenerator) MarshalPublic(publicKey *rsa.PublicKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "RSA_PUBLIC_KEY",
-		Bytes: publicKeyBytes,
+		Bytes: x509.MarshalPKCS1PublicKey(publicKey),
 	})
-
-	return encodePublic, encodedPrivate, nil
 }
 
 // Unmarshal takes an encoded RSA private key and transforms it into a rsa.PrivateKey.
 func (g *RSAGenerator) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
 	block, _ := pem.Decode(privateKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode RSA private key")
+	}
 	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
 	if err != nil {
 		return nil, err
@@ -65,6 +187,15 @@ func (g *RSAGenerator) Unmarshal(privateKeyBytes []byte) (*RSAKeyPair, error) {
 	}, nil
 }
 
+// UnmarshalPublic takes an encoded RSA public key and transforms it into a rsa.PublicKey.
+func (g *RSAGenerator) UnmarshalPublic(publicKeyBytes []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(publicKeyBytes)
+	if block == nil {
+		return nil, errors.New("failed to decode RSA public key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
 func CastToRSAKeyPair(keyPair interface{}) (*RSAKeyPair, error) {
 	rkp, ok := keyPair.(*RSAKeyPair)
 	if !ok {
@@ -72,3 +203,30 @@ func CastToRSAKeyPair(keyPair interface{}) (*RSAKeyPair, error) {
 	}
 	return rkp, nil
 }
+
+// rsaKeyMarshaler adapts the RSAGenerator encoding to the KeyMarshaler interface.
+type rsaKeyMarshaler struct{}
+
+func (rsaKeyMarshaler) Encode(keyPair interface{}) ([]byte, []byte, error) {
+	rsaKeyPair, err := CastToRSAKeyPair(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+	return (&RSAGenerator{}).Marshal(*rsaKeyPair)
+}
+
+func (rsaKeyMarshaler) Decode(privateKeyBytes []byte) (interface{}, error) {
+	return (&RSAGenerator{}).Unmarshal(privateKeyBytes)
+}
+
+func (rsaKeyMarshaler) DecodePublic(publicKeyBytes []byte) (crypto.PublicKey, error) {
+	return (&RSAGenerator{}).UnmarshalPublic(publicKeyBytes)
+}
+
+func (rsaKeyMarshaler) EncodePublic(publicKey crypto.PublicKey) ([]byte, error) {
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA public key")
+	}
+	return (&RSAGenerator{}).MarshalPublic(rsaPublicKey), nil
+}
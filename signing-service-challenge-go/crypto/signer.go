@@ -5,6 +5,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 )
 
@@ -13,31 +14,100 @@ type Signer interface {
 	Sign(dataToBeSigned []byte) ([]byte, error)
 }
 
-// SignRSA signs the data using RSA.
-func SignRSA(keypair *RSAKeyPair, dataToBeSigned []byte) ([]byte, error) {
-	hashed := crypto.SHA256.New()
-	_, err := hashed.Write(dataToBeSigned)
-	if err != nil {
-		return nil, err
+// Verifier defines a contract for checking signatures created by a Signer.
+type Verifier interface {
+	Verify(signedData []byte, signature []byte) (bool, error)
+}
+
+// RSAVerifier verifies signatures created by SignRSA or SignRSAPSS depending on the scheme.
+type RSAVerifier struct {
+	PublicKey  *rsa.PublicKey
+	Scheme     string
+	SaltLength int
+	Hash       crypto.Hash
+}
+
+// Verify checks the signature of the data against the RSA public key.
+func (v *RSAVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	hashed := Digest(v.Hash, signedData)
+	var err error
+	if v.Scheme == RSASchemePSS {
+		err = rsa.VerifyPSS(v.PublicKey, v.Hash, hashed, signature, &rsa.PSSOptions{
+			SaltLength: v.SaltLength,
+		})
+	} else {
+		err = rsa.VerifyPKCS1v15(v.PublicKey, v.Hash, hashed, signature)
+	}
+	if errors.Is(err, rsa.ErrVerification) {
+		return false, nil
 	}
-	hashedData := hashed.Sum(nil)
 	if err != nil {
-		panic(err)
+		return false, fmt.Errorf("failed to verify signature: %w", err)
+	}
+	return true, nil
+}
+
+// ECCVerifier verifies ASN.1 encoded ECDSA signatures created by SignECC.
+type ECCVerifier struct {
+	PublicKey *ecdsa.PublicKey
+	Hash      crypto.Hash
+}
+
+// Verify checks the signature of the data against the ECC public key.
+func (v *ECCVerifier) Verify(signedData []byte, signature []byte) (bool, error) {
+	return ecdsa.VerifyASN1(v.PublicKey, Digest(v.Hash, signedData), signature), nil
+}
+
+// RSASigner signs data with an RSA private key using PKCS#1 v1.5 or PSS depending on the scheme.
+type RSASigner struct {
+	KeyPair    *RSAKeyPair
+	Scheme     string
+	SaltLength int
+	Hash       crypto.Hash
+}
+
+// Sign signs the data using SignRSA or SignRSAPSS.
+func (s *RSASigner) Sign(dataToBeSigned []byte) ([]byte, error) {
+	if s.Scheme == RSASchemePSS {
+		return SignRSAPSS(s.KeyPair, dataToBeSigned, s.Hash, s.SaltLength)
 	}
-	signature, err := rsa.SignPKCS1v15(rand.Reader, keypair.Private, crypto.SHA256, hashedData)
+	return SignRSA(s.KeyPair, dataToBeSigned, s.Hash)
+}
+
+// ECCSigner signs data with an ECC private key using ECDSA.
+type ECCSigner struct {
+	KeyPair *ECCKeyPair
+	Hash    crypto.Hash
+}
+
+// Sign signs the data using SignECC.
+func (s *ECCSigner) Sign(dataToBeSigned []byte) ([]byte, error) {
+	return SignECC(s.KeyPair, dataToBeSigned, s.Hash)
+}
+
+// SignRSA signs the digest of the data using RSA PKCS#1 v1.5.
+func SignRSA(keypair *RSAKeyPair, dataToBeSigned []byte, hash crypto.Hash) ([]byte, error) {
+	signature, err := rsa.SignPKCS1v15(rand.Reader, keypair.Private, hash, Digest(hash, dataToBeSigned))
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign data: %w", err)
 	}
 	return signature, nil
 }
 
-// SignECC signs the data using ECDSA.
-func SignECC(keypair *ECCKeyPair, dataToBeSigned []byte) ([]byte, error) {
-	hashed := crypto.SHA256.New()
-	hashed.Write(dataToBeSigned)
-	hashedData := hashed.Sum(nil)
+// SignRSAPSS signs the digest of the data using RSASSA-PSS with the given salt length.
+func SignRSAPSS(keypair *RSAKeyPair, dataToBeSigned []byte, hash crypto.Hash, saltLength int) ([]byte, error) {
+	signature, err := rsa.SignPSS(rand.Reader, keypair.Private, hash, Digest(hash, dataToBeSigned), &rsa.PSSOptions{
+		SaltLength: saltLength,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %w", err)
+	}
+	return signature, nil
+}
 
-	signature, err := ecdsa.SignASN1(rand.Reader, keypair.Private, hashedData)
+// SignECC signs the digest of the data using ECDSA.
+func SignECC(keypair *ECCKeyPair, dataToBeSigned []byte, hash crypto.Hash) ([]byte, error) {
+	signature, err := ecdsa.SignASN1(rand.Reader, keypair.Private, Digest(hash, dataToBeSigned))
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign data: %w", err)
 	}
@@ -0,0 +1,257 @@
+package domain
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"encoding/base64"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"strings"
+)
+
+// Reasons of a ChainViolation.
+const (
+	ViolationCounterGap           = "counter_gap"
+	ViolationChainBroken          = "chain_broken"
+	ViolationSignedDataMismatch   = "signed_data_mismatch"
+	ViolationInvalidSignature     = "invalid_signature"
+	ViolationDeviceStateMismatch  = "device_state_mismatch"
+	ViolationInvalidKeyTransition = "invalid_key_transition"
+)
+
+// auditPageSize is the number of signature records loaded at once during an audit.
+const auditPageSize = 500
+
+// ChainViolation describes the first signature record that breaks the signature chain of a device.
+type ChainViolation struct {
+	Counter int32  `json:"counter"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (v *ChainViolation) Error() string {
+	return fmt.Sprintf("signature %d: %s: %s", v.Counter, v.Reason, v.Message)
+}
+
+// AuditReport is the result of checking the signature chain of a device.
+type AuditReport struct {
+	DeviceID          string          `json:"device_id"`
+	SignatureCounter  int32           `json:"signature_counter"`
+	CheckedSignatures int             `json:"checked_signatures"`
+	Valid             bool            `json:"valid"`
+	FirstBrokenLink   *ChainViolation `json:"first_broken_link,omitempty"`
+}
+
+// ChainVerifier checks the signature records of a device one after another in counter order.
+// Every signed_data has to embed the record's counter, its data and the previous signature,
+// with the base64 encoded device ID in place of the previous signature for counter 0.
+type ChainVerifier struct {
+	deviceID string
+	verifier crypto.Verifier
+	next     int32
+	previous string
+	// newVerifier creates the verifier of the public key introduced by a key transition record,
+	// key transitions are not followed if it is nil.
+	newVerifier func(publicKey stdcrypto.PublicKey) (crypto.Verifier, error)
+	publicKey   stdcrypto.PublicKey
+}
+
+// NewChainVerifier creates a ChainVerifier for the device, the verifier checks the signatures.
+func NewChainVerifier(deviceID string, verifier crypto.Verifier) *ChainVerifier {
+	return &ChainVerifier{
+		deviceID: deviceID,
+		verifier: verifier,
+		previous: base64.StdEncoding.EncodeToString([]byte(deviceID)),
+	}
+}
+
+// FollowKeyTransitions makes the verifier check the records following a key transition record with the
+// public key it introduces, the verifier of that key is created by newVerifier.
+func (v *ChainVerifier) FollowKeyTransitions(newVerifier func(publicKey stdcrypto.PublicKey) (crypto.Verifier, error)) {
+	v.newVerifier = newVerifier
+}
+
+// Verify checks the next record of the chain and returns the violation it contains, if any.
+func (v *ChainVerifier) Verify(record *SignatureRecord) *ChainViolation {
+	if record.Counter != v.next {
+		return &ChainViolation{
+			Counter: record.Counter,
+			Reason:  ViolationCounterGap,
+			Message: fmt.Sprintf("expected signature counter %d", v.next),
+		}
+	}
+
+	expected := fmt.Sprintf("%d_%s_%s", record.Counter, record.DataToBeSigned, v.previous)
+	if record.SignedData != expected {
+		if !strings.HasSuffix(record.SignedData, "_"+v.previous) {
+			return &ChainViolation{
+				Counter: record.Counter,
+				Reason:  ViolationChainBroken,
+				Message: "signed_data does not reference the previous signature",
+			}
+		}
+		return &ChainViolation{
+			Counter: record.Counter,
+			Reason:  ViolationSignedDataMismatch,
+			Message: fmt.Sprintf("signed_data does not match %q", expected),
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(record.Signature)
+	if err != nil {
+		return &ChainViolation{
+			Counter: record.Counter,
+			Reason:  ViolationInvalidSignature,
+			Message: "signature is not base64 encoded",
+		}
+	}
+	valid, err := v.verifier.Verify([]byte(record.SignedData), signature)
+	if err != nil || !valid {
+		return &ChainViolation{
+			Counter: record.Counter,
+			Reason:  ViolationInvalidSignature,
+			Message: "signature does not match the device public key",
+		}
+	}
+
+	if record.Kind == SignatureKindKeyTransition && v.newVerifier != nil {
+		publicKey, err := ParseKeyTransitionData(record.DataToBeSigned)
+		var verifier crypto.Verifier
+		if err == nil {
+			verifier, err = v.newVerifier(publicKey)
+		}
+		if err != nil {
+			return &ChainViolation{
+				Counter: record.Counter,
+				Reason:  ViolationInvalidKeyTransition,
+				Message: fmt.Sprintf("key transition does not carry a usable public key: %v", err),
+			}
+		}
+		v.verifier = verifier
+		v.publicKey = publicKey
+	}
+
+	v.next++
+	v.previous = record.Signature
+	return nil
+}
+
+// Checked returns the number of records verified successfully.
+func (v *ChainVerifier) Checked() int32 {
+	return v.next
+}
+
+// PublicKey returns the public key introduced by the last key transition verified successfully,
+// or nil if there is none.
+func (v *ChainVerifier) PublicKey() stdcrypto.PublicKey {
+	return v.publicKey
+}
+
+// Previous returns the last signature verified successfully, or the base64 encoded device ID if there is none.
+func (v *ChainVerifier) Previous() string {
+	return v.previous
+}
+
+// Audit walks the stored signature records of a device, re-verifies every signature with the public key
+// the device had at the time and checks that the counters are contiguous from 0 and every signed_data
+// references the previous signature. Starting with the first key of the device, the key introduced by
+// every key transition record verifies the following records and has to match the stored key history.
+// The report lists the first broken link, if any.
+func (s *SignatureService) Audit(ctx context.Context, deviceID string) (*AuditReport, error) {
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.deviceKeys(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	publicKeys := make([]stdcrypto.PublicKey, len(keys))
+	for i, key := range keys {
+		publicKeys[i], err = device.DecodeKey(key.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	verifier, err := keyVerifier(device, publicKeys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	report := &AuditReport{
+		DeviceID:         device.ID,
+		SignatureCounter: device.SignatureCounter,
+	}
+	chain := NewChainVerifier(device.ID, verifier)
+	chain.FollowKeyTransitions(func(publicKey stdcrypto.PublicKey) (crypto.Verifier, error) {
+		return keyVerifier(device, publicKey)
+	})
+	version := 0
+
+	// Signatures created after the device was loaded are not part of the audit.
+	last := device.SignatureCounter - 1
+	from := int32(0)
+	for from <= last {
+		records, err := s.storage.ListSignatures(ctx, device.ID, SignatureFilter{
+			FromCounter: &from,
+			ToCounter:   &last,
+			Limit:       auditPageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for _, record := range records {
+			violation := chain.Verify(record)
+			if violation == nil && record.Kind == SignatureKindKeyTransition {
+				version++
+				if version >= len(keys) || keys[version].FromCounter != record.Counter+1 ||
+					!samePublicKey(chain.PublicKey(), publicKeys[version]) {
+					violation = &ChainViolation{
+						Counter: record.Counter,
+						Reason:  ViolationDeviceStateMismatch,
+						Message: "key transition does not match the key history of the device",
+					}
+				}
+			}
+			if violation != nil {
+				report.CheckedSignatures = int(chain.Checked())
+				report.FirstBrokenLink = violation
+				return report, nil
+			}
+		}
+		from = records[len(records)-1].Counter + 1
+	}
+	report.CheckedSignatures = int(chain.Checked())
+
+	if chain.Checked() != device.SignatureCounter {
+		report.FirstBrokenLink = &ChainViolation{
+			Counter: chain.Checked(),
+			Reason:  ViolationCounterGap,
+			Message: fmt.Sprintf("device counter is %d but only %d signatures are stored", device.SignatureCounter, chain.Checked()),
+		}
+		return report, nil
+	}
+	if version != len(keys)-1 {
+		report.FirstBrokenLink = &ChainViolation{
+			Counter: *keys[version].ToCounter,
+			Reason:  ViolationDeviceStateMismatch,
+			Message: fmt.Sprintf("the device has %d keys but its chain holds %d key transitions", len(keys), version),
+		}
+		return report, nil
+	}
+	if device.SignatureCounter > 0 && chain.Previous() != device.LastSignature {
+		report.FirstBrokenLink = &ChainViolation{
+			Counter: device.SignatureCounter - 1,
+			Reason:  ViolationDeviceStateMismatch,
+			Message: "last signature of the device does not match the last stored signature",
+		}
+		return report, nil
+	}
+
+	report.Valid = true
+	return report, nil
+}
@@ -0,0 +1,150 @@
+package domain_test
+
+import (
+	"context"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// tamperingStorage changes the signature records read from the underlying storage.
+type tamperingStorage struct {
+	domain.Storage
+	tamper func(records []*domain.SignatureRecord) []*domain.SignatureRecord
+}
+
+func (s *tamperingStorage) ListSignatures(ctx context.Context, deviceID string, filter domain.SignatureFilter) ([]*domain.SignatureRecord, error) {
+	records, err := s.Storage.ListSignatures(ctx, deviceID, filter)
+	if err != nil {
+		return nil, err
+	}
+	return s.tamper(records), nil
+}
+
+// newAuditedDevice creates a device with three signatures and returns a service auditing it
+// through a storage that applies tamper to the signature records.
+func newAuditedDevice(t *testing.T, algorithm string, tamper func(records []*domain.SignatureRecord) []*domain.SignatureRecord) (*domain.SignatureService, string) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage)
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: algorithm})
+	assert.NoError(t, err)
+	for _, data := range []string{"a", "b", "c"} {
+		_, err = service.Sign(ctx, device.ID, data)
+		assert.NoError(t, err)
+	}
+
+	return domain.NewSignatureService(&tamperingStorage{Storage: storage, tamper: tamper}), device.ID
+}
+
+func TestAuditIntactChain(t *testing.T) {
+	for _, algorithm := range []string{"ECC", "RSA", "ED25519"} {
+		service, id := newAuditedDevice(t, algorithm, func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+			return records
+		})
+
+		report, err := service.Audit(context.Background(), id)
+		assert.NoError(t, err)
+		assert.True(t, report.Valid, algorithm)
+		assert.Equal(t, 3, report.CheckedSignatures)
+		assert.Equal(t, int32(3), report.SignatureCounter)
+		assert.Nil(t, report.FirstBrokenLink)
+	}
+}
+
+func TestAuditEmptyChain(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	report, err := service.Audit(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 0, report.CheckedSignatures)
+
+	_, err = service.Audit(ctx, "unknown")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestAuditReportsFirstBrokenLink(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func(records []*domain.SignatureRecord) []*domain.SignatureRecord
+		counter int32
+		reason  string
+		checked int
+	}{
+		{
+			name: "missing signature",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				return append(records[:1], records[2:]...)
+			},
+			counter: 2,
+			reason:  domain.ViolationCounterGap,
+			checked: 1,
+		},
+		{
+			name: "truncated log",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				kept := make([]*domain.SignatureRecord, 0)
+				for _, record := range records {
+					if record.Counter < 2 {
+						kept = append(kept, record)
+					}
+				}
+				return kept
+			},
+			counter: 2,
+			reason:  domain.ViolationCounterGap,
+			checked: 2,
+		},
+		{
+			name: "changed data",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[1].DataToBeSigned = "forged"
+				return records
+			},
+			counter: 1,
+			reason:  domain.ViolationSignedDataMismatch,
+			checked: 1,
+		},
+		{
+			name: "replaced previous signature",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[2].SignedData = "2_c_" + records[0].Signature
+				return records
+			},
+			counter: 2,
+			reason:  domain.ViolationChainBroken,
+			checked: 2,
+		},
+		{
+			name: "forged signature",
+			tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				records[0].Signature = records[1].Signature
+				return records
+			},
+			counter: 0,
+			reason:  domain.ViolationInvalidSignature,
+			checked: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, id := newAuditedDevice(t, "ECC", test.tamper)
+
+			report, err := service.Audit(context.Background(), id)
+			assert.NoError(t, err)
+			assert.False(t, report.Valid)
+			if assert.NotNil(t, report.FirstBrokenLink) {
+				assert.Equal(t, test.counter, report.FirstBrokenLink.Counter)
+				assert.Equal(t, test.reason, report.FirstBrokenLink.Reason)
+			}
+			assert.Equal(t, test.checked, report.CheckedSignatures)
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package domain
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"math/big"
+	"time"
+)
+
+// Reasons for revoking a device certificate, a subset of the CRL reason codes of RFC 5280.
+const (
+	RevocationReasonUnspecified          = "unspecified"
+	RevocationReasonKeyCompromise        = "key_compromise"
+	RevocationReasonSuperseded           = "superseded"
+	RevocationReasonCessationOfOperation = "cessation_of_operation"
+)
+
+// revocationReasonCodes maps the revocation reasons to their CRL reason code.
+var revocationReasonCodes = map[string]int{
+	RevocationReasonUnspecified:          0,
+	RevocationReasonKeyCompromise:        1,
+	RevocationReasonSuperseded:           4,
+	RevocationReasonCessationOfOperation: 5,
+}
+
+var (
+	// ErrInvalidRevocationReason is returned for a revocation reason that is not supported.
+	ErrInvalidRevocationReason = errors.New("invalid revocation reason")
+	// ErrNoCertificateAuthority is returned for certificate operations of a service without a certificate authority.
+	ErrNoCertificateAuthority = errors.New("no certificate authority configured")
+)
+
+// DeviceCertificate is the X.509 certificate issued for a key of a device. The serial number is
+// hex encoded, the certificate DER encoded.
+type DeviceCertificate struct {
+	DeviceID         string     `json:"device_id"`
+	KeyVersion       int        `json:"key_version"`
+	SerialNumber     string     `json:"serial_number"`
+	Certificate      []byte     `json:"certificate"`
+	NotBefore        time.Time  `json:"not_before"`
+	NotAfter         time.Time  `json:"not_after"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+}
+
+// DeviceCertificateResponse is a device certificate with its chain up to the root certificate,
+// all as standard "CERTIFICATE" PEM blocks.
+type DeviceCertificateResponse struct {
+	KeyVersion       int        `json:"key_version"`
+	SerialNumber     string     `json:"serial_number"`
+	Certificate      string     `json:"certificate"`
+	Chain            []string   `json:"chain"`
+	NotBefore        time.Time  `json:"not_before"`
+	NotAfter         time.Time  `json:"not_after"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+}
+
+// RevokeCertificateRequest revokes the certificate of the current key of a device.
+// An empty reason means unspecified.
+type RevokeCertificateRequest struct {
+	Reason string `json:"reason"`
+}
+
+// WithCertificateAuthority makes the service issue a certificate for every device key.
+func WithCertificateAuthority(ca *crypto.CertificateAuthority) ServiceOption {
+	return func(s *SignatureService) {
+		s.certificateAuthority = ca
+	}
+}
+
+// CertificateSerialNumber derives the serial number of the certificate of a device key from the
+// device ID and the key version, so that every serial number identifies the device and key it belongs to.
+func CertificateSerialNumber(deviceID string, keyVersion int) (*big.Int, error) {
+	id, err := uuid.Parse(deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("device ID %s is not a UUID: %w", deviceID, err)
+	}
+	if keyVersion < 1 || keyVersion > 0xffff {
+		return nil, fmt.Errorf("key version %d is out of range", keyVersion)
+	}
+	serial := append(id[:], byte(keyVersion>>8), byte(keyVersion))
+	return new(big.Int).SetBytes(serial), nil
+}
+
+// PEM encodes the certificate as a standard "CERTIFICATE" PEM block.
+func (c *DeviceCertificate) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate})
+}
+
+// CertificateResponse converts a certificate of a device into its representation with the PEM encoded chain.
+func (s *SignatureService) CertificateResponse(certificate *DeviceCertificate) (*DeviceCertificateResponse, error) {
+	chain, err := s.CertificateChain()
+	if err != nil {
+		return nil, err
+	}
+
+	response := &DeviceCertificateResponse{
+		KeyVersion:       certificate.KeyVersion,
+		SerialNumber:     certificate.SerialNumber,
+		Certificate:      string(certificate.PEM()),
+		Chain:            make([]string, 0, len(chain)),
+		NotBefore:        certificate.NotBefore,
+		NotAfter:         certificate.NotAfter,
+		RevokedAt:        certificate.RevokedAt,
+		RevocationReason: certificate.RevocationReason,
+	}
+	for _, der := range chain {
+		response.Chain = append(response.Chain, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	}
+	return response, nil
+}
+
+// CertificateChain returns the DER encoded certificates of the certificate authority which complete the
+// chain of a device certificate, the intermediate certificate followed by the root certificate.
+func (s *SignatureService) CertificateChain() ([][]byte, error) {
+	if s.certificateAuthority == nil {
+		return nil, ErrNoCertificateAuthority
+	}
+	return s.certificateAuthority.Chain(), nil
+}
+
+// GetCertificate retrieves the certificate of the key of a device with the given version, version 0
+// selects the current key. It returns ErrNotFound if the key has no certificate.
+func (s *SignatureService) GetCertificate(ctx context.Context, deviceID string, keyVersion int) (*DeviceCertificate, error) {
+	if s.certificateAuthority == nil {
+		return nil, ErrNoCertificateAuthority
+	}
+
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.deviceKeys(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	if keyVersion == 0 {
+		keyVersion = len(keys)
+	}
+	if keyVersion < 1 || keyVersion > len(keys) {
+		return nil, fmt.Errorf("%w: key version %d of device %s", ErrNotFound, keyVersion, deviceID)
+	}
+
+	certificates, err := s.storage.ListCertificates(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, certificate := range certificates {
+		if certificate.KeyVersion == keyVersion {
+			return certificate, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: certificate of key version %d of device %s", ErrNotFound, keyVersion, deviceID)
+}
+
+// IssueCertificate issues the certificate of the current key of a device that has none, such as a device
+// created before the certificate authority was configured or whose certificate failed to be issued along
+// with its key. It returns ErrConflict if the key already has a certificate and ErrDeviceNotActive for a
+// decommissioned device.
+func (s *SignatureService) IssueCertificate(ctx context.Context, deviceID string) (*DeviceCertificate, error) {
+	if s.certificateAuthority == nil {
+		return nil, ErrNoCertificateAuthority
+	}
+
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device.CurrentStatus() == DeviceStatusDecommissioned {
+		return nil, fmt.Errorf("%w: device %s is %s", ErrDeviceNotActive, device.ID, device.CurrentStatus())
+	}
+	keys, err := s.deviceKeys(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	return s.issueCertificate(ctx, device, len(keys))
+}
+
+// RevokeCertificate revokes the certificate of the current key of a device, the device keeps signing.
+// It returns ErrInvalidRevocationReason for an unsupported reason and ErrConflict if the certificate
+// has already been revoked.
+func (s *SignatureService) RevokeCertificate(ctx context.Context, deviceID string, reason string) (*DeviceCertificate, error) {
+	if reason == "" {
+		reason = RevocationReasonUnspecified
+	}
+	if _, ok := revocationReasonCodes[reason]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRevocationReason, reason)
+	}
+
+	certificate, err := s.GetCertificate(ctx, deviceID, 0)
+	if err != nil {
+		return nil, err
+	}
+	revokedAt := time.Now().UTC()
+	err = s.storage.RevokeCertificate(ctx, deviceID, certificate.SerialNumber, revokedAt, reason)
+	if err != nil {
+		return nil, err
+	}
+	certificate.RevokedAt = &revokedAt
+	certificate.RevocationReason = reason
+	return certificate, nil
+}
+
+// CRL creates the DER encoded certificate revocation list of all revoked device certificates.
+func (s *SignatureService) CRL(ctx context.Context) ([]byte, error) {
+	if s.certificateAuthority == nil {
+		return nil, ErrNoCertificateAuthority
+	}
+
+	certificates, err := s.storage.ListRevokedCertificates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make([]crypto.RevokedCertificate, 0, len(certificates))
+	for _, certificate := range certificates {
+		serialNumber, ok := new(big.Int).SetString(certificate.SerialNumber, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %s of a certificate of device %s", certificate.SerialNumber, certificate.DeviceID)
+		}
+		revoked = append(revoked, crypto.RevokedCertificate{
+			SerialNumber: serialNumber,
+			RevokedAt:    *certificate.RevokedAt,
+			ReasonCode:   revocationReasonCodes[certificate.RevocationReason],
+		})
+	}
+	return s.certificateAuthority.CreateCRL(revoked, time.Now())
+}
+
+// issueCertificate issues and stores the certificate of the current key of a device, which has the
+// given version, and revokes the certificates of its previous keys as superseded. It returns ErrConflict
+// if the key already has a certificate.
+func (s *SignatureService) issueCertificate(ctx context.Context, device *InternalSignatureDevice, keyVersion int) (*DeviceCertificate, error) {
+	serialNumber, err := CertificateSerialNumber(device.ID, keyVersion)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := device.DecodePublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	subject := pkix.Name{CommonName: device.ID, SerialNumber: device.ID}
+	if device.Label != nil && *device.Label != "" {
+		subject.CommonName = *device.Label
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	der, err := s.certificateAuthority.Issue(crypto.CertificateRequest{
+		PublicKey:    publicKey,
+		SerialNumber: serialNumber,
+		Subject:      subject,
+		NotBefore:    now,
+		NotAfter:     now.Add(crypto.DefaultCertificateValidity),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The validity is taken from the certificate, as it never outlasts the intermediate certificate.
+	issued, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := &DeviceCertificate{
+		DeviceID:     device.ID,
+		KeyVersion:   keyVersion,
+		SerialNumber: serialNumber.Text(16),
+		Certificate:  der,
+		NotBefore:    issued.NotBefore.UTC(),
+		NotAfter:     issued.NotAfter.UTC(),
+	}
+	err = s.storage.InsertCertificate(ctx, certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.revokeCertificates(ctx, device.ID, RevocationReasonSuperseded, func(c *DeviceCertificate) bool {
+		return c.KeyVersion < keyVersion
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certificate, nil
+}
+
+// revokeCertificates revokes the certificates of a device that are not revoked yet and match the filter.
+func (s *SignatureService) revokeCertificates(ctx context.Context, deviceID string, reason string, matches func(c *DeviceCertificate) bool) error {
+	certificates, err := s.storage.ListCertificates(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	revokedAt := time.Now().UTC()
+	for _, certificate := range certificates {
+		if certificate.RevokedAt != nil || !matches(certificate) {
+			continue
+		}
+		err = s.storage.RevokeCertificate(ctx, deviceID, certificate.SerialNumber, revokedAt, reason)
+		if err != nil && !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return nil
+}
+
+// certifyKey issues the certificate of the current key of a device after the key has been stored.
+// The key is already in use, so a failure is only logged, the certificate can be issued later through
+// IssueCertificate.
+func (s *SignatureService) certifyKey(ctx context.Context, device *InternalSignatureDevice, keyVersion int) {
+	if s.certificateAuthority == nil {
+		return
+	}
+	_, err := s.issueCertificate(ctx, device, keyVersion)
+	if err != nil && !errors.Is(err, ErrConflict) {
+		zap.S().Warnw("Failed to issue device certificate", "device", device.ID, "keyVersion", keyVersion, "error", err)
+	}
+}
@@ -0,0 +1,192 @@
+package domain_test
+
+import (
+	"context"
+	"crypto/x509"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// newTestCertificateAuthority creates a certificate authority keeping its keys in memory.
+func newTestCertificateAuthority(t *testing.T) *crypto.CertificateAuthority {
+	t.Helper()
+	ca, err := crypto.OpenCertificateAuthority(crypto.CertificateAuthorityConfig{})
+	assert.NoError(t, err)
+	return ca
+}
+
+// verifyCertificate parses a device certificate and checks that it chains up to the root of the service's CA.
+func verifyCertificate(t *testing.T, service *domain.SignatureService, certificate *domain.DeviceCertificate) *x509.Certificate {
+	t.Helper()
+	parsed, err := x509.ParseCertificate(certificate.Certificate)
+	assert.NoError(t, err)
+
+	chain, err := service.CertificateChain()
+	assert.NoError(t, err)
+	intermediates := x509.NewCertPool()
+	roots := x509.NewCertPool()
+	for i, der := range chain {
+		ca, err := x509.ParseCertificate(der)
+		assert.NoError(t, err)
+		if i == len(chain)-1 {
+			roots.AddCert(ca)
+		} else {
+			intermediates.AddCert(ca)
+		}
+	}
+	_, err = parsed.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         roots,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	assert.NoError(t, err)
+	return parsed
+}
+
+func TestCreateDeviceIssuesCertificate(t *testing.T) {
+	for _, algorithm := range []string{"ECC", "RSA", "ED25519"} {
+		t.Run(algorithm, func(t *testing.T) {
+			ctx := context.Background()
+			service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage(),
+				domain.WithCertificateAuthority(newTestCertificateAuthority(t)))
+			label := "till 1"
+
+			device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: algorithm, Label: &label})
+			assert.NoError(t, err)
+
+			certificate, err := service.GetCertificate(ctx, device.ID, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, certificate.KeyVersion)
+			assert.Nil(t, certificate.RevokedAt)
+
+			parsed := verifyCertificate(t, service, certificate)
+			assert.Equal(t, parsed.NotBefore, certificate.NotBefore)
+			assert.Equal(t, parsed.NotAfter, certificate.NotAfter)
+			assert.Equal(t, label, parsed.Subject.CommonName)
+			assert.Equal(t, device.ID, parsed.Subject.SerialNumber)
+			serialNumber, err := domain.CertificateSerialNumber(device.ID, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, serialNumber, parsed.SerialNumber)
+			assert.Equal(t, serialNumber.Text(16), certificate.SerialNumber)
+
+			publicKey, err := device.DecodePublicKey()
+			assert.NoError(t, err)
+			assert.Equal(t, publicKey, parsed.PublicKey)
+		})
+	}
+}
+
+func TestIssueCertificateOfDeviceWithoutCertificate(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	device, err := domain.NewSignatureService(storage).CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	_, err = domain.NewSignatureService(storage).GetCertificate(ctx, device.ID, 0)
+	assert.ErrorIs(t, err, domain.ErrNoCertificateAuthority)
+	_, err = domain.NewSignatureService(storage).IssueCertificate(ctx, device.ID)
+	assert.ErrorIs(t, err, domain.ErrNoCertificateAuthority)
+
+	// Retrieving a missing certificate does not issue it.
+	service := domain.NewSignatureService(storage, domain.WithCertificateAuthority(newTestCertificateAuthority(t)))
+	_, err = service.GetCertificate(ctx, device.ID, 0)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	certificate, err := service.IssueCertificate(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, certificate.KeyVersion)
+	parsed := verifyCertificate(t, service, certificate)
+	// Devices without a label are named by their ID.
+	assert.Equal(t, device.ID, parsed.Subject.CommonName)
+
+	again, err := service.GetCertificate(ctx, device.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, certificate, again)
+	_, err = service.IssueCertificate(ctx, device.ID)
+	assert.ErrorIs(t, err, domain.ErrConflict)
+
+	_, err = service.GetCertificate(ctx, device.ID, 2)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+	_, err = service.GetCertificate(ctx, "unknown", 0)
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+	_, err = service.IssueCertificate(ctx, "unknown")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+
+	// Decommissioned devices get no new certificates.
+	other, err := domain.NewSignatureService(storage).CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	_, err = service.ChangeDeviceStatus(ctx, other.ID, domain.DeviceStatusDecommissioned, "")
+	assert.NoError(t, err)
+	_, err = service.IssueCertificate(ctx, other.ID)
+	assert.ErrorIs(t, err, domain.ErrDeviceNotActive)
+}
+
+func TestRotateKeySupersedesCertificate(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage(),
+		domain.WithCertificateAuthority(newTestCertificateAuthority(t)))
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	rotated, _, _, err := service.RotateKey(ctx, device.ID)
+	assert.NoError(t, err)
+
+	current, err := service.GetCertificate(ctx, device.ID, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, current.KeyVersion)
+	assert.Nil(t, current.RevokedAt)
+	publicKey, err := rotated.DecodePublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, publicKey, verifyCertificate(t, service, current).PublicKey)
+
+	previous, err := service.GetCertificate(ctx, device.ID, 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, previous.RevokedAt)
+	assert.Equal(t, domain.RevocationReasonSuperseded, previous.RevocationReason)
+	assert.NotEqual(t, previous.SerialNumber, current.SerialNumber)
+}
+
+func TestRevokeCertificate(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage(),
+		domain.WithCertificateAuthority(newTestCertificateAuthority(t)))
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	other, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	_, err = service.RevokeCertificate(ctx, device.ID, "lost")
+	assert.ErrorIs(t, err, domain.ErrInvalidRevocationReason)
+
+	revoked, err := service.RevokeCertificate(ctx, device.ID, domain.RevocationReasonKeyCompromise)
+	assert.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	_, err = service.RevokeCertificate(ctx, device.ID, "")
+	assert.ErrorIs(t, err, domain.ErrConflict)
+
+	// Decommissioning revokes the remaining certificates.
+	_, err = service.ChangeDeviceStatus(ctx, other.ID, domain.DeviceStatusDecommissioned, "")
+	assert.NoError(t, err)
+	decommissioned, err := service.GetCertificate(ctx, other.ID, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.RevocationReasonCessationOfOperation, decommissioned.RevocationReason)
+
+	der, err := service.CRL(ctx)
+	assert.NoError(t, err)
+	crl, err := x509.ParseRevocationList(der)
+	assert.NoError(t, err)
+	chain, err := service.CertificateChain()
+	assert.NoError(t, err)
+	intermediate, err := x509.ParseCertificate(chain[0])
+	assert.NoError(t, err)
+	assert.NoError(t, crl.CheckSignatureFrom(intermediate))
+
+	serialNumbers := make([]string, 0, len(crl.RevokedCertificates))
+	for _, entry := range crl.RevokedCertificates {
+		serialNumbers = append(serialNumbers, entry.SerialNumber.Text(16))
+	}
+	assert.ElementsMatch(t, []string{revoked.SerialNumber, decommissioned.SerialNumber}, serialNumbers)
+}
@@ -1,73 +1,177 @@
 package domain
 
 import (
+	stdcrypto "crypto"
+	"encoding/base64"
+	"fmt"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
-	"sync"
 )
 
-// Algorithm represents the supported algorithms.
-type Algorithm int
+// CreateSignatureDeviceRequest represents the request body for creating a signature device.
+// Curve, KeySize, SignatureScheme, SaltLength and HashAlgorithm are optional and default per algorithm.
+type CreateSignatureDeviceRequest struct {
+	Algorithm       string  `json:"algorithm"`
+	Label           *string `json:"label"`
+	Curve           string  `json:"curve"`
+	KeySize         int     `json:"key_size"`
+	SignatureScheme string  `json:"signature_scheme"`
+	SaltLength      int     `json:"salt_length"`
+	HashAlgorithm   string  `json:"hash_algorithm"`
+	// KeyBackend selects where the key pair is generated, see KeyBackendSoftware and KeyBackendPKCS11.
+	KeyBackend string `json:"key_backend"`
+}
 
-// Constants representing supported algorithms.
-const (
-	ECC Algorithm = iota + 1
-	RSA
-)
+// InternalSignatureDevice is the stored representation of a signature device.
+// The key pair is generated once at creation and kept PEM encoded. If KeyEncryptionKeyID is set,
+// the private key is sealed by the key-encryption key with that ID, see crypto.Keyring. Devices whose
+// key pair was generated in a hardware security module have no private key but its KeyHandle.
+type InternalSignatureDevice struct {
+	ID               string  `json:"id"`
+	Algorithm        string  `json:"algorithm"`
+	Label            *string `json:"label"`
+	Curve            string  `json:"curve"`
+	KeySize          int     `json:"keySize"`
+	SignatureScheme  string  `json:"signatureScheme"`
+	SaltLength       int     `json:"saltLength"`
+	HashAlgorithm    string  `json:"hashAlgorithm"`
+	Status           string  `json:"status,omitempty"`
+	SignatureCounter int32   `json:"signatureCounter"`
+	LastSignature    string  `json:"lastSignature"`
+	PublicKey        []byte  `json:"publicKey"`
+	PrivateKey       []byte  `json:"privateKey"`
+	// KeyEncryptionKeyID is empty for private keys stored in the clear.
+	KeyEncryptionKeyID string `json:"keyEncryptionKeyId,omitempty"`
+	// KeyHandle references the private key in a PKCS#11 token, see crypto.PKCS11KeyHandle.
+	KeyHandle string `json:"keyHandle,omitempty"`
+}
 
-var (
-	onceSignatureService      sync.Once
-	singletonSignatureService *SignatureService
-)
+// Clone returns a copy of the device that can be changed without affecting the original.
+func (d *InternalSignatureDevice) Clone() *InternalSignatureDevice {
+	clone := *d
+	if d.Label != nil {
+		label := *d.Label
+		clone.Label = &label
+	}
+	return &clone
+}
 
-// AlgorithmNames maps algorithm strings to their corresponding Algorithm constants.
-var AlgorithmNames = map[string]Algorithm{
-	"ECC": ECC,
-	"RSA": RSA,
+// SecuredDataToBeSigned extends the raw data with the device's signature counter and last signature
+// following the format <signature_counter>_<data_to_be_signed>_<last_signature_base64_encoded>.
+// For the first signature the base64 encoded device ID is used instead of the last signature.
+func (d *InternalSignatureDevice) SecuredDataToBeSigned(data string) string {
+	lastSignature := d.LastSignature
+	if d.SignatureCounter == 0 {
+		lastSignature = base64.StdEncoding.EncodeToString([]byte(d.ID))
+	}
+	return fmt.Sprintf("%d_%s_%s", d.SignatureCounter, data, lastSignature)
 }
 
-// CreateSignatureDeviceRequest represents the request body for creating a signature device.
-type CreateSignatureDeviceRequest struct {
-	Algorithm string  `json:"algorithm"`
-	Label     *string `json:"label"`
+// RecordSignature keeps the base64 encoded signature as the device's last signature
+// and increments its signature counter.
+func (d *InternalSignatureDevice) RecordSignature(signature string) {
+	d.LastSignature = signature
+	d.SignatureCounter++
 }
 
-type InternalSignatureDevice struct {
-	ID               string                  `json:"id"`
-	Algorithm        crypto.KeyPairGenerator `json:"algorithm"`
-	Label            *string                 `json:"label"`
-	SignatureCounter int32                   `json:"signatureCounter"`
+// Verify checks a signature of the data against the device's public key.
+func (d *InternalSignatureDevice) Verify(data []byte, signature []byte) (bool, error) {
+	verifier, err := d.Verifier()
+	if err != nil {
+		return false, err
+	}
+	return verifier.Verify(data, signature)
 }
 
-type CreateSignatureDeviceResponse struct {
-	ID        string `json:"id"`
-	Algorithm string `json:"algorithm"`
-	Label     string `json:"label"`
+// Verifier creates a verifier for the signatures of the device.
+func (d *InternalSignatureDevice) Verifier() (crypto.Verifier, error) {
+	algorithm, err := crypto.LookupAlgorithm(d.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.Verifier(d.PublicKey, d.SignatureOptions())
 }
 
-type SignatureService struct {
-	Devices map[string]*InternalSignatureDevice
-	Mutex   sync.Mutex
+// KeyBackend returns where the private key of the device is kept.
+func (d *InternalSignatureDevice) KeyBackend() string {
+	if d.KeyHandle != "" {
+		return KeyBackendPKCS11
+	}
+	return KeyBackendSoftware
 }
 
-func NewSignatureService() *SignatureService {
-	return &SignatureService{
-		Devices: make(map[string]*InternalSignatureDevice),
+// SignatureOptions returns the signature scheme parameters the device was created with.
+func (d *InternalSignatureDevice) SignatureOptions() crypto.SignatureOptions {
+	return crypto.SignatureOptions{
+		Scheme:     d.SignatureScheme,
+		SaltLength: d.SaltLength,
+		Hash:       d.HashAlgorithm,
 	}
 }
 
-func GetSignatureService() *SignatureService {
-	onceSignatureService.Do(func() {
-		singletonSignatureService = NewSignatureService()
-	})
-	return singletonSignatureService
+// DecodePublicKey parses the device's public key.
+func (d *InternalSignatureDevice) DecodePublicKey() (stdcrypto.PublicKey, error) {
+	return d.DecodeKey(d.PublicKey)
+}
+
+// DecodeKey parses a public key of the device, such as a retired one, encoded by the device's algorithm.
+func (d *InternalSignatureDevice) DecodeKey(publicKey []byte) (stdcrypto.PublicKey, error) {
+	algorithm, err := crypto.LookupAlgorithm(d.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.Marshaler.DecodePublic(publicKey)
+}
+
+type CreateSignatureDeviceResponse struct {
+	ID              string `json:"id"`
+	Algorithm       string `json:"algorithm"`
+	Label           string `json:"label"`
+	Curve           string `json:"curve,omitempty"`
+	KeySize         int    `json:"key_size,omitempty"`
+	SignatureScheme string `json:"signature_scheme,omitempty"`
+	SaltLength      int    `json:"salt_length,omitempty"`
+	HashAlgorithm   string `json:"hash_algorithm,omitempty"`
+	KeyBackend      string `json:"key_backend"`
+}
+
+// SignatureDeviceResponse is the device resource of the v1 API, which also reports the lifecycle state
+// and the signature counter.
+type SignatureDeviceResponse struct {
+	*CreateSignatureDeviceResponse
+	Status           string `json:"status"`
+	SignatureCounter int32  `json:"signature_counter"`
+}
+
+// UpdateSignatureDeviceRequest represents the request body for changing the label of a signature device.
+type UpdateSignatureDeviceRequest struct {
+	Label *string `json:"label"`
+}
+
+// CreateSignatureRequest represents the request body for signing data with a device in the v1 API.
+// The idempotency key can also be sent in the Idempotency-Key header.
+type CreateSignatureRequest struct {
+	Data           string `json:"data"`
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 type SignTransactionRequest struct {
-	ID   string `json:"id"`
-	Data string `json:"data"`
+	ID             string `json:"id"`
+	Data           string `json:"data"`
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 type SignatureResponse struct {
 	Signature  string `json:"signature"`
 	SignedData string `json:"signed_data"`
 }
+
+// VerifySignatureRequest represents the request body for verifying a signature of a device.
+type VerifySignatureRequest struct {
+	ID         string `json:"id"`
+	SignedData string `json:"signed_data"`
+	Signature  string `json:"signature"`
+}
+
+type VerifySignatureResponse struct {
+	Valid bool `json:"valid"`
+}
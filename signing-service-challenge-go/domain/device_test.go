@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSecuredDataToBeSignedUsesDeviceIDForFirstSignature(t *testing.T) {
+	device := &InternalSignatureDevice{ID: "device-1"}
+
+	secured := device.SecuredDataToBeSigned("data")
+
+	assert.Equal(t, "0_data_"+base64.StdEncoding.EncodeToString([]byte("device-1")), secured)
+}
+
+func TestRecordSignatureChainsLastSignature(t *testing.T) {
+	device := &InternalSignatureDevice{ID: "device-1"}
+
+	device.RecordSignature("c2lnbmF0dXJl")
+	assert.Equal(t, int32(1), device.SignatureCounter)
+	assert.Equal(t, "1_data_c2lnbmF0dXJl", device.SecuredDataToBeSigned("data"))
+
+	device.RecordSignature("b3RoZXI=")
+	assert.Equal(t, int32(2), device.SignatureCounter)
+	assert.Equal(t, "2_data_b3RoZXI=", device.SecuredDataToBeSigned("data"))
+}
@@ -0,0 +1,309 @@
+package domain
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"hash"
+	"io"
+	"time"
+)
+
+// Files of a device export archive.
+const (
+	ExportDeviceFile        = "device.json"
+	ExportPublicKeyFile     = "public_key.pem"
+	ExportKeysFile          = "keys.json"
+	ExportSignatureLogFile  = "signatures.jsonl"
+	ExportManifestFile      = "manifest.json"
+	ExportManifestSignature = "manifest.sig"
+)
+
+// exportPageSize is the number of signature records loaded at once while writing the signature log.
+const exportPageSize = 500
+
+// ExportedDevice is the device metadata written to an export archive.
+type ExportedDevice struct {
+	ID               string `json:"id"`
+	Algorithm        string `json:"algorithm"`
+	Label            string `json:"label"`
+	Curve            string `json:"curve,omitempty"`
+	KeySize          int    `json:"key_size,omitempty"`
+	SignatureScheme  string `json:"signature_scheme,omitempty"`
+	SaltLength       int    `json:"salt_length,omitempty"`
+	HashAlgorithm    string `json:"hash_algorithm,omitempty"`
+	Status           string `json:"status"`
+	SignatureCounter int32  `json:"signature_counter"`
+	LastSignature    string `json:"last_signature,omitempty"`
+}
+
+// ExportManifest lists the files of an export archive with their SHA-256 digests.
+// It is signed by the device, the base64 encoded signature is stored next to it in manifest.sig.
+type ExportManifest struct {
+	DeviceID         string         `json:"device_id"`
+	SignatureCounter int32          `json:"signature_counter"`
+	CreatedAt        time.Time      `json:"created_at"`
+	Files            []ExportedFile `json:"files"`
+}
+
+// ExportedFile is a file of an export archive as listed in the manifest.
+type ExportedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// DeviceExport writes the archive of a device as of the time it was loaded.
+// Signatures created afterwards are not part of the archive.
+type DeviceExport struct {
+	storage   Storage
+	device    *InternalSignatureDevice
+	keys      []*DeviceKey
+	signer    crypto.Signer
+	createdAt time.Time
+}
+
+// Export loads the device to be exported. The archive is written by DeviceExport.WriteTar,
+// so that a missing device can be reported before anything is written.
+func (s *SignatureService) Export(ctx context.Context, deviceID string) (*DeviceExport, error) {
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.deviceKeys(ctx, device)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := s.deviceSigner(device)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceExport{
+		storage:   s.storage,
+		device:    device,
+		keys:      keys,
+		signer:    signer,
+		createdAt: time.Now().UTC(),
+	}, nil
+}
+
+// DeviceID returns the ID of the exported device.
+func (e *DeviceExport) DeviceID() string {
+	return e.device.ID
+}
+
+// WriteTar streams the export as a tar archive holding the device metadata, its current public key,
+// all its keys with the signature counters they signed, the signature log in JSON Lines format and
+// the signed manifest.
+// The signature log is read from the storage twice, once to compute its size and digest
+// for the tar header and the manifest, and once to write it, so it is never held in memory.
+func (e *DeviceExport) WriteTar(ctx context.Context, w io.Writer) error {
+	device, err := e.deviceFile()
+	if err != nil {
+		return err
+	}
+	publicKey, err := e.publicKeyFile()
+	if err != nil {
+		return err
+	}
+	keys, err := e.keysFile()
+	if err != nil {
+		return err
+	}
+
+	logDigest := newDigestWriter()
+	err = e.writeSignatureLog(ctx, logDigest)
+	if err != nil {
+		return err
+	}
+
+	manifest := ExportManifest{
+		DeviceID:         e.device.ID,
+		SignatureCounter: e.device.SignatureCounter,
+		CreatedAt:        e.createdAt,
+		Files: []ExportedFile{
+			digestFile(ExportDeviceFile, device),
+			digestFile(ExportPublicKeyFile, publicKey),
+			digestFile(ExportKeysFile, keys),
+			logDigest.file(ExportSignatureLogFile),
+		},
+	}
+	manifestFile, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestSignature, err := e.signer.Sign(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(w)
+	for _, file := range []struct {
+		name    string
+		content []byte
+	}{
+		{ExportDeviceFile, device},
+		{ExportPublicKeyFile, publicKey},
+		{ExportKeysFile, keys},
+	} {
+		err = e.writeTarFile(archive, file.name, file.content)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = archive.WriteHeader(e.tarHeader(ExportSignatureLogFile, logDigest.size))
+	if err != nil {
+		return err
+	}
+	written := newDigestWriter()
+	err = e.writeSignatureLog(ctx, io.MultiWriter(archive, written))
+	if err != nil {
+		return err
+	}
+	if written.file(ExportSignatureLogFile) != logDigest.file(ExportSignatureLogFile) {
+		return errors.New("signature log changed while it was exported")
+	}
+
+	err = e.writeTarFile(archive, ExportManifestFile, manifestFile)
+	if err != nil {
+		return err
+	}
+	err = e.writeTarFile(archive, ExportManifestSignature, []byte(base64.StdEncoding.EncodeToString(manifestSignature)))
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// deviceFile encodes the device metadata without its private key.
+func (e *DeviceExport) deviceFile() ([]byte, error) {
+	label := ""
+	if e.device.Label != nil {
+		label = *e.device.Label
+	}
+	return json.MarshalIndent(ExportedDevice{
+		ID:               e.device.ID,
+		Algorithm:        e.device.Algorithm,
+		Label:            label,
+		Curve:            e.device.Curve,
+		KeySize:          e.device.KeySize,
+		SignatureScheme:  e.device.SignatureScheme,
+		SaltLength:       e.device.SaltLength,
+		HashAlgorithm:    e.device.HashAlgorithm,
+		Status:           e.device.CurrentStatus(),
+		SignatureCounter: e.device.SignatureCounter,
+		LastSignature:    e.device.LastSignature,
+	}, "", "  ")
+}
+
+// publicKeyFile encodes the device's public key as a standard "PUBLIC KEY" PEM block.
+func (e *DeviceExport) publicKeyFile() ([]byte, error) {
+	publicKey, err := e.device.DecodePublicKey()
+	if err != nil {
+		return nil, err
+	}
+	return crypto.PublicKeyToPEM(publicKey)
+}
+
+// keysFile encodes the current and retired keys of the device with standard "PUBLIC KEY" PEM blocks,
+// the first key verifies the signature log up to the first key transition record.
+func (e *DeviceExport) keysFile() ([]byte, error) {
+	keys := make([]*DeviceKeyResponse, 0, len(e.keys))
+	for _, key := range e.keys {
+		keyResponse, err := e.device.KeyResponse(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, keyResponse)
+	}
+	return json.MarshalIndent(keys, "", "  ")
+}
+
+// writeSignatureLog writes the signature records of the device up to its counter as JSON Lines.
+func (e *DeviceExport) writeSignatureLog(ctx context.Context, w io.Writer) error {
+	last := e.device.SignatureCounter - 1
+	from := int32(0)
+	for from <= last {
+		records, err := e.storage.ListSignatures(ctx, e.device.ID, SignatureFilter{
+			FromCounter: &from,
+			ToCounter:   &last,
+			Limit:       exportPageSize,
+		})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+
+		var page bytes.Buffer
+		encoder := json.NewEncoder(&page)
+		for _, record := range records {
+			err = encoder.Encode(record)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = w.Write(page.Bytes())
+		if err != nil {
+			return err
+		}
+		from = records[len(records)-1].Counter + 1
+	}
+	return nil
+}
+
+func (e *DeviceExport) writeTarFile(archive *tar.Writer, name string, content []byte) error {
+	err := archive.WriteHeader(e.tarHeader(name, int64(len(content))))
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(content)
+	return err
+}
+
+func (e *DeviceExport) tarHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  e.createdAt,
+	}
+}
+
+// digestWriter computes the size and SHA-256 digest of everything written to it.
+type digestWriter struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigestWriter() *digestWriter {
+	return &digestWriter{hash: sha256.New()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.size += int64(len(p))
+	return w.hash.Write(p)
+}
+
+func (w *digestWriter) file(name string) ExportedFile {
+	return ExportedFile{
+		Name:   name,
+		Size:   w.size,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	}
+}
+
+func digestFile(name string, content []byte) ExportedFile {
+	w := newDigestWriter()
+	w.Write(content)
+	return w.file(name)
+}
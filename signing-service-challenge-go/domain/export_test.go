@@ -0,0 +1,121 @@
+package domain_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readTar returns the files of a tar archive in order.
+func readTar(t *testing.T, archive []byte) ([]string, map[string][]byte) {
+	reader := tar.NewReader(bytes.NewReader(archive))
+	var names []string
+	files := make(map[string][]byte)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return names, files
+		}
+		assert.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		names = append(names, header.Name)
+		files[header.Name] = content
+	}
+}
+
+func TestExportWritesSignedArchive(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage)
+
+	label := "Till 1"
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC", Label: &label})
+	assert.NoError(t, err)
+	for _, data := range []string{"a", "b", "c"} {
+		_, err = service.Sign(ctx, device.ID, data)
+		assert.NoError(t, err)
+	}
+
+	export, err := service.Export(ctx, device.ID)
+	assert.NoError(t, err)
+	// Signatures created after the export was started are not part of the archive.
+	_, err = service.Sign(ctx, device.ID, "d")
+	assert.NoError(t, err)
+
+	var archive bytes.Buffer
+	assert.NoError(t, export.WriteTar(ctx, &archive))
+
+	names, files := readTar(t, archive.Bytes())
+	assert.Equal(t, []string{
+		domain.ExportDeviceFile,
+		domain.ExportPublicKeyFile,
+		domain.ExportKeysFile,
+		domain.ExportSignatureLogFile,
+		domain.ExportManifestFile,
+		domain.ExportManifestSignature,
+	}, names)
+
+	var exported domain.ExportedDevice
+	assert.NoError(t, json.Unmarshal(files[domain.ExportDeviceFile], &exported))
+	assert.Equal(t, "Till 1", exported.Label)
+	assert.Equal(t, int32(3), exported.SignatureCounter)
+	assert.NotContains(t, string(files[domain.ExportDeviceFile]), "PRIVATE")
+
+	var keys []*domain.DeviceKeyResponse
+	assert.NoError(t, json.Unmarshal(files[domain.ExportKeysFile], &keys))
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, 1, keys[0].Version)
+		assert.Equal(t, string(files[domain.ExportPublicKeyFile]), keys[0].PublicKey)
+		assert.Nil(t, keys[0].ToCounter)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(files[domain.ExportSignatureLogFile]), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	var last domain.SignatureRecord
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &last))
+	assert.Equal(t, int32(2), last.Counter)
+	assert.Equal(t, exported.LastSignature, last.Signature)
+
+	var manifest domain.ExportManifest
+	assert.NoError(t, json.Unmarshal(files[domain.ExportManifestFile], &manifest))
+	assert.Equal(t, device.ID, manifest.DeviceID)
+	assert.Len(t, manifest.Files, 4)
+	for _, file := range manifest.Files {
+		digest := sha256.Sum256(files[file.Name])
+		assert.Equal(t, hex.EncodeToString(digest[:]), file.SHA256, file.Name)
+		assert.Equal(t, int64(len(files[file.Name])), file.Size, file.Name)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(string(files[domain.ExportManifestSignature]))
+	assert.NoError(t, err)
+	valid, err := device.Verify(files[domain.ExportManifestFile], signature)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	algorithm, err := crypto.LookupAlgorithm("ECC")
+	assert.NoError(t, err)
+	publicKey, err := crypto.ParsePublicKeyPEM(algorithm, files[domain.ExportPublicKeyFile])
+	assert.NoError(t, err)
+	devicePublicKey, err := device.DecodePublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, devicePublicKey, publicKey)
+}
+
+func TestExportUnknownDevice(t *testing.T) {
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	_, err := service.Export(context.Background(), "unknown")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
@@ -0,0 +1,74 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotencyKeyRetention is the time an idempotency key is remembered after its signature was created.
+const DefaultIdempotencyKeyRetention = 24 * time.Hour
+
+// MaxIdempotencyKeyLength is the maximum length of an idempotency key in bytes.
+const MaxIdempotencyKeyLength = 255
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is sent again with a different request.
+var ErrIdempotencyKeyReused = errors.New("idempotency key reused")
+
+// WithIdempotencyKeyRetention sets the time an idempotency key is remembered, after which the same key
+// signs again. It defaults to DefaultIdempotencyKeyRetention.
+func WithIdempotencyKeyRetention(retention time.Duration) ServiceOption {
+	return func(s *SignatureService) {
+		s.idempotencyKeyRetention = retention
+	}
+}
+
+// idempotencyKeyLocks serializes the requests using the same idempotency key, so that a key is only
+// ever used for one signature across all devices. The zero value is ready to use.
+type idempotencyKeyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*idempotencyKeyLock
+}
+
+// idempotencyKeyLock is the lock of a single key, it is removed once nobody holds or waits for it.
+type idempotencyKeyLock struct {
+	sync.Mutex
+	references int
+}
+
+// lock blocks until the lock of the key is acquired and returns the function releasing it.
+func (l *idempotencyKeyLocks) lock(key string) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*idempotencyKeyLock)
+	}
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &idempotencyKeyLock{}
+		l.locks[key] = lock
+	}
+	lock.references++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(l.locks, key)
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// matchIdempotentRequest returns the record stored for an idempotency key if it was created
+// for the same device and data, which makes the request a retry of the original one.
+func matchIdempotentRequest(record *SignatureRecord, deviceID string, data string) (*SignatureRecord, bool, error) {
+	if record.DeviceID != deviceID || record.DataToBeSigned != data {
+		return nil, false, fmt.Errorf("%w: the key has already been used for a different request", ErrIdempotencyKeyReused)
+	}
+	return record, true, nil
+}
@@ -0,0 +1,131 @@
+package domain_test
+
+import (
+	"context"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignIdempotentlyReplaysRetries(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	other, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	original, replayed, err := service.SignIdempotently(ctx, device.ID, "receipt", "key-1")
+	assert.NoError(t, err)
+	assert.False(t, replayed)
+	assert.Equal(t, "key-1", original.IdempotencyKey)
+
+	retry, replayed, err := service.SignIdempotently(ctx, device.ID, "receipt", "key-1")
+	assert.NoError(t, err)
+	assert.True(t, replayed)
+	assert.Equal(t, original, retry)
+
+	_, _, err = service.SignIdempotently(ctx, device.ID, "other receipt", "key-1")
+	assert.ErrorIs(t, err, domain.ErrIdempotencyKeyReused)
+	_, _, err = service.SignIdempotently(ctx, other.ID, "receipt", "key-1")
+	assert.ErrorIs(t, err, domain.ErrIdempotencyKeyReused)
+
+	// Requests without a key always sign.
+	_, replayed, err = service.SignIdempotently(ctx, device.ID, "receipt", "")
+	assert.NoError(t, err)
+	assert.False(t, replayed)
+
+	stored, err := service.GetDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), stored.SignatureCounter)
+}
+
+func TestSignIdempotentlyForgetsExpiredKeys(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage(), domain.WithIdempotencyKeyRetention(time.Millisecond))
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.NoError(t, err)
+
+	_, _, err = service.SignIdempotently(ctx, device.ID, "receipt", "key-1")
+	assert.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	record, replayed, err := service.SignIdempotently(ctx, device.ID, "other receipt", "key-1")
+	assert.NoError(t, err)
+	assert.False(t, replayed)
+	assert.Equal(t, int32(1), record.Counter)
+}
+
+func TestSignIdempotentlySignsConcurrentRetriesOnce(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			record, _, err := service.SignIdempotently(ctx, device.ID, "receipt", "key-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(0), record.Counter)
+		}()
+	}
+	wg.Wait()
+
+	stored, err := service.GetDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), stored.SignatureCounter)
+}
+
+// slowLookupStorage delays the lookups of idempotency keys, so that concurrent requests check a key
+// before any of them has stored its signature.
+type slowLookupStorage struct {
+	domain.Storage
+}
+
+func (s slowLookupStorage) FindSignatureByIdempotencyKey(ctx context.Context, deviceID string, key string, since time.Time) (*domain.SignatureRecord, error) {
+	record, err := s.Storage.FindSignatureByIdempotencyKey(ctx, deviceID, key, since)
+	time.Sleep(10 * time.Millisecond)
+	return record, err
+}
+
+func TestSignIdempotentlySignsWithKeyOnOneDeviceOnly(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(slowLookupStorage{persistence.NewSignatureDeviceStorage()})
+
+	var devices []string
+	for i := 0; i < 10; i++ {
+		device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+		assert.NoError(t, err)
+		devices = append(devices, device.ID)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	signed := 0
+	for _, id := range devices {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			_, _, err := service.SignIdempotently(ctx, id, "receipt", "key-1")
+			if err != nil {
+				assert.ErrorIs(t, err, domain.ErrIdempotencyKeyReused)
+				return
+			}
+			mutex.Lock()
+			signed++
+			mutex.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, signed)
+}
@@ -0,0 +1,206 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"go.uber.org/zap"
+)
+
+// Backends keeping the private keys of devices.
+const (
+	// KeyBackendSoftware keeps the PEM encoded private key in the storage, sealed if a keyring is configured.
+	KeyBackendSoftware = "software"
+	// KeyBackendPKCS11 generates the key pair in a PKCS#11 token, which the private key never leaves.
+	KeyBackendPKCS11 = "pkcs11"
+)
+
+var (
+	// ErrPrivateKeySealed is returned when a sealed private key is used without the keyring to open it.
+	ErrPrivateKeySealed = errors.New("private key is sealed")
+	// ErrKeyBackendUnavailable is returned when a device keeps its key in a PKCS#11 token that is not configured.
+	ErrKeyBackendUnavailable = errors.New("key backend is not available")
+	// ErrNoKeyring is returned when private keys are re-wrapped by a service without a keyring.
+	ErrNoKeyring = errors.New("no keyring configured")
+)
+
+// WithKeyring seals the private keys of new devices with the primary key-encryption key of the keyring
+// and opens sealed keys for signing. Without a keyring, private keys are stored in the clear.
+func WithKeyring(keyring *crypto.Keyring) ServiceOption {
+	return func(s *SignatureService) {
+		s.keyring = keyring
+	}
+}
+
+// WithPKCS11 makes the PKCS#11 token available to generate and use device keys.
+// Devices are only created in the token if they request KeyBackendPKCS11 or it is the default backend.
+func WithPKCS11(provider *crypto.PKCS11Provider) ServiceOption {
+	return func(s *SignatureService) {
+		s.pkcs11 = provider
+	}
+}
+
+// WithDefaultKeyBackend selects the backend of devices that do not request one, KeyBackendSoftware by default.
+func WithDefaultKeyBackend(backend string) ServiceOption {
+	return func(s *SignatureService) {
+		s.defaultKeyBackend = backend
+	}
+}
+
+// RewrapReport summarizes a run of RewrapPrivateKeys. Skipped lists the devices whose private key
+// was changed by someone else while it was re-wrapped.
+type RewrapReport struct {
+	Rewrapped int
+	Sealed    int
+	Unchanged int
+	Skipped   []string
+}
+
+// generateKeyPair generates the key pair of a new device in the backend selected by the request.
+// Keys in a PKCS#11 token are labelled with the device ID.
+func (s *SignatureService) generateKeyPair(algorithm *crypto.Algorithm, request CreateSignatureDeviceRequest, deviceID string) (*crypto.EncodedKeyPair, error) {
+	keyOptions := crypto.KeyOptions{
+		Curve:   request.Curve,
+		KeySize: request.KeySize,
+	}
+	signatureOptions := crypto.SignatureOptions{
+		Scheme:     request.SignatureScheme,
+		SaltLength: request.SaltLength,
+		Hash:       request.HashAlgorithm,
+	}
+
+	backend := request.KeyBackend
+	if backend == "" {
+		backend = s.defaultKeyBackend
+	}
+	switch backend {
+	case KeyBackendSoftware:
+		return algorithm.GenerateKeyPair(keyOptions, signatureOptions)
+	case KeyBackendPKCS11:
+		if s.pkcs11 == nil {
+			return nil, fmt.Errorf("%w: no PKCS#11 token is configured", crypto.ErrInvalidOptions)
+		}
+		return s.pkcs11.GenerateKeyPair(algorithm, keyOptions, signatureOptions, deviceID)
+	default:
+		return nil, fmt.Errorf("%w: unknown key backend %s, allowed are %s, %s",
+			crypto.ErrInvalidOptions, backend, KeyBackendSoftware, KeyBackendPKCS11)
+	}
+}
+
+// discardKeyPair destroys a key pair generated in the PKCS#11 token that is not going to be stored, so
+// that failed creations and rotations do not leave orphaned keys in the token. Keys generated in software
+// only live in memory. A failure is only logged, as the operation has failed already.
+func (s *SignatureService) discardKeyPair(keyPair *crypto.EncodedKeyPair) {
+	if keyPair == nil || keyPair.KeyHandle == "" || s.pkcs11 == nil {
+		return
+	}
+	err := s.pkcs11.DestroyKeyPair(keyPair.KeyHandle)
+	if err != nil {
+		zap.S().Warnw("Failed to destroy discarded key pair", "keyHandle", keyPair.KeyHandle, "error", err)
+	}
+}
+
+// deviceSigner creates the signer of a device. Keys in a PKCS#11 token sign in the token, sealed keys
+// are opened first. The device ID is the associated data of a sealed key, so a key cannot be moved to
+// another device.
+func (s *SignatureService) deviceSigner(device *InternalSignatureDevice) (crypto.Signer, error) {
+	algorithm, err := crypto.LookupAlgorithm(device.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if device.KeyHandle != "" {
+		if s.pkcs11 == nil {
+			return nil, fmt.Errorf("%w: device %s keeps its key in a PKCS#11 token", ErrKeyBackendUnavailable, device.ID)
+		}
+		return s.pkcs11.Signer(algorithm, device.KeyHandle, device.SignatureOptions())
+	}
+
+	privateKey := device.PrivateKey
+	if device.KeyEncryptionKeyID != "" {
+		if s.keyring == nil {
+			return nil, fmt.Errorf("%w: no keyring to open the private key of device %s", ErrPrivateKeySealed, device.ID)
+		}
+		privateKey, err = s.keyring.Open(device.PrivateKey, []byte(device.ID))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the private key of device %s: %w", device.ID, err)
+		}
+	}
+	return algorithm.Signer(privateKey, device.SignatureOptions())
+}
+
+// signWithDevice signs the data with the private key of the device.
+func (s *SignatureService) signWithDevice(device *InternalSignatureDevice, data []byte) ([]byte, error) {
+	signer, err := s.deviceSigner(device)
+	if err != nil {
+		return nil, err
+	}
+	return signer.Sign(data)
+}
+
+// RewrapPrivateKeys wraps the data keys of all private keys sealed with an older key-encryption key
+// with the primary one and seals the private keys still stored in the clear. The data keys and
+// encrypted private keys are kept, so the keys stay usable by instances that already know the primary
+// key-encryption key while this runs. Keys changed concurrently are skipped and listed in the report,
+// keys kept in a PKCS#11 token are left alone. It runs while the service keeps signing, devices are
+// not locked. It returns ErrNoKeyring without a keyring.
+func (s *SignatureService) RewrapPrivateKeys(ctx context.Context) (*RewrapReport, error) {
+	return s.rewrapPrivateKeys(ctx, true)
+}
+
+// SealPrivateKeys seals the private keys still stored in the clear with the primary key-encryption key,
+// such as those of devices created before a keyring was configured. Keys sealed with an older
+// key-encryption key are left for RewrapPrivateKeys and counted as unchanged. It returns ErrNoKeyring
+// without a keyring.
+func (s *SignatureService) SealPrivateKeys(ctx context.Context) (*RewrapReport, error) {
+	return s.rewrapPrivateKeys(ctx, false)
+}
+
+// rewrapPrivateKeys seals the private keys stored in the clear and, if rewrapSealed is set, re-wraps
+// those sealed with an older key-encryption key.
+func (s *SignatureService) rewrapPrivateKeys(ctx context.Context, rewrapSealed bool) (*RewrapReport, error) {
+	if s.keyring == nil {
+		return nil, ErrNoKeyring
+	}
+	devices, err := s.storage.GetAllSignatureDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RewrapReport{}
+	for _, device := range devices {
+		if device.KeyHandle != "" {
+			continue
+		}
+		if device.KeyEncryptionKeyID == s.keyring.PrimaryID() || (device.KeyEncryptionKeyID != "" && !rewrapSealed) {
+			report.Unchanged++
+			continue
+		}
+
+		var privateKey []byte
+		var keyEncryptionKeyID string
+		if device.KeyEncryptionKeyID == "" {
+			privateKey, keyEncryptionKeyID, err = s.keyring.Seal(device.PrivateKey, []byte(device.ID))
+		} else {
+			privateKey, keyEncryptionKeyID, err = s.keyring.Rewrap(device.PrivateKey)
+		}
+		if err != nil {
+			return report, fmt.Errorf("device %s: %w", device.ID, err)
+		}
+
+		err = s.storage.UpdatePrivateKey(ctx, device.ID, device.PrivateKey, privateKey, keyEncryptionKeyID)
+		if errors.Is(err, ErrConflict) {
+			report.Skipped = append(report.Skipped, device.ID)
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("device %s: %w", device.ID, err)
+		}
+		if device.KeyEncryptionKeyID == "" {
+			report.Sealed++
+		} else {
+			report.Rewrapped++
+		}
+	}
+	return report, nil
+}
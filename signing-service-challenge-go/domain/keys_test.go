@@ -0,0 +1,183 @@
+package domain_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto/pkcs11test"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+// newTestKeyring creates a keyring of the given keys, the first one is the primary key.
+// The key material is derived from the ID, so that a key has the same value in every keyring.
+func newTestKeyring(t *testing.T, ids ...string) *crypto.Keyring {
+	var keys []*crypto.KeyEncryptionKey
+	for _, id := range ids {
+		key, err := crypto.NewKeyEncryptionKey(id, bytes.Repeat([]byte(id[len(id)-1:]), crypto.KeyEncryptionKeySize))
+		assert.NoError(t, err)
+		keys = append(keys, key)
+	}
+	keyring, err := crypto.NewKeyring(keys[0], keys[1:]...)
+	assert.NoError(t, err)
+	return keyring
+}
+
+func TestSealedDeviceSigns(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-1")))
+
+	for _, algorithm := range []string{"ECC", "RSA", "ED25519"} {
+		device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: algorithm})
+		assert.NoError(t, err)
+
+		stored, err := storage.GetSignatureDevice(ctx, device.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+		assert.NotContains(t, string(stored.PrivateKey), "PRIVATE KEY")
+
+		_, err = service.Sign(ctx, device.ID, "first")
+		assert.NoError(t, err)
+		report, err := service.Audit(ctx, device.ID)
+		assert.NoError(t, err)
+		assert.True(t, report.Valid, algorithm)
+
+		// Without the keyring the sealed key cannot be used.
+		_, err = domain.NewSignatureService(storage).Sign(ctx, device.ID, "second")
+		assert.ErrorIs(t, err, domain.ErrPrivateKeySealed)
+	}
+}
+
+func TestRewrapPrivateKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+
+	plain, err := domain.NewSignatureService(storage).CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	sealed, err := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-1"))).
+		CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	// kek-2 becomes the primary key, kek-1 is kept until all keys are re-wrapped.
+	service := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-2", "kek-1")))
+	current, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	report, err := service.RewrapPrivateKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.RewrapReport{Rewrapped: 1, Sealed: 1, Unchanged: 1}, report)
+
+	rotated := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-2")))
+	for _, id := range []string{plain.ID, sealed.ID, current.ID} {
+		stored, err := storage.GetSignatureDevice(ctx, id)
+		assert.NoError(t, err)
+		assert.Equal(t, "kek-2", stored.KeyEncryptionKeyID)
+		assert.False(t, strings.Contains(string(stored.PrivateKey), "PRIVATE KEY"))
+
+		_, err = rotated.Sign(ctx, id, "after rotation")
+		assert.NoError(t, err)
+	}
+
+	report, err = service.RewrapPrivateKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.RewrapReport{Unchanged: 3}, report)
+}
+
+func TestSealPrivateKeys(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+
+	plain, err := domain.NewSignatureService(storage).CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	sealed, err := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-1"))).
+		CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	_, err = domain.NewSignatureService(storage).SealPrivateKeys(ctx)
+	assert.ErrorIs(t, err, domain.ErrNoKeyring)
+
+	service := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-2", "kek-1")))
+	report, err := service.SealPrivateKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.RewrapReport{Sealed: 1, Unchanged: 1}, report)
+
+	stored, err := storage.GetSignatureDevice(ctx, plain.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "kek-2", stored.KeyEncryptionKeyID)
+	assert.False(t, strings.Contains(string(stored.PrivateKey), "PRIVATE KEY"))
+	// Keys sealed with an older key-encryption key are left for RewrapPrivateKeys.
+	stored, err = storage.GetSignatureDevice(ctx, sealed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+}
+
+func TestPKCS11DeviceSigns(t *testing.T) {
+	ctx := context.Background()
+	provider, err := crypto.OpenPKCS11(pkcs11test.NewToken(t))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer provider.Close()
+
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage, domain.WithPKCS11(provider), domain.WithDefaultKeyBackend(domain.KeyBackendPKCS11),
+		domain.WithKeyring(newTestKeyring(t, "kek-1")))
+
+	for _, request := range []domain.CreateSignatureDeviceRequest{
+		{Algorithm: "ECC"},
+		{Algorithm: "RSA", SignatureScheme: crypto.RSASchemePSS},
+	} {
+		device, err := service.CreateDevice(ctx, request)
+		assert.NoError(t, err)
+		assert.Equal(t, domain.KeyBackendPKCS11, device.KeyBackend())
+
+		stored, err := storage.GetSignatureDevice(ctx, device.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, stored.PrivateKey)
+		assert.Empty(t, stored.KeyEncryptionKeyID)
+		assert.NotEmpty(t, stored.KeyHandle)
+
+		_, err = service.Sign(ctx, device.ID, "first")
+		assert.NoError(t, err)
+		_, err = service.Sign(ctx, device.ID, "second")
+		assert.NoError(t, err)
+		report, err := service.Audit(ctx, device.ID)
+		assert.NoError(t, err)
+		assert.True(t, report.Valid, request.Algorithm)
+
+		_, err = domain.NewSignatureService(storage).Sign(ctx, device.ID, "third")
+		assert.ErrorIs(t, err, domain.ErrKeyBackendUnavailable)
+	}
+
+	// Devices can still ask for a key in software.
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519", KeyBackend: domain.KeyBackendSoftware})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.KeyBackendSoftware, device.KeyBackend())
+	_, err = service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.ErrorIs(t, err, crypto.ErrUnsupportedAlgorithm)
+
+	// Keys in the token are not re-wrapped.
+	report, err := service.RewrapPrivateKeys(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.RewrapReport{Unchanged: 1}, report)
+}
+
+func TestCreateDeviceKeyBackend(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.KeyBackendSoftware, device.KeyBackend())
+
+	_, err = service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC", KeyBackend: domain.KeyBackendPKCS11})
+	assert.ErrorIs(t, err, crypto.ErrInvalidOptions)
+	assert.EqualError(t, err, "invalid options: no PKCS#11 token is configured")
+
+	_, err = service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC", KeyBackend: "tpm"})
+	assert.ErrorIs(t, err, crypto.ErrInvalidOptions)
+}
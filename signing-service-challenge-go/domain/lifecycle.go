@@ -0,0 +1,144 @@
+package domain
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Lifecycle states of a signature device. Only active devices sign transactions.
+// Suspended devices can be activated again, decommissioning is final.
+const (
+	DeviceStatusActive         = "active"
+	DeviceStatusSuspended      = "suspended"
+	DeviceStatusDecommissioned = "decommissioned"
+)
+
+// ClosingRecordData is the data signed by the closing record that completes the signature chain
+// of a decommissioned device.
+const ClosingRecordData = "DEVICE_DECOMMISSIONED"
+
+var (
+	// ErrDeviceNotActive is returned when a suspended or decommissioned device is asked to sign.
+	ErrDeviceNotActive = errors.New("device is not active")
+	// ErrInvalidStatusTransition is returned when the lifecycle state of a device cannot change to the requested one.
+	ErrInvalidStatusTransition = errors.New("invalid status transition")
+)
+
+// deviceStatusTransitions lists the states every state can change to.
+var deviceStatusTransitions = map[string][]string{
+	DeviceStatusActive:         {DeviceStatusSuspended, DeviceStatusDecommissioned},
+	DeviceStatusSuspended:      {DeviceStatusActive, DeviceStatusDecommissioned},
+	DeviceStatusDecommissioned: {},
+}
+
+// DeviceStatusChange is an entry of the history of a device, recording a change of its lifecycle state.
+// The sequence numbers the changes of a device starting at 1.
+type DeviceStatusChange struct {
+	DeviceID   string    `json:"device_id"`
+	Sequence   int       `json:"sequence"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DeviceStatusChangeRequest represents the optional request body of a lifecycle transition.
+type DeviceStatusChangeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// CurrentStatus returns the lifecycle state of the device. Devices stored before lifecycle states
+// were introduced have no status and are active.
+func (d *InternalSignatureDevice) CurrentStatus() string {
+	if d.Status == "" {
+		return DeviceStatusActive
+	}
+	return d.Status
+}
+
+// ChangeStatus records a change of the lifecycle state of the device, the sequence is set by the storage.
+func (d *InternalSignatureDevice) ChangeStatus(change *DeviceStatusChange) {
+	change.DeviceID = d.ID
+	change.FromStatus = d.CurrentStatus()
+	d.Status = change.ToStatus
+}
+
+// checkStatusTransition reports whether a device in the from state can change to the to state.
+func checkStatusTransition(from string, to string) error {
+	if _, ok := deviceStatusTransitions[to]; !ok {
+		return fmt.Errorf("%w: unknown device status %q", ErrInvalidStatusTransition, to)
+	}
+	for _, allowed := range deviceStatusTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: a %s device cannot become %s", ErrInvalidStatusTransition, from, to)
+}
+
+// ChangeDeviceStatus moves a device to another lifecycle state and records the change in its history.
+// Changing a device to its current state does nothing. Before a device is decommissioned, it signs
+// the closing record, which ends its signature chain, within the same unit of work, so that the closing
+// record and the status change are stored together or not at all. Afterwards the certificates of the
+// device are revoked.
+func (s *SignatureService) ChangeDeviceStatus(ctx context.Context, deviceID string, status string, reason string) (*InternalSignatureDevice, error) {
+	var device *InternalSignatureDevice
+	err := s.storage.WithDeviceTx(ctx, deviceID, func(tx DeviceTx) error {
+		device = tx.Device()
+		if device.CurrentStatus() == status {
+			return nil
+		}
+		err := checkStatusTransition(device.CurrentStatus(), status)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if status == DeviceStatusDecommissioned {
+			securedData := device.SecuredDataToBeSigned(ClosingRecordData)
+			signature, err := s.signWithDevice(device, []byte(securedData))
+			if err != nil {
+				return err
+			}
+			err = tx.InsertSignature(&SignatureRecord{
+				Kind:           SignatureKindClosing,
+				DataToBeSigned: ClosingRecordData,
+				SignedData:     securedData,
+				Signature:      base64.StdEncoding.EncodeToString(signature),
+				Algorithm:      device.Algorithm,
+				CreatedAt:      now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.ChangeStatus(&DeviceStatusChange{
+			ToStatus:  status,
+			Reason:    reason,
+			CreatedAt: now,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Also runs when the device has already been decommissioned, so that a retry completes the revocation.
+	if status == DeviceStatusDecommissioned && s.certificateAuthority != nil {
+		err = s.revokeCertificates(ctx, deviceID, RevocationReasonCessationOfOperation, func(*DeviceCertificate) bool {
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return device, nil
+}
+
+// GetDeviceHistory retrieves the lifecycle state changes of a device in the order they happened.
+func (s *SignatureService) GetDeviceHistory(ctx context.Context, deviceID string) ([]*DeviceStatusChange, error) {
+	return s.storage.ListDeviceHistory(ctx, deviceID)
+}
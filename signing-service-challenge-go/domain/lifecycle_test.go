@@ -0,0 +1,162 @@
+package domain_test
+
+import (
+	"context"
+	"errors"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+// testStorages returns a fresh instance of every storage backend.
+func testStorages(t *testing.T) map[string]domain.Storage {
+	file, err := persistence.OpenFileStorage(t.TempDir(), persistence.DefaultSnapshotInterval)
+	assert.NoError(t, err)
+	sqlite, err := persistence.OpenSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		file.Close()
+		sqlite.Close()
+	})
+	return map[string]domain.Storage{
+		"memory": persistence.NewSignatureDeviceStorage(),
+		"file":   file,
+		"sqlite": sqlite,
+	}
+}
+
+// failingTxStorage fails the status changes and key rotations of every unit of work, after the
+// signatures inserted before them have been accepted. It keeps the last refused key rotation.
+type failingTxStorage struct {
+	domain.Storage
+	err      error
+	rotation *domain.KeyRotation
+}
+
+func (s *failingTxStorage) WithDeviceTx(ctx context.Context, id string, fn func(tx domain.DeviceTx) error) error {
+	return s.Storage.WithDeviceTx(ctx, id, func(tx domain.DeviceTx) error {
+		return fn(&failingDeviceTx{DeviceTx: tx, storage: s})
+	})
+}
+
+type failingDeviceTx struct {
+	domain.DeviceTx
+	storage *failingTxStorage
+}
+
+func (tx *failingDeviceTx) ChangeStatus(change *domain.DeviceStatusChange) error {
+	return tx.storage.err
+}
+
+func (tx *failingDeviceTx) RotateKey(rotation *domain.KeyRotation) error {
+	tx.storage.rotation = rotation
+	return tx.storage.err
+}
+
+func TestDeviceLifecycle(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	assert.Equal(t, domain.DeviceStatusActive, device.CurrentStatus())
+	_, err = service.Sign(ctx, device.ID, "first")
+	assert.NoError(t, err)
+
+	device, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusSuspended, "maintenance")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.DeviceStatusSuspended, device.CurrentStatus())
+	_, err = service.Sign(ctx, device.ID, "rejected")
+	assert.ErrorIs(t, err, domain.ErrDeviceNotActive)
+	assert.EqualError(t, err, "device is not active: device "+device.ID+" is suspended")
+
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusActive, "")
+	assert.NoError(t, err)
+	_, err = service.Sign(ctx, device.ID, "second")
+	assert.NoError(t, err)
+
+	device, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusDecommissioned, "sold")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), device.SignatureCounter)
+
+	closing, err := service.GetSignature(ctx, device.ID, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, domain.SignatureKindClosing, closing.Kind)
+	assert.Equal(t, domain.ClosingRecordData, closing.DataToBeSigned)
+
+	// The closing record is part of the signature chain.
+	report, err := service.Audit(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 3, report.CheckedSignatures)
+
+	// Decommissioning is irreversible and only happens once.
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusActive, "")
+	assert.ErrorIs(t, err, domain.ErrInvalidStatusTransition)
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusSuspended, "")
+	assert.ErrorIs(t, err, domain.ErrInvalidStatusTransition)
+	device, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusDecommissioned, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), device.SignatureCounter)
+	_, err = service.Sign(ctx, device.ID, "rejected")
+	assert.ErrorIs(t, err, domain.ErrDeviceNotActive)
+
+	history, err := service.GetDeviceHistory(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+	for i, expected := range []struct{ from, to, reason string }{
+		{domain.DeviceStatusActive, domain.DeviceStatusSuspended, "maintenance"},
+		{domain.DeviceStatusSuspended, domain.DeviceStatusActive, ""},
+		{domain.DeviceStatusActive, domain.DeviceStatusDecommissioned, "sold"},
+	} {
+		assert.Equal(t, i+1, history[i].Sequence)
+		assert.Equal(t, expected.from, history[i].FromStatus)
+		assert.Equal(t, expected.to, history[i].ToStatus)
+		assert.Equal(t, expected.reason, history[i].Reason)
+	}
+}
+
+func TestChangeDeviceStatusRejectsUnknownStatus(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.NoError(t, err)
+
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, "deleted", "")
+	assert.ErrorIs(t, err, domain.ErrInvalidStatusTransition)
+	_, err = service.ChangeDeviceStatus(ctx, "unknown", domain.DeviceStatusSuspended, "")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestDecommissionStoresClosingRecordAndStatusTogether(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			service := domain.NewSignatureService(storage)
+			device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+			assert.NoError(t, err)
+
+			failure := errors.New("status change failed")
+			failing := domain.NewSignatureService(&failingTxStorage{Storage: storage, err: failure})
+			_, err = failing.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusDecommissioned, "")
+			assert.ErrorIs(t, err, failure)
+
+			// Without the status change the closing record is not stored either.
+			stored, err := service.GetDevice(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, domain.DeviceStatusActive, stored.CurrentStatus())
+			assert.Equal(t, int32(0), stored.SignatureCounter)
+			_, err = service.GetSignature(ctx, device.ID, 0)
+			assert.ErrorIs(t, err, domain.ErrNotFound)
+
+			_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusDecommissioned, "")
+			assert.NoError(t, err)
+			closing, err := service.GetSignature(ctx, device.ID, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, domain.SignatureKindClosing, closing.Kind)
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package domain
+
+import (
+	"bytes"
+	"context"
+	stdcrypto "crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyTransitionDataPrefix starts the data of a key transition record, it is followed by the base64 encoded
+// PKIX public key the device signs with from the next record on. Transactions must not use the prefix.
+const KeyTransitionDataPrefix = "KEY_TRANSITION_"
+
+// ErrReservedData is returned when the data of a transaction could be mistaken for a key transition.
+var ErrReservedData = errors.New("reserved data")
+
+// DeviceKey is a public key of a device with the range of signature counters it signed. The version
+// numbers the keys of a device starting at 1. The current key has no last counter.
+type DeviceKey struct {
+	DeviceID    string `json:"device_id"`
+	Version     int    `json:"version"`
+	PublicKey   []byte `json:"public_key"`
+	FromCounter int32  `json:"from_counter"`
+	// ToCounter is the counter of the key transition record, the last record signed with the key.
+	ToCounter *int32     `json:"to_counter,omitempty"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// Covers reports whether the key signed the record with the given counter.
+func (k *DeviceKey) Covers(counter int32) bool {
+	return counter >= k.FromCounter && (k.ToCounter == nil || counter <= *k.ToCounter)
+}
+
+// KeyID identifies the key among all keys of all devices as "<device ID>:<first counter>", for
+// instance as the kid of a JSON Web Key.
+func (k *DeviceKey) KeyID() string {
+	return k.DeviceID + ":" + strconv.FormatInt(int64(k.FromCounter), 10)
+}
+
+// KeyRotation replaces the key pair of a device within a unit of work, see DeviceTx.RotateKey.
+type KeyRotation struct {
+	PublicKey          []byte    `json:"publicKey"`
+	PrivateKey         []byte    `json:"privateKey"`
+	KeyEncryptionKeyID string    `json:"keyEncryptionKeyId,omitempty"`
+	KeyHandle          string    `json:"keyHandle,omitempty"`
+	CreatedAt          time.Time `json:"createdAt"`
+	// Retired is the replaced public key, its version and first counter are set by the storage.
+	Retired *DeviceKey `json:"retired"`
+}
+
+// KeyRotationResponse is the result of rotating the key of a device: the device, its new key and
+// the key transition record signed with the previous key.
+type KeyRotationResponse struct {
+	Device        *SignatureDeviceResponse `json:"device"`
+	Key           *DeviceKeyResponse       `json:"key"`
+	KeyTransition *SignatureRecord         `json:"key_transition"`
+}
+
+// DeviceKeyResponse is a key of a device with its public key as a standard "PUBLIC KEY" PEM block.
+type DeviceKeyResponse struct {
+	Version     int        `json:"version"`
+	PublicKey   string     `json:"public_key"`
+	FromCounter int32      `json:"from_counter"`
+	ToCounter   *int32     `json:"to_counter,omitempty"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+}
+
+// RotateKey replaces the key pair of the device by the one of the rotation and retires the previous
+// public key after the last signature of the device, which has to be the key transition record.
+func (d *InternalSignatureDevice) RotateKey(rotation *KeyRotation) {
+	lastCounter := d.SignatureCounter - 1
+	retiredAt := rotation.CreatedAt
+	rotation.Retired = &DeviceKey{
+		DeviceID:  d.ID,
+		PublicKey: d.PublicKey,
+		ToCounter: &lastCounter,
+		RetiredAt: &retiredAt,
+	}
+	d.PublicKey = rotation.PublicKey
+	d.PrivateKey = rotation.PrivateKey
+	d.KeyEncryptionKeyID = rotation.KeyEncryptionKeyID
+	d.KeyHandle = rotation.KeyHandle
+}
+
+// KeyResponse converts a key of the device into its representation with a standard PEM encoded public key.
+func (d *InternalSignatureDevice) KeyResponse(key *DeviceKey) (*DeviceKeyResponse, error) {
+	publicKey, err := d.DecodeKey(key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := crypto.PublicKeyToPEM(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceKeyResponse{
+		Version:     key.Version,
+		PublicKey:   string(publicKeyPEM),
+		FromCounter: key.FromCounter,
+		ToCounter:   key.ToCounter,
+		RetiredAt:   key.RetiredAt,
+	}, nil
+}
+
+// KeyTransitionData encodes the data of the key transition record introducing the public key.
+func KeyTransitionData(publicKey stdcrypto.PublicKey) (string, error) {
+	der, err := crypto.PublicKeyToDER(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return KeyTransitionDataPrefix + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ParseKeyTransitionData decodes the public key introduced by a key transition record.
+func ParseKeyTransitionData(data string) (stdcrypto.PublicKey, error) {
+	encoded, ok := strings.CutPrefix(data, KeyTransitionDataPrefix)
+	if !ok {
+		return nil, errors.New("data is not a key transition")
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKIXPublicKey(der)
+}
+
+// RotateKey generates a new key pair for a device with the algorithm, options and key backend of its
+// current key. Within one unit of work the current key signs the key transition record, which carries
+// the new public key and becomes the last record of the retired key, and the key pair is replaced.
+// It returns the rotated device, its new key and the key transition record. Decommissioned devices
+// return ErrDeviceNotActive. The key transition record and the new key are stored together or not at
+// all, a key pair generated in a PKCS#11 token is destroyed if the rotation fails. With a certificate
+// authority, the new key is certified and the certificate of the previous key revoked as superseded.
+func (s *SignatureService) RotateKey(ctx context.Context, deviceID string) (*InternalSignatureDevice, *DeviceKey, *SignatureRecord, error) {
+	var device *InternalSignatureDevice
+	var rotation *KeyRotation
+	var record *SignatureRecord
+	var keyPair *crypto.EncodedKeyPair
+	err := s.storage.WithDeviceTx(ctx, deviceID, func(tx DeviceTx) error {
+		device = tx.Device()
+		if device.CurrentStatus() == DeviceStatusDecommissioned {
+			return fmt.Errorf("%w: device %s is %s", ErrDeviceNotActive, device.ID, device.CurrentStatus())
+		}
+
+		algorithm, err := crypto.LookupAlgorithm(device.Algorithm)
+		if err != nil {
+			return err
+		}
+		keyPair, err = s.generateKeyPair(algorithm, CreateSignatureDeviceRequest{
+			Algorithm:       device.Algorithm,
+			Curve:           device.Curve,
+			KeySize:         device.KeySize,
+			SignatureScheme: device.SignatureScheme,
+			SaltLength:      device.SaltLength,
+			HashAlgorithm:   device.HashAlgorithm,
+			KeyBackend:      device.KeyBackend(),
+		}, device.ID)
+		if err != nil {
+			return err
+		}
+		rotation = &KeyRotation{
+			PublicKey:  keyPair.PublicKey,
+			PrivateKey: keyPair.PrivateKey,
+			KeyHandle:  keyPair.KeyHandle,
+			CreatedAt:  time.Now().UTC(),
+		}
+		if s.keyring != nil && rotation.KeyHandle == "" {
+			rotation.PrivateKey, rotation.KeyEncryptionKeyID, err = s.keyring.Seal(rotation.PrivateKey, []byte(device.ID))
+			if err != nil {
+				return err
+			}
+		}
+
+		publicKey, err := device.DecodeKey(keyPair.PublicKey)
+		if err != nil {
+			return err
+		}
+		data, err := KeyTransitionData(publicKey)
+		if err != nil {
+			return err
+		}
+		securedData := device.SecuredDataToBeSigned(data)
+		signature, err := s.signWithDevice(device, []byte(securedData))
+		if err != nil {
+			return err
+		}
+		record = &SignatureRecord{
+			Kind:           SignatureKindKeyTransition,
+			DataToBeSigned: data,
+			SignedData:     securedData,
+			Signature:      base64.StdEncoding.EncodeToString(signature),
+			Algorithm:      device.Algorithm,
+			CreatedAt:      rotation.CreatedAt,
+		}
+		err = tx.InsertSignature(record)
+		if err != nil {
+			return err
+		}
+		return tx.RotateKey(rotation)
+	})
+	if err != nil {
+		s.discardKeyPair(keyPair)
+		return nil, nil, nil, err
+	}
+	key := &DeviceKey{
+		DeviceID:    device.ID,
+		Version:     rotation.Retired.Version + 1,
+		PublicKey:   device.PublicKey,
+		FromCounter: *rotation.Retired.ToCounter + 1,
+	}
+	s.certifyKey(ctx, device, key.Version)
+	return device, key, record, nil
+}
+
+// ListDeviceKeys retrieves the keys of a device ordered by their version, the current key is the last one.
+func (s *SignatureService) ListDeviceKeys(ctx context.Context, deviceID string) ([]*DeviceKey, error) {
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.deviceKeys(ctx, device)
+}
+
+// deviceKeys completes the retired keys of the device with its current key. Keys retired after the
+// device was loaded are left out, so the keys match the loaded state.
+func (s *SignatureService) deviceKeys(ctx context.Context, device *InternalSignatureDevice) ([]*DeviceKey, error) {
+	retired, err := s.storage.ListDeviceKeys(ctx, device.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*DeviceKey, 0, len(retired)+1)
+	for _, key := range retired {
+		if *key.ToCounter >= device.SignatureCounter {
+			break
+		}
+		keys = append(keys, key)
+	}
+	current := &DeviceKey{
+		DeviceID:  device.ID,
+		Version:   len(keys) + 1,
+		PublicKey: device.PublicKey,
+	}
+	if len(keys) > 0 {
+		current.FromCounter = *keys[len(keys)-1].ToCounter + 1
+	}
+	return append(keys, current), nil
+}
+
+// keyAt returns the key of the device that signed the record with the given counter. Counters the
+// device has not signed yet belong to the current key.
+func keyAt(keys []*DeviceKey, counter int32) *DeviceKey {
+	for _, key := range keys {
+		if key.Covers(counter) {
+			return key
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+// signedDataCounter reads the signature counter at the start of signed data.
+func signedDataCounter(signedData string) (int32, bool) {
+	prefix, _, found := strings.Cut(signedData, "_")
+	if !found {
+		return 0, false
+	}
+	counter, err := strconv.ParseInt(prefix, 10, 32)
+	if err != nil || counter < 0 {
+		return 0, false
+	}
+	return int32(counter), true
+}
+
+// keyVerifier creates a verifier for the device's signatures made with the public key.
+func keyVerifier(device *InternalSignatureDevice, publicKey stdcrypto.PublicKey) (crypto.Verifier, error) {
+	algorithm, err := crypto.LookupAlgorithm(device.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	return algorithm.NewVerifier(publicKey, device.SignatureOptions())
+}
+
+// samePublicKey reports whether both public keys are equal.
+func samePublicKey(a stdcrypto.PublicKey, b stdcrypto.PublicKey) bool {
+	aDER, err := crypto.PublicKeyToDER(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := crypto.PublicKeyToDER(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDER, bDER)
+}
@@ -0,0 +1,300 @@
+package domain_test
+
+import (
+	"context"
+	stdcrypto "crypto"
+	"encoding/base64"
+	"errors"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto/pkcs11test"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRotateKey(t *testing.T) {
+	for _, algorithm := range []string{"ECC", "RSA", "ED25519"} {
+		t.Run(algorithm, func(t *testing.T) {
+			ctx := context.Background()
+			service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+			device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: algorithm})
+			assert.NoError(t, err)
+			before, err := service.Sign(ctx, device.ID, "before")
+			assert.NoError(t, err)
+
+			rotated, key, transition, err := service.RotateKey(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.NotEqual(t, device.PublicKey, rotated.PublicKey)
+			assert.Equal(t, int32(2), rotated.SignatureCounter)
+			assert.Equal(t, 2, key.Version)
+			assert.Equal(t, int32(2), key.FromCounter)
+			assert.Equal(t, rotated.PublicKey, key.PublicKey)
+
+			// The previous key signs the new public key.
+			assert.Equal(t, domain.SignatureKindKeyTransition, transition.Kind)
+			assert.Equal(t, int32(1), transition.Counter)
+			introduced, err := domain.ParseKeyTransitionData(transition.DataToBeSigned)
+			assert.NoError(t, err)
+			publicKey, err := rotated.DecodePublicKey()
+			assert.NoError(t, err)
+			assert.Equal(t, publicKey, introduced)
+			signature, err := base64.StdEncoding.DecodeString(transition.Signature)
+			assert.NoError(t, err)
+			valid, err := device.Verify([]byte(transition.SignedData), signature)
+			assert.NoError(t, err)
+			assert.True(t, valid)
+
+			after, err := service.Sign(ctx, device.ID, "after")
+			assert.NoError(t, err)
+
+			keys, err := service.ListDeviceKeys(ctx, device.ID)
+			assert.NoError(t, err)
+			if assert.Len(t, keys, 2) {
+				assert.Equal(t, 1, keys[0].Version)
+				assert.Equal(t, device.PublicKey, keys[0].PublicKey)
+				assert.Equal(t, int32(0), keys[0].FromCounter)
+				assert.Equal(t, int32(1), *keys[0].ToCounter)
+				assert.NotNil(t, keys[0].RetiredAt)
+				assert.Equal(t, 2, keys[1].Version)
+				assert.Equal(t, int32(2), keys[1].FromCounter)
+				assert.Nil(t, keys[1].ToCounter)
+			}
+
+			// Verification picks the key that was active at the counter of the signed data.
+			for _, record := range []*domain.SignatureRecord{before, transition, after} {
+				signature, err := base64.StdEncoding.DecodeString(record.Signature)
+				assert.NoError(t, err)
+				valid, err := service.VerifySignature(ctx, device.ID, record.SignedData, signature)
+				assert.NoError(t, err)
+				assert.True(t, valid, record.Counter)
+			}
+			signature, err = base64.StdEncoding.DecodeString(before.Signature)
+			assert.NoError(t, err)
+			valid, err = service.VerifySignature(ctx, device.ID, "2"+before.SignedData[1:], signature)
+			assert.NoError(t, err)
+			assert.False(t, valid)
+
+			report, err := service.Audit(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.True(t, report.Valid, report.FirstBrokenLink)
+			assert.Equal(t, 3, report.CheckedSignatures)
+		})
+	}
+}
+
+func TestRotateKeySealsNewKey(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage, domain.WithKeyring(newTestKeyring(t, "kek-1")))
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	_, _, _, err = service.RotateKey(ctx, device.ID)
+	assert.NoError(t, err)
+
+	stored, err := storage.GetSignatureDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+	assert.NotEqual(t, device.PrivateKey, stored.PrivateKey)
+	_, err = service.Sign(ctx, device.ID, "after")
+	assert.NoError(t, err)
+}
+
+func TestRotateKeyOfSuspendedAndDecommissionedDevices(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusSuspended, "")
+	assert.NoError(t, err)
+	_, _, _, err = service.RotateKey(ctx, device.ID)
+	assert.NoError(t, err)
+
+	_, err = service.ChangeDeviceStatus(ctx, device.ID, domain.DeviceStatusDecommissioned, "")
+	assert.NoError(t, err)
+	_, _, _, err = service.RotateKey(ctx, device.ID)
+	assert.ErrorIs(t, err, domain.ErrDeviceNotActive)
+
+	report, err := service.Audit(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid, report.FirstBrokenLink)
+
+	_, _, _, err = service.RotateKey(ctx, "unknown")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestRotateKeyStoresTransitionAndKeyTogether(t *testing.T) {
+	for name, storage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			service := domain.NewSignatureService(storage)
+			device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+			assert.NoError(t, err)
+
+			failure := errors.New("rotation failed")
+			failing := domain.NewSignatureService(&failingTxStorage{Storage: storage, err: failure})
+			_, _, _, err = failing.RotateKey(ctx, device.ID)
+			assert.ErrorIs(t, err, failure)
+
+			// Without the new key the key transition record is not stored either.
+			stored, err := service.GetDevice(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, int32(0), stored.SignatureCounter)
+			assert.Equal(t, device.PublicKey, stored.PublicKey)
+			keys, err := service.ListDeviceKeys(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.Len(t, keys, 1)
+		})
+	}
+}
+
+func TestRotateKeyOfPKCS11Device(t *testing.T) {
+	ctx := context.Background()
+	provider, err := crypto.OpenPKCS11(pkcs11test.NewToken(t))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer provider.Close()
+
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage, domain.WithPKCS11(provider), domain.WithDefaultKeyBackend(domain.KeyBackendPKCS11))
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	_, err = service.Sign(ctx, device.ID, "before")
+	assert.NoError(t, err)
+
+	rotated, _, _, err := service.RotateKey(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, device.PublicKey, rotated.PublicKey)
+
+	stored, err := storage.GetSignatureDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, stored.PrivateKey)
+	assert.NotEqual(t, device.KeyHandle, stored.KeyHandle)
+
+	_, err = service.Sign(ctx, device.ID, "after")
+	assert.NoError(t, err)
+	report, err := service.Audit(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+}
+
+func TestRotateKeyDestroysDiscardedPKCS11Key(t *testing.T) {
+	ctx := context.Background()
+	provider, err := crypto.OpenPKCS11(pkcs11test.NewToken(t))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer provider.Close()
+
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage, domain.WithPKCS11(provider), domain.WithDefaultKeyBackend(domain.KeyBackendPKCS11))
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	failing := &failingTxStorage{Storage: storage, err: errors.New("rotation failed")}
+	_, _, _, err = domain.NewSignatureService(failing, domain.WithPKCS11(provider)).RotateKey(ctx, device.ID)
+	assert.Error(t, err)
+
+	// The key generated for the rotation is gone, the current key still signs.
+	if assert.NotNil(t, failing.rotation) {
+		assert.ErrorIs(t, provider.DestroyKeyPair(failing.rotation.KeyHandle), crypto.ErrPKCS11KeyNotFound)
+	}
+	_, err = service.Sign(ctx, device.ID, "data")
+	assert.NoError(t, err)
+}
+
+func TestSignRejectsKeyTransitionData(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	_, err = service.Sign(ctx, device.ID, domain.KeyTransitionDataPrefix+"forged")
+	assert.ErrorIs(t, err, domain.ErrReservedData)
+}
+
+func TestAuditDetectsForgedKeyTransition(t *testing.T) {
+	ctx := context.Background()
+	storage := persistence.NewSignatureDeviceStorage()
+	service := domain.NewSignatureService(storage)
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+	_, _, _, err = service.RotateKey(ctx, device.ID)
+	assert.NoError(t, err)
+	_, err = service.Sign(ctx, device.ID, "after")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		tamper func(record *domain.SignatureRecord)
+		reason string
+	}{
+		{
+			name: "transition not followed",
+			tamper: func(record *domain.SignatureRecord) {
+				record.Kind = ""
+			},
+			reason: domain.ViolationInvalidSignature,
+		},
+		{
+			name: "forged transition signature",
+			tamper: func(record *domain.SignatureRecord) {
+				record.Signature = base64.StdEncoding.EncodeToString([]byte("forged"))
+			},
+			reason: domain.ViolationInvalidSignature,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tampered := domain.NewSignatureService(&tamperingStorage{Storage: storage, tamper: func(records []*domain.SignatureRecord) []*domain.SignatureRecord {
+				test.tamper(records[0])
+				return records
+			}})
+			report, err := tampered.Audit(ctx, device.ID)
+			assert.NoError(t, err)
+			assert.False(t, report.Valid)
+			if assert.NotNil(t, report.FirstBrokenLink) {
+				assert.Equal(t, test.reason, report.FirstBrokenLink.Reason)
+			}
+		})
+	}
+}
+
+func TestChainVerifierRejectsInvalidKeyTransition(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC"})
+	assert.NoError(t, err)
+
+	data := domain.KeyTransitionDataPrefix + "invalid"
+	securedData := device.SecuredDataToBeSigned(data)
+	algorithm, err := crypto.LookupAlgorithm(device.Algorithm)
+	assert.NoError(t, err)
+	signer, err := algorithm.Signer(device.PrivateKey, device.SignatureOptions())
+	assert.NoError(t, err)
+	signature, err := signer.Sign([]byte(securedData))
+	assert.NoError(t, err)
+
+	verifier, err := device.Verifier()
+	assert.NoError(t, err)
+	chain := domain.NewChainVerifier(device.ID, verifier)
+	chain.FollowKeyTransitions(func(publicKey stdcrypto.PublicKey) (crypto.Verifier, error) {
+		t.Fatal("no verifier is created for an invalid key")
+		return nil, nil
+	})
+	violation := chain.Verify(&domain.SignatureRecord{
+		DeviceID:       device.ID,
+		Kind:           domain.SignatureKindKeyTransition,
+		DataToBeSigned: data,
+		SignedData:     securedData,
+		Signature:      base64.StdEncoding.EncodeToString(signature),
+	})
+	if assert.NotNil(t, violation) {
+		assert.Equal(t, domain.ViolationInvalidKeyTransition, violation.Reason)
+	}
+	assert.Nil(t, chain.PublicKey())
+}
@@ -0,0 +1,283 @@
+package domain
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of the signature listing.
+const (
+	DefaultSignaturePageSize = 50
+	MaxSignaturePageSize     = 500
+)
+
+// ErrInvalidQuery is returned for malformed listing parameters, such as an invalid cursor.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// SignatureService implements the business rules of signature devices on top of the injected Storage,
+// which is the single source of truth for the devices.
+type SignatureService struct {
+	storage                 Storage
+	keyring                 *crypto.Keyring
+	pkcs11                  *crypto.PKCS11Provider
+	defaultKeyBackend       string
+	idempotencyKeyRetention time.Duration
+	idempotencyKeyLocks     idempotencyKeyLocks
+	certificateAuthority    *crypto.CertificateAuthority
+}
+
+// ServiceOption configures optional behavior of a SignatureService.
+type ServiceOption func(s *SignatureService)
+
+// NewSignatureService creates a new SignatureService working on the given storage.
+func NewSignatureService(storage Storage, options ...ServiceOption) *SignatureService {
+	s := &SignatureService{
+		storage:                 storage,
+		idempotencyKeyRetention: DefaultIdempotencyKeyRetention,
+		defaultKeyBackend:       KeyBackendSoftware,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// CreateDevice generates the key pair of a new signature device and stores it. With a certificate
+// authority, a certificate is issued for the public key.
+// It returns crypto.ErrUnsupportedAlgorithm or crypto.ErrInvalidOptions for invalid requests.
+func (s *SignatureService) CreateDevice(ctx context.Context, request CreateSignatureDeviceRequest) (*InternalSignatureDevice, error) {
+	algorithm, err := crypto.LookupAlgorithm(request.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uuid.New().String()
+	keyPair, err := s.generateKeyPair(algorithm, request, id)
+	if err != nil {
+		return nil, err
+	}
+
+	device := &InternalSignatureDevice{
+		ID:               id,
+		Algorithm:        algorithm.Name,
+		Label:            request.Label,
+		Curve:            keyPair.KeyOptions.Curve,
+		KeySize:          keyPair.KeyOptions.KeySize,
+		SignatureScheme:  keyPair.SignatureOptions.Scheme,
+		SaltLength:       keyPair.SignatureOptions.SaltLength,
+		HashAlgorithm:    keyPair.SignatureOptions.Hash,
+		Status:           DeviceStatusActive,
+		SignatureCounter: 0,
+		PublicKey:        keyPair.PublicKey,
+		PrivateKey:       keyPair.PrivateKey,
+		KeyHandle:        keyPair.KeyHandle,
+	}
+
+	if s.keyring != nil && device.KeyHandle == "" {
+		device.PrivateKey, device.KeyEncryptionKeyID, err = s.keyring.Seal(device.PrivateKey, []byte(device.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.storage.CreateSignatureDevice(ctx, device)
+	if err != nil {
+		s.discardKeyPair(keyPair)
+		return nil, err
+	}
+	s.certifyKey(ctx, device, 1)
+	return device, nil
+}
+
+// Sign extends the data with the device's counter and last signature, signs it and advances the counter.
+// It returns ErrDeviceNotActive if the device is suspended or decommissioned.
+// Reading the counter, signing and storing the signature happen in one unit of work,
+// so the counter is only incremented once the signature has been created successfully.
+func (s *SignatureService) Sign(ctx context.Context, deviceID string, data string) (*SignatureRecord, error) {
+	record, _, err := s.SignIdempotently(ctx, deviceID, data, "")
+	return record, err
+}
+
+// SignIdempotently signs like Sign, but stores the idempotency key with the signature record. If the key
+// has already been used within the retention window for the same device and data, the stored record is
+// returned without signing again and replayed is true. A key used for another request gives ErrIdempotencyKeyReused.
+// An empty key signs every time. Data starting with KeyTransitionDataPrefix gives ErrReservedData.
+// Requests with the same key are serialized within the service, so concurrent requests for different
+// devices cannot both sign with it. Services sharing a SQLite database only check the key per device.
+func (s *SignatureService) SignIdempotently(ctx context.Context, deviceID string, data string, idempotencyKey string) (record *SignatureRecord, replayed bool, err error) {
+	if strings.HasPrefix(data, KeyTransitionDataPrefix) {
+		return nil, false, fmt.Errorf("%w: data must not start with %s", ErrReservedData, KeyTransitionDataPrefix)
+	}
+
+	since := time.Now().UTC().Add(-s.idempotencyKeyRetention)
+	if idempotencyKey != "" {
+		defer s.idempotencyKeyLocks.lock(idempotencyKey)()
+
+		if err := s.storage.PruneIdempotencyKeys(ctx, since); err != nil {
+			return nil, false, err
+		}
+		// Finds keys used for other devices. The key stays locked until the signature is stored.
+		record, err = s.storage.FindSignatureByIdempotencyKey(ctx, "", idempotencyKey, since)
+		if err == nil {
+			return matchIdempotentRequest(record, deviceID, data)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, false, err
+		}
+	}
+
+	err = s.storage.WithDeviceTx(ctx, deviceID, func(tx DeviceTx) error {
+		device := tx.Device()
+		if idempotencyKey != "" {
+			// Another service sharing the storage may have signed with the key in the meantime.
+			existing, err := tx.FindSignatureByIdempotencyKey(idempotencyKey, since)
+			if err == nil {
+				record, replayed, err = matchIdempotentRequest(existing, deviceID, data)
+				return err
+			}
+			if !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+
+		if device.CurrentStatus() != DeviceStatusActive {
+			return fmt.Errorf("%w: device %s is %s", ErrDeviceNotActive, device.ID, device.CurrentStatus())
+		}
+		securedData := device.SecuredDataToBeSigned(data)
+		signature, err := s.signWithDevice(device, []byte(securedData))
+		if err != nil {
+			return err
+		}
+
+		record = &SignatureRecord{
+			DataToBeSigned: data,
+			SignedData:     securedData,
+			Signature:      base64.StdEncoding.EncodeToString(signature),
+			Algorithm:      device.Algorithm,
+			IdempotencyKey: idempotencyKey,
+			CreatedAt:      time.Now().UTC(),
+		}
+		return tx.InsertSignature(record)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return record, replayed, nil
+}
+
+// VerifySignature checks a signature of the signed data against the public key the device signed with
+// when its counter had the value at the start of the signed data. Signed data without a counter is
+// checked against the current public key.
+func (s *SignatureService) VerifySignature(ctx context.Context, deviceID string, signedData string, signature []byte) (bool, error) {
+	device, err := s.storage.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return false, err
+	}
+	counter, ok := signedDataCounter(signedData)
+	if !ok {
+		return device.Verify([]byte(signedData), signature)
+	}
+
+	keys, err := s.deviceKeys(ctx, device)
+	if err != nil {
+		return false, err
+	}
+	publicKey, err := device.DecodeKey(keyAt(keys, counter).PublicKey)
+	if err != nil {
+		return false, err
+	}
+	verifier, err := keyVerifier(device, publicKey)
+	if err != nil {
+		return false, err
+	}
+	return verifier.Verify([]byte(signedData), signature)
+}
+
+// GetDevice retrieves a signature device by ID.
+func (s *SignatureService) GetDevice(ctx context.Context, id string) (*InternalSignatureDevice, error) {
+	return s.storage.GetSignatureDevice(ctx, id)
+}
+
+// ListDevices retrieves all signature devices.
+func (s *SignatureService) ListDevices(ctx context.Context) ([]*InternalSignatureDevice, error) {
+	return s.storage.GetAllSignatureDevices(ctx)
+}
+
+// UpdateDeviceLabel changes the label of a signature device and returns the updated device.
+func (s *SignatureService) UpdateDeviceLabel(ctx context.Context, id string, label *string) (*InternalSignatureDevice, error) {
+	var device *InternalSignatureDevice
+	err := s.storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+		device = tx.Device()
+		return tx.UpdateLabel(label)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// ListSignatures retrieves a page of the signatures of a device that match the filter, continuing
+// after the cursor of the previous page if one is given. A zero limit selects DefaultSignaturePageSize.
+func (s *SignatureService) ListSignatures(ctx context.Context, deviceID string, filter SignatureFilter, cursor string) (*SignaturePage, error) {
+	if filter.Limit == 0 {
+		filter.Limit = DefaultSignaturePageSize
+	}
+	if filter.Limit < 0 || filter.Limit > MaxSignaturePageSize {
+		return nil, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidQuery, MaxSignaturePageSize)
+	}
+
+	if cursor != "" {
+		after, err := decodeSignatureCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		if filter.FromCounter == nil || *filter.FromCounter <= after {
+			from := after + 1
+			filter.FromCounter = &from
+		}
+	}
+
+	// Fetching one more signature than requested tells whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	records, err := s.storage.ListSignatures(ctx, deviceID, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &SignaturePage{Signatures: records}
+	if len(records) > limit {
+		page.Signatures = records[:limit]
+		page.NextCursor = encodeSignatureCursor(records[limit-1].Counter)
+	}
+	return page, nil
+}
+
+// encodeSignatureCursor creates the opaque cursor continuing a listing after the given counter.
+func encodeSignatureCursor(counter int32) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(int64(counter), 10)))
+}
+
+func decodeSignatureCursor(cursor string) (int32, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+	counter, err := strconv.ParseInt(string(decoded), 10, 32)
+	if err != nil || counter < 0 {
+		return 0, fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+	return int32(counter), nil
+}
+
+// GetSignature retrieves the signature a device created with the given counter value.
+func (s *SignatureService) GetSignature(ctx context.Context, deviceID string, counter int32) (*SignatureRecord, error) {
+	return s.storage.GetSignature(ctx, deviceID, counter)
+}
@@ -0,0 +1,114 @@
+package domain_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSignatureServiceCreateAndListDevices(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	label := "Till 1"
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ECC", Label: &label})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), device.SignatureCounter)
+
+	stored, err := service.GetDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, device, stored)
+
+	devices, err := service.ListDevices(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, devices, 1)
+
+	_, err = service.GetDevice(ctx, "unknown")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+func TestSignatureServiceCreateDeviceRejectsInvalidRequests(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	_, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "DSA"})
+	assert.ErrorIs(t, err, crypto.ErrUnsupportedAlgorithm)
+
+	_, err = service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "RSA", KeySize: 1024})
+	assert.ErrorIs(t, err, crypto.ErrInvalidOptions)
+
+	devices, err := service.ListDevices(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, devices)
+}
+
+func TestSignatureServiceSignChainsAndVerifies(t *testing.T) {
+	ctx := context.Background()
+	service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+	device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "ED25519"})
+	assert.NoError(t, err)
+
+	first, err := service.Sign(ctx, device.ID, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "0_a_"+base64.StdEncoding.EncodeToString([]byte(device.ID)), first.SignedData)
+
+	second, err := service.Sign(ctx, device.ID, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "1_b_"+first.Signature, second.SignedData)
+
+	stored, err := service.GetDevice(ctx, device.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), stored.SignatureCounter)
+	assert.Equal(t, second.Signature, stored.LastSignature)
+
+	signature, err := base64.StdEncoding.DecodeString(second.Signature)
+	assert.NoError(t, err)
+	valid, err := service.VerifySignature(ctx, device.ID, second.SignedData, signature)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	valid, err = service.VerifySignature(ctx, device.ID, first.SignedData, signature)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	_, err = service.Sign(ctx, "unknown", "c")
+	assert.ErrorIs(t, err, domain.ErrNotFound)
+}
+
+// BenchmarkSign signs in parallel on a growing number of devices. Signatures on the same device are
+// serialized, so the throughput grows with the device count up to the number of CPUs.
+// Run it with e.g. -cpu 1,4,8 to compare.
+func BenchmarkSign(b *testing.B) {
+	ctx := context.Background()
+	for _, deviceCount := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("devices=%d", deviceCount), func(b *testing.B) {
+			service := domain.NewSignatureService(persistence.NewSignatureDeviceStorage())
+
+			ids := make([]string, deviceCount)
+			for i := range ids {
+				device, err := service.CreateDevice(ctx, domain.CreateSignatureDeviceRequest{Algorithm: "RSA"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				ids[i] = device.ID
+			}
+
+			var next uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					id := ids[atomic.AddUint64(&next, 1)%uint64(deviceCount)]
+					if _, err := service.Sign(ctx, id, "benchmark"); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
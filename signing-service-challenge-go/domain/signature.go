@@ -0,0 +1,60 @@
+package domain
+
+import "time"
+
+// Kinds of signature records. Transactions have no kind.
+const (
+	// SignatureKindClosing marks the last record of a decommissioned device.
+	SignatureKindClosing = "closing"
+	// SignatureKindKeyTransition marks the record in which the previous key of a device signs its new public key.
+	SignatureKindKeyTransition = "key_transition"
+)
+
+// SignatureRecord is a signature created by a device, identified by the counter value it was created with.
+type SignatureRecord struct {
+	DeviceID       string    `json:"device_id"`
+	Counter        int32     `json:"counter"`
+	Kind           string    `json:"kind,omitempty"`
+	DataToBeSigned string    `json:"data_to_be_signed"`
+	SignedData     string    `json:"signed_data"`
+	Signature      string    `json:"signature"`
+	Algorithm      string    `json:"algorithm"`
+	IdempotencyKey string    `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SignatureFilter restricts the signatures listed for a device, zero values do not restrict anything.
+type SignatureFilter struct {
+	// FromCounter and ToCounter are the inclusive bounds of the signature counter.
+	FromCounter *int32
+	ToCounter   *int32
+	// Since is the inclusive and Until the exclusive bound of the creation time.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of signatures returned.
+	Limit int
+}
+
+// Matches reports whether the record passes the counter and time bounds of the filter.
+func (f SignatureFilter) Matches(record *SignatureRecord) bool {
+	if f.FromCounter != nil && record.Counter < *f.FromCounter {
+		return false
+	}
+	if f.ToCounter != nil && record.Counter > *f.ToCounter {
+		return false
+	}
+	if !f.Since.IsZero() && record.CreatedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.CreatedAt.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// SignaturePage is a page of the signatures of a device ordered by their counter.
+// NextCursor continues the listing after the last signature of the page, it is empty on the last page.
+type SignaturePage struct {
+	Signatures []*SignatureRecord `json:"signatures"`
+	NextCursor string             `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,75 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Errors returned by every Storage implementation, wrapped with details.
+var (
+	// ErrNotFound is returned when the requested device or signature does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write collides with the stored state, such as creating
+	// an existing device or storing a signature for a counter value that has already been used.
+	ErrConflict = errors.New("conflict")
+)
+
+// Storage Implement this interface in any persistence layer, such as a DB
+type Storage interface {
+	GetSignatureDevice(ctx context.Context, id string) (*InternalSignatureDevice, error)
+	CreateSignatureDevice(ctx context.Context, device *InternalSignatureDevice) error
+	GetAllSignatureDevices(ctx context.Context) ([]*InternalSignatureDevice, error)
+	GetLastSignature(ctx context.Context, deviceID string) (string, error)
+	// ListSignatures retrieves the signatures of a device that match the filter ordered by their counter.
+	ListSignatures(ctx context.Context, deviceID string, filter SignatureFilter) ([]*SignatureRecord, error)
+	// GetSignature retrieves the signature a device created with the given counter value.
+	GetSignature(ctx context.Context, deviceID string, counter int32) (*SignatureRecord, error)
+	// FindSignatureByIdempotencyKey retrieves the latest signature created with the idempotency key
+	// since the given time, of the device with the given ID or of any device if the ID is empty.
+	FindSignatureByIdempotencyKey(ctx context.Context, deviceID string, key string, since time.Time) (*SignatureRecord, error)
+	// PruneIdempotencyKeys forgets the idempotency keys of signatures created before the given time,
+	// which are no longer found by FindSignatureByIdempotencyKey anyway.
+	PruneIdempotencyKeys(ctx context.Context, before time.Time) error
+	// UpdatePrivateKey replaces the private key of a device and the ID of the key-encryption key sealing it,
+	// provided the stored private key is still the given previous one. Otherwise it returns ErrConflict.
+	UpdatePrivateKey(ctx context.Context, deviceID string, previous []byte, privateKey []byte, keyEncryptionKeyID string) error
+	// ListDeviceHistory retrieves the lifecycle state changes of a device ordered by their sequence.
+	ListDeviceHistory(ctx context.Context, deviceID string) ([]*DeviceStatusChange, error)
+	// ListDeviceKeys retrieves the retired keys of a device ordered by their version.
+	ListDeviceKeys(ctx context.Context, deviceID string) ([]*DeviceKey, error)
+	// InsertCertificate stores a certificate issued for a key of a device. It returns ErrConflict if
+	// the key already has a certificate or the serial number is taken.
+	InsertCertificate(ctx context.Context, certificate *DeviceCertificate) error
+	// ListCertificates retrieves the certificates of a device ordered by their key version.
+	ListCertificates(ctx context.Context, deviceID string) ([]*DeviceCertificate, error)
+	// ListRevokedCertificates retrieves the revoked certificates of all devices ordered by their revocation time.
+	ListRevokedCertificates(ctx context.Context) ([]*DeviceCertificate, error)
+	// RevokeCertificate marks the certificate of a device with the given serial number as revoked.
+	// It returns ErrConflict if the certificate has already been revoked.
+	RevokeCertificate(ctx context.Context, deviceID string, serialNumber string, revokedAt time.Time, reason string) error
+	// WithDeviceTx runs fn as a single unit of work on the device with the given ID.
+	// Units of work on the same device never interleave, and the changes made through the DeviceTx
+	// are only persisted if fn returns nil. fn must not call back into the Storage.
+	WithDeviceTx(ctx context.Context, id string, fn func(tx DeviceTx) error) error
+}
+
+// DeviceTx gives access to a device within a unit of work started by Storage.WithDeviceTx.
+type DeviceTx interface {
+	// Device returns the current state of the device within the unit of work.
+	Device() *InternalSignatureDevice
+	// InsertSignature stores the signature created with the device's current counter value
+	// and advances the counter. The device ID and counter of the record are set accordingly.
+	InsertSignature(record *SignatureRecord) error
+	// FindSignatureByIdempotencyKey retrieves the latest stored signature of the device created with
+	// the idempotency key since the given time.
+	FindSignatureByIdempotencyKey(key string, since time.Time) (*SignatureRecord, error)
+	// ChangeStatus moves the device to the lifecycle state of the change and appends the change
+	// to the device's history. The device ID, previous state and sequence of the change are set accordingly.
+	ChangeStatus(change *DeviceStatusChange) error
+	// UpdateLabel changes the label of the device, a nil label removes it.
+	UpdateLabel(label *string) error
+	// RotateKey replaces the key pair of the device and keeps its previous public key, which is retired
+	// after the last inserted signature. The version and first counter of the retired key are set accordingly.
+	RotateKey(rotation *KeyRotation) error
+}
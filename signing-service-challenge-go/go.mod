@@ -5,8 +5,11 @@ go 1.20
 require (
 	github.com/gin-gonic/gin v1.9.1
 	github.com/google/uuid v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.17
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/stretchr/testify v1.8.3
 	go.uber.org/zap v1.26.0
+	golang.org/x/crypto v0.9.0
 )
 
 require (
@@ -33,7 +36,6 @@ require (
 	github.com/ugorji/go/codec v1.2.11 // indirect
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/arch v0.3.0 // indirect
-	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
@@ -1,16 +1,61 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/api"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/crypto"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/persistence"
 	"go.uber.org/zap"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const (
 	ServerURL     = "http://localhost"
 	ListenAddress = ":8080"
+	// StorageEnv selects the persistence backend: "memory" (default), "file" or "sqlite".
+	StorageEnv = "SIGNING_SERVICE_STORAGE"
+	// SQLitePathEnv sets the database file of the "sqlite" backend.
+	SQLitePathEnv     = "SIGNING_SERVICE_SQLITE_PATH"
+	DefaultSQLitePath = "signing-service.db"
+	// FileDirEnv sets the directory holding the log and snapshots of the "file" backend.
+	FileDirEnv     = "SIGNING_SERVICE_FILE_DIR"
+	DefaultFileDir = "signing-service-data"
+	// IdempotencyRetentionEnv sets how long idempotency keys of signing requests are remembered,
+	// as a duration such as "24h".
+	IdempotencyRetentionEnv = "SIGNING_SERVICE_IDEMPOTENCY_RETENTION"
+	// KEKEnv holds the key-encryption keys sealing the private keys at rest as comma separated
+	// <id>:<base64 encoded 32 byte key> entries, the first one seals new keys.
+	// Without it or KEKFileEnv, private keys are stored in the clear, which only the "memory" and
+	// "file" backends allow. With it, keys still stored in the clear are sealed on startup.
+	KEKEnv = "SIGNING_SERVICE_KEK"
+	// KEKFileEnv names a file holding the key-encryption keys, one entry per line, if KEKEnv is not set.
+	KEKFileEnv = "SIGNING_SERVICE_KEK_FILE"
+	// PKCS11ModuleEnv names the PKCS#11 library of a hardware security module, such as libsofthsm2.so.
+	// The token holding the device keys is selected by its label and logged in with the user PIN.
+	PKCS11ModuleEnv = "SIGNING_SERVICE_PKCS11_MODULE"
+	PKCS11TokenEnv  = "SIGNING_SERVICE_PKCS11_TOKEN"
+	PKCS11PINEnv    = "SIGNING_SERVICE_PKCS11_PIN"
+	// KeyBackendEnv selects where devices that do not request a backend keep their keys:
+	// "software" (default) or "pkcs11".
+	KeyBackendEnv = "SIGNING_SERVICE_KEY_BACKEND"
+	// CADirEnv enables the certificate authority issuing the device certificates and sets the directory
+	// holding its root and intermediate certificates and keys, which are generated on the first start.
+	// The keys are sealed with the key-encryption keys of KEKEnv, if given, and re-wrapped on every start.
+	// Without it, no device certificates are issued.
+	CADirEnv = "SIGNING_SERVICE_CA_DIR"
+	// CANameEnv sets the organization named in the certificates of the certificate authority.
+	CANameEnv = "SIGNING_SERVICE_CA_NAME"
+	// CACRLURLEnv sets the public URL of the certificate revocation list served at /api/v1/ca/crl,
+	// which is named as the CRL distribution point of the device certificates. Without it, the
+	// certificates name no distribution point.
+	CACRLURLEnv = "SIGNING_SERVICE_CA_CRL_URL"
 	// TODO: add further configuration parameters here ...
 )
 
@@ -25,14 +70,143 @@ func main() {
 
 		}
 	}(logger)
+
+	keyring, err := crypto.LoadKeyring(os.Getenv(KEKEnv), os.Getenv(KEKFileEnv))
+	if err != nil {
+		log.Fatal("Invalid key-encryption keys: ", err)
+	}
+
+	storage, err := newStorage(logger, keyring)
+	if err != nil {
+		log.Fatal("Could not set up storage: ", err)
+	}
+
+	provider, err := newPKCS11Provider(logger)
+	if err != nil {
+		log.Fatal("Could not set up PKCS#11 token: ", err)
+	}
+	if provider != nil {
+		defer provider.Close()
+	}
+
+	options, err := newServiceOptions(provider, keyring)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	signatureService := domain.NewSignatureService(storage, options...)
+	if keyring != nil {
+		report, err := signatureService.SealPrivateKeys(context.Background())
+		if err != nil {
+			log.Fatal("Could not seal private keys: ", err)
+		}
+		if report.Sealed > 0 || len(report.Skipped) > 0 {
+			logger.Infow("Sealed private keys stored in the clear", "sealed", report.Sealed, "skipped", report.Skipped)
+		}
+	}
+
 	logger.Info("Starting server on " + ListenAddress)
-	storage := persistence.GetSignatureDeviceStorage() // For further implementation change this to DB storage
-	server := api.NewServer(ServerURL, ListenAddress, storage)
-	domain.NewSignatureService()
+	server := api.NewServer(ServerURL, ListenAddress, signatureService)
 
-	// Run the server
-	if err := server.Run(); err != nil {
-		log.Fatal("Could not start server on ", ListenAddress)
+	// Run the server until it is interrupted, then close the storage, which writes the final
+	// snapshot of the file storage.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Run(ctx); err != nil {
+		logger.Errorw("Server stopped", "error", err)
 	}
+	logger.Info("Shutting down")
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Errorw("Could not close storage", "error", err)
+		}
+	}
+}
 
+// newStorage creates the persistence backend selected through the environment. The SQLite backend
+// requires a keyring, so that no private key is stored in the clear in the database.
+func newStorage(logger *zap.SugaredLogger, keyring *crypto.Keyring) (persistence.Storage, error) {
+	switch backend := os.Getenv(StorageEnv); backend {
+	case "", "memory":
+		logger.Info("Using in-memory storage")
+		return persistence.NewSignatureDeviceStorage(), nil
+	case "file":
+		dir := os.Getenv(FileDirEnv)
+		if dir == "" {
+			dir = DefaultFileDir
+		}
+		logger.Info("Using file storage in " + dir)
+		return persistence.OpenFileStorage(dir, persistence.DefaultSnapshotInterval)
+	case "sqlite":
+		if keyring == nil {
+			return nil, fmt.Errorf("the sqlite backend requires key-encryption keys in %s or %s", KEKEnv, KEKFileEnv)
+		}
+		path := os.Getenv(SQLitePathEnv)
+		if path == "" {
+			path = DefaultSQLitePath
+		}
+		logger.Info("Using SQLite storage at " + path)
+		return persistence.OpenSQLiteStorage(path)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// newPKCS11Provider opens the PKCS#11 token configured through the environment, if any.
+func newPKCS11Provider(logger *zap.SugaredLogger) (*crypto.PKCS11Provider, error) {
+	module := os.Getenv(PKCS11ModuleEnv)
+	if module == "" {
+		return nil, nil
+	}
+	token := os.Getenv(PKCS11TokenEnv)
+	logger.Info("Using PKCS#11 token " + token + " of " + module)
+	return crypto.OpenPKCS11(crypto.PKCS11Config{
+		ModulePath: module,
+		TokenLabel: token,
+		PIN:        os.Getenv(PKCS11PINEnv),
+	})
+}
+
+// newServiceOptions configures the signature service through the environment.
+func newServiceOptions(provider *crypto.PKCS11Provider, keyring *crypto.Keyring) ([]domain.ServiceOption, error) {
+	var options []domain.ServiceOption
+	if value := os.Getenv(IdempotencyRetentionEnv); value != "" {
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration", IdempotencyRetentionEnv)
+		}
+		options = append(options, domain.WithIdempotencyKeyRetention(retention))
+	}
+
+	if keyring != nil {
+		options = append(options, domain.WithKeyring(keyring))
+	}
+
+	if provider != nil {
+		options = append(options, domain.WithPKCS11(provider))
+	}
+	switch backend := os.Getenv(KeyBackendEnv); backend {
+	case "", domain.KeyBackendSoftware:
+	case domain.KeyBackendPKCS11:
+		if provider == nil {
+			return nil, fmt.Errorf("%s=%s requires %s", KeyBackendEnv, backend, PKCS11ModuleEnv)
+		}
+		options = append(options, domain.WithDefaultKeyBackend(backend))
+	default:
+		return nil, fmt.Errorf("unknown key backend %q", backend)
+	}
+
+	if dir := os.Getenv(CADirEnv); dir != "" {
+		ca, err := crypto.OpenCertificateAuthority(crypto.CertificateAuthorityConfig{
+			Dir:     dir,
+			Name:    os.Getenv(CANameEnv),
+			CRLURL:  os.Getenv(CACRLURLEnv),
+			Keyring: keyring,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate authority in %s: %w", dir, err)
+		}
+		options = append(options, domain.WithCertificateAuthority(ca))
+	}
+	return options, nil
 }
@@ -0,0 +1,684 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	logFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	// DefaultSnapshotInterval is the number of log records after which a new snapshot is written.
+	DefaultSnapshotInterval = 1000
+
+	recordHeaderSize = 8
+	maxRecordSize    = 16 << 20
+)
+
+// Types of the records written to the log.
+const (
+	recordCreateDevice     = "create_device"
+	recordUpdateDevice     = "update_device"
+	recordUpdatePrivateKey = "update_private_key"
+	// The writes of a unit of work on a device, logs of older versions hold them as separate
+	// insert_signature, change_status, rotate_key and update_device records instead.
+	recordDeviceTx        = "device_tx"
+	recordInsertSignature = "insert_signature"
+	recordChangeStatus    = "change_status"
+	recordRotateKey       = "rotate_key"
+	// The revocation of a certificate only carries its device ID, serial number, revocation time and reason.
+	recordInsertCertificate = "insert_certificate"
+	recordRevokeCertificate = "revoke_certificate"
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTornRecord marks an incomplete or corrupted record at the end of the log.
+	errTornRecord = errors.New("torn log record")
+
+	// ErrStorageInUse is returned when the directory of a file storage is already opened by another
+	// process, such as the running service, or another FileStorage.
+	ErrStorageInUse = errors.New("file storage is in use")
+
+	// ErrCorruptLog is returned on startup for a corrupted record that is followed by further data.
+	// Unlike a torn record at the end of the log, it cannot be left by a crash and is not truncated.
+	ErrCorruptLog = errors.New("corrupt log record")
+)
+
+// logRecord is a single change appended to the log.
+// The sequence number makes replaying records that are already part of a snapshot a no-op.
+// Signatures logged before signature records were introduced only carry Counter and Signature.
+type logRecord struct {
+	Sequence           uint64                          `json:"sequence"`
+	Type               string                          `json:"type"`
+	Device             *domain.InternalSignatureDevice `json:"device,omitempty"`
+	DeviceID           string                          `json:"deviceId,omitempty"`
+	Label              *string                         `json:"label,omitempty"`
+	Counter            int32                           `json:"counter"`
+	Signature          string                          `json:"signature,omitempty"`
+	SignatureRecord    *domain.SignatureRecord         `json:"signatureRecord,omitempty"`
+	StatusChange       *domain.DeviceStatusChange      `json:"statusChange,omitempty"`
+	PrivateKey         []byte                          `json:"privateKey,omitempty"`
+	KeyEncryptionKeyID string                          `json:"keyEncryptionKeyId,omitempty"`
+	KeyRotation        *domain.KeyRotation             `json:"keyRotation,omitempty"`
+	Certificate        *domain.DeviceCertificate       `json:"certificate,omitempty"`
+	Changes            []*deviceChange                 `json:"changes,omitempty"`
+}
+
+// snapshotState is the full state written to the snapshot file.
+// Signatures holds the plain signatures of snapshots written before signature records were introduced.
+type snapshotState struct {
+	LastSequence     uint64                                  `json:"lastSequence"`
+	Devices          []*domain.InternalSignatureDevice       `json:"devices"`
+	Signatures       map[string][]string                     `json:"signatures,omitempty"`
+	SignatureRecords map[string][]*domain.SignatureRecord    `json:"signatureRecords"`
+	History          map[string][]*domain.DeviceStatusChange `json:"history,omitempty"`
+	Keys             map[string][]*domain.DeviceKey          `json:"keys,omitempty"`
+	Certificates     map[string][]*domain.DeviceCertificate  `json:"certificates,omitempty"`
+}
+
+// FileStorage is an embedded storage engine that keeps its state in memory and makes every change
+// durable in an fsync'd append-only log before applying it. The state is periodically written to a
+// snapshot, after which the log starts over. On startup the snapshot is loaded and the log replayed,
+// a torn record at the end of the log left by a crash is detected by its checksum and truncated.
+// A corrupted record in the middle of the log makes the startup fail with ErrCorruptLog instead.
+// The log is locked while the storage is open, so that a directory is only used by one process.
+type FileStorage struct {
+	dir              string
+	snapshotInterval int
+
+	locks         deviceLocks
+	mutex         sync.Mutex
+	state         *DeviceStorage
+	log           *os.File
+	logSize       int64
+	sequence      uint64
+	sinceSnapshot int
+	failed        error
+}
+
+// OpenFileStorage opens the file storage in dir, creating it if it does not exist, and recovers its state.
+// A snapshot is written every snapshotInterval records, zero disables periodic snapshots.
+func OpenFileStorage(dir string, snapshotInterval int) (*FileStorage, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FileStorage{
+		dir:              dir,
+		snapshotInterval: snapshotInterval,
+		state:            NewSignatureDeviceStorage(),
+	}
+
+	f.log, err = os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f.log)
+	if errors.Is(err, ErrStorageInUse) {
+		err = fmt.Errorf("%w: %s is opened by another process", ErrStorageInUse, dir)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err == nil {
+		err = f.loadSnapshot()
+	}
+	if err == nil {
+		err = f.replay()
+	}
+	if err != nil {
+		f.log.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close writes a final snapshot and closes the log.
+func (f *FileStorage) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var err error
+	if f.failed == nil {
+		err = f.snapshot()
+	}
+	closeErr := f.log.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// GetSignatureDevice retrieves a signature device by ID.
+func (f *FileStorage) GetSignatureDevice(ctx context.Context, id string) (*domain.InternalSignatureDevice, error) {
+	return f.state.GetSignatureDevice(ctx, id)
+}
+
+// GetAllSignatureDevices retrieves all signature devices.
+func (f *FileStorage) GetAllSignatureDevices(ctx context.Context) ([]*domain.InternalSignatureDevice, error) {
+	return f.state.GetAllSignatureDevices(ctx)
+}
+
+// GetLastSignature retrieves the last inserted signature of a device.
+func (f *FileStorage) GetLastSignature(ctx context.Context, deviceID string) (string, error) {
+	return f.state.GetLastSignature(ctx, deviceID)
+}
+
+// ListSignatures retrieves the signatures of a device that match the filter ordered by their counter.
+func (f *FileStorage) ListSignatures(ctx context.Context, deviceID string, filter domain.SignatureFilter) ([]*domain.SignatureRecord, error) {
+	return f.state.ListSignatures(ctx, deviceID, filter)
+}
+
+// GetSignature retrieves the signature a device created with the given counter value.
+func (f *FileStorage) GetSignature(ctx context.Context, deviceID string, counter int32) (*domain.SignatureRecord, error) {
+	return f.state.GetSignature(ctx, deviceID, counter)
+}
+
+// FindSignatureByIdempotencyKey retrieves the latest signature created with the idempotency key since the
+// given time, of the device with the given ID or of any device if the ID is empty.
+func (f *FileStorage) FindSignatureByIdempotencyKey(ctx context.Context, deviceID string, key string, since time.Time) (*domain.SignatureRecord, error) {
+	return f.state.FindSignatureByIdempotencyKey(ctx, deviceID, key, since)
+}
+
+// PruneIdempotencyKeys forgets the idempotency keys of signatures created before the given time. The index
+// is only kept in memory and rebuilt from the signatures on startup, so pruning is not logged.
+func (f *FileStorage) PruneIdempotencyKeys(ctx context.Context, before time.Time) error {
+	return f.state.PruneIdempotencyKeys(ctx, before)
+}
+
+// ListDeviceHistory retrieves the lifecycle state changes of a device ordered by their sequence.
+func (f *FileStorage) ListDeviceHistory(ctx context.Context, deviceID string) ([]*domain.DeviceStatusChange, error) {
+	return f.state.ListDeviceHistory(ctx, deviceID)
+}
+
+// ListDeviceKeys retrieves the retired keys of a device ordered by their version.
+func (f *FileStorage) ListDeviceKeys(ctx context.Context, deviceID string) ([]*domain.DeviceKey, error) {
+	return f.state.ListDeviceKeys(ctx, deviceID)
+}
+
+// ListCertificates retrieves the certificates of a device ordered by their key version.
+func (f *FileStorage) ListCertificates(ctx context.Context, deviceID string) ([]*domain.DeviceCertificate, error) {
+	return f.state.ListCertificates(ctx, deviceID)
+}
+
+// ListRevokedCertificates retrieves the revoked certificates of all devices ordered by their revocation time.
+func (f *FileStorage) ListRevokedCertificates(ctx context.Context) ([]*domain.DeviceCertificate, error) {
+	return f.state.ListRevokedCertificates(ctx)
+}
+
+// CreateSignatureDevice logs the creation of a signature device and applies it.
+func (f *FileStorage) CreateSignatureDevice(ctx context.Context, device *domain.InternalSignatureDevice) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if _, err := f.state.GetSignatureDevice(ctx, device.ID); err == nil {
+		return fmt.Errorf("%w: device %s already exists", ErrConflict, device.ID)
+	}
+
+	return f.commit(&logRecord{Type: recordCreateDevice, Device: device}, func() error {
+		return f.state.CreateSignatureDevice(ctx, device)
+	})
+}
+
+// UpdatePrivateKey logs the replacement of the private key of a signature device and applies it,
+// provided the stored private key is still the previous one.
+func (f *FileStorage) UpdatePrivateKey(ctx context.Context, deviceID string, previous []byte, privateKey []byte, keyEncryptionKeyID string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	device, err := f.state.GetSignatureDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(device.PrivateKey, previous) {
+		return fmt.Errorf("%w: the private key of device %s has changed", ErrConflict, deviceID)
+	}
+
+	return f.commit(&logRecord{
+		Type:               recordUpdatePrivateKey,
+		DeviceID:           deviceID,
+		PrivateKey:         privateKey,
+		KeyEncryptionKeyID: keyEncryptionKeyID,
+	}, func() error {
+		return f.state.UpdatePrivateKey(ctx, deviceID, previous, privateKey, keyEncryptionKeyID)
+	})
+}
+
+// InsertCertificate logs a certificate issued for a key of a device and applies it.
+func (f *FileStorage) InsertCertificate(ctx context.Context, certificate *domain.DeviceCertificate) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.state.mutex.RLock()
+	err := f.state.checkCertificate(certificate)
+	f.state.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return f.commit(&logRecord{Type: recordInsertCertificate, Certificate: certificate}, func() error {
+		return f.state.InsertCertificate(ctx, certificate)
+	})
+}
+
+// RevokeCertificate logs the revocation of a certificate of a device and applies it.
+func (f *FileStorage) RevokeCertificate(ctx context.Context, deviceID string, serialNumber string, revokedAt time.Time, reason string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.state.mutex.RLock()
+	_, err := f.state.revocableCertificate(deviceID, serialNumber)
+	f.state.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return f.commit(&logRecord{Type: recordRevokeCertificate, Certificate: &domain.DeviceCertificate{
+		DeviceID:         deviceID,
+		SerialNumber:     serialNumber,
+		RevokedAt:        &revokedAt,
+		RevocationReason: reason,
+	}}, func() error {
+		return f.state.RevokeCertificate(ctx, deviceID, serialNumber, revokedAt, reason)
+	})
+}
+
+// WithDeviceTx runs fn as a unit of work on a device. The signatures inserted, status changes and key
+// rotations made by fn are buffered and logged as one record once fn returns nil, so that they are
+// recovered together or not at all.
+func (f *FileStorage) WithDeviceTx(ctx context.Context, id string, fn func(tx DeviceTx) error) error {
+	unlock := f.locks.lock(id)
+	defer unlock()
+
+	device, err := f.state.GetSignatureDevice(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx := &memoryDeviceTx{ctx: ctx, device: device, state: f.state}
+	err = fn(tx)
+	if err != nil || len(tx.changes) == 0 {
+		return err
+	}
+	return f.commitChanges(id, tx.changes)
+}
+
+// commitChanges logs the writes of a unit of work on a device as one record and applies them.
+func (f *FileStorage) commitChanges(deviceID string, changes []*deviceChange) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.state.mutex.RLock()
+	err := f.state.checkChanges(deviceID, changes)
+	f.state.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	return f.commit(&logRecord{
+		Type:     recordDeviceTx,
+		DeviceID: deviceID,
+		Changes:  changes,
+	}, func() error {
+		return f.state.applyChanges(deviceID, changes)
+	})
+}
+
+// commit makes the record durable, applies it to the state and writes a snapshot when it is due.
+// Callers must hold the mutex.
+func (f *FileStorage) commit(record *logRecord, apply func() error) error {
+	err := f.append(record)
+	if err != nil {
+		return err
+	}
+	err = apply()
+	if err != nil {
+		return err
+	}
+
+	if f.snapshotInterval > 0 && f.sinceSnapshot >= f.snapshotInterval {
+		// The record is already durable, a failed snapshot is retried with the next record.
+		err = f.snapshot()
+		if err != nil {
+			zap.S().Warnw("Failed to write snapshot", "error", err)
+		}
+	}
+	return nil
+}
+
+// append writes the record to the log and waits until it is on disk.
+func (f *FileStorage) append(record *logRecord) error {
+	if f.failed != nil {
+		return f.failed
+	}
+
+	record.Sequence = f.sequence + 1
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buffer[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buffer[4:8], crc32.Checksum(payload, crcTable))
+	copy(buffer[recordHeaderSize:], payload)
+
+	_, err = f.log.WriteAt(buffer, f.logSize)
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		// A partially written record would hide all following records from the replay.
+		truncateErr := f.log.Truncate(f.logSize)
+		if truncateErr != nil {
+			f.failed = fmt.Errorf("file storage is unusable after a failed write: %w", truncateErr)
+		}
+		return fmt.Errorf("failed to write log record: %w", err)
+	}
+
+	f.logSize += int64(len(buffer))
+	f.sequence = record.Sequence
+	f.sinceSnapshot++
+	return nil
+}
+
+// snapshot atomically replaces the snapshot with the current state and starts a new log.
+// Callers must hold the mutex.
+func (f *FileStorage) snapshot() error {
+	f.state.mutex.RLock()
+	state := snapshotState{
+		LastSequence:     f.sequence,
+		Devices:          make([]*domain.InternalSignatureDevice, 0, len(f.state.devices)),
+		SignatureRecords: f.state.signatures,
+		History:          f.state.history,
+		Keys:             f.state.keys,
+		Certificates:     f.state.certificates,
+	}
+	for _, device := range f.state.devices {
+		state.Devices = append(state.Devices, device)
+	}
+	data, err := json.Marshal(state)
+	f.state.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(f.dir, snapshotFileName)
+	err = writeFileSync(path+".tmp", data)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	err = syncDir(f.dir)
+	if err != nil {
+		return err
+	}
+
+	// If a crash happens before the truncation, the records are skipped by their sequence on replay.
+	err = f.log.Truncate(0)
+	if err == nil {
+		err = f.log.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	f.logSize = 0
+	f.sinceSnapshot = 0
+	return nil
+}
+
+// loadSnapshot restores the state of the last snapshot, if there is one.
+func (f *FileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(f.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state snapshotState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	for _, device := range state.Devices {
+		f.state.devices[device.ID] = device
+	}
+	for deviceID, signatures := range state.Signatures {
+		for counter, signature := range signatures {
+			f.state.signatures[deviceID] = append(f.state.signatures[deviceID], &domain.SignatureRecord{
+				DeviceID:  deviceID,
+				Counter:   int32(counter),
+				Signature: signature,
+			})
+		}
+	}
+	for deviceID, records := range state.SignatureRecords {
+		f.state.setSignatures(deviceID, records)
+	}
+	for deviceID, history := range state.History {
+		f.state.history[deviceID] = history
+	}
+	for deviceID, keys := range state.Keys {
+		f.state.keys[deviceID] = keys
+	}
+	for _, certificates := range state.Certificates {
+		for _, certificate := range certificates {
+			f.state.setCertificate(certificate)
+		}
+	}
+	f.sequence = state.LastSequence
+	return nil
+}
+
+// replay applies the records of the log that are newer than the snapshot.
+// A torn record at the end is truncated, any other corrupted record fails the replay.
+func (f *FileStorage) replay() error {
+	info, err := f.log.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(f.log)
+	var offset int64
+	for {
+		record, size, err := readRecord(reader, info.Size()-offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ErrCorruptLog) {
+			// File systems may extend the log by zeroes without the data written before a crash.
+			var zeroes bool
+			zeroes, err = zeroesFrom(f.log, offset)
+			if err != nil {
+				return err
+			}
+			if !zeroes {
+				return fmt.Errorf("%w at offset %d of %s", ErrCorruptLog, offset, f.log.Name())
+			}
+			err = errTornRecord
+		}
+		if errors.Is(err, errTornRecord) {
+			zap.S().Warnw("Truncating torn record at the end of the log", "offset", offset)
+			err = f.log.Truncate(offset)
+			if err == nil {
+				err = f.log.Sync()
+			}
+			if err != nil {
+				return fmt.Errorf("failed to truncate torn log record: %w", err)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if record.Sequence > f.sequence {
+			err = f.apply(record)
+			if err != nil {
+				return fmt.Errorf("failed to replay log record %d: %w", record.Sequence, err)
+			}
+			f.sequence = record.Sequence
+			f.sinceSnapshot++
+		}
+		offset += size
+	}
+
+	f.logSize = offset
+	return nil
+}
+
+// apply changes the state according to a replayed record.
+func (f *FileStorage) apply(record *logRecord) error {
+	switch record.Type {
+	case recordCreateDevice:
+		return f.state.CreateSignatureDevice(context.Background(), record.Device)
+	case recordUpdateDevice:
+		return f.state.applyChanges(record.DeviceID, []*deviceChange{{LabelChange: &labelChange{Label: record.Label}}})
+	case recordDeviceTx:
+		return f.state.applyChanges(record.DeviceID, record.Changes)
+	case recordInsertSignature:
+		signatureRecord := record.SignatureRecord
+		if signatureRecord == nil {
+			signatureRecord = &domain.SignatureRecord{
+				DeviceID:  record.DeviceID,
+				Counter:   record.Counter,
+				Signature: record.Signature,
+			}
+		}
+		// Refuses any record that would not continue the counter of the device.
+		return f.state.applyChanges(signatureRecord.DeviceID, []*deviceChange{{SignatureRecord: signatureRecord}})
+	case recordChangeStatus:
+		return f.state.applyChanges(record.StatusChange.DeviceID, []*deviceChange{{StatusChange: record.StatusChange}})
+	case recordUpdatePrivateKey:
+		f.state.mutex.Lock()
+		defer f.state.mutex.Unlock()
+		return f.state.setPrivateKey(record.DeviceID, record.PrivateKey, record.KeyEncryptionKeyID)
+	case recordRotateKey:
+		return f.state.applyChanges(record.KeyRotation.Retired.DeviceID, []*deviceChange{{KeyRotation: record.KeyRotation}})
+	case recordInsertCertificate:
+		return f.state.InsertCertificate(context.Background(), record.Certificate)
+	case recordRevokeCertificate:
+		certificate := record.Certificate
+		return f.state.RevokeCertificate(context.Background(), certificate.DeviceID, certificate.SerialNumber,
+			*certificate.RevokedAt, certificate.RevocationReason)
+	default:
+		return fmt.Errorf("unknown record type %s", record.Type)
+	}
+}
+
+// readRecord reads the next record and returns it together with its size in the log, remaining is
+// the number of bytes left in the log. It returns io.EOF at the clean end of the log, errTornRecord for
+// an incomplete record or a corrupted one reaching the end of the log and ErrCorruptLog for a corrupted
+// record followed by further data.
+func readRecord(reader io.Reader, remaining int64) (*logRecord, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if errors.Is(err, io.EOF) {
+		return nil, 0, io.EOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, 0, errTornRecord
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	// Only the last record may have been torn by a crash.
+	corrupted := ErrCorruptLog
+	if recordHeaderSize+int64(length) >= remaining {
+		corrupted = errTornRecord
+	}
+	if length == 0 || length > maxRecordSize {
+		return nil, 0, corrupted
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, 0, errTornRecord
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return nil, 0, corrupted
+	}
+
+	var record logRecord
+	err = json.Unmarshal(payload, &record)
+	if err != nil {
+		return nil, 0, corrupted
+	}
+	return &record, int64(recordHeaderSize + len(payload)), nil
+}
+
+// zeroesFrom reports whether the file only contains zero bytes from the offset on.
+func zeroesFrom(file *os.File, offset int64) (bool, error) {
+	buffer := make([]byte, 32<<10)
+	for {
+		n, err := file.ReadAt(buffer, offset)
+		for _, b := range buffer[:n] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// writeFileSync writes the data to a new file and waits until it is on disk.
+func writeFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir makes the creation and renaming of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
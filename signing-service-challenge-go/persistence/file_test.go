@@ -0,0 +1,450 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// crash closes the log without writing a final snapshot, like a process that was killed.
+func crash(t *testing.T, storage *FileStorage) {
+	assert.NoError(t, storage.log.Close())
+}
+
+func TestFileStorageReplaysLogAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	assert.NoError(t, sign(ctx, storage, "device-1", "second"))
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), device.SignatureCounter)
+	assert.Equal(t, "second", device.LastSignature)
+
+	record, err := storage.GetSignature(ctx, "device-1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "data", record.DataToBeSigned)
+	assert.Equal(t, testTime, record.CreatedAt)
+
+	// The counter continues where it was before the crash.
+	assert.NoError(t, sign(ctx, storage, "device-1", "third"))
+	device, err = storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), device.SignatureCounter)
+}
+
+func TestFileStorageRefusesSecondOpen(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+
+	_, err = OpenFileStorage(dir, 0)
+	assert.ErrorIs(t, err, ErrStorageInUse)
+
+	assert.NoError(t, storage.Close())
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Close())
+}
+
+func TestFileStorageReplaysStatusChanges(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+		return tx.ChangeStatus(&domain.DeviceStatusChange{ToStatus: domain.DeviceStatusSuspended, CreatedAt: testTime})
+	})
+	assert.NoError(t, err)
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, domain.DeviceStatusSuspended, device.Status)
+
+	// The history also survives a snapshot.
+	assert.NoError(t, storage.Close())
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	history, err := storage.ListDeviceHistory(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, 1, history[0].Sequence)
+	assert.Equal(t, domain.DeviceStatusActive, history[0].FromStatus)
+}
+
+func TestFileStorageReplaysLabelUpdates(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	label := "Renamed"
+	err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+		return tx.UpdateLabel(&label)
+	})
+	assert.NoError(t, err)
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Renamed", *device.Label)
+}
+
+func TestFileStorageReplaysPrivateKeyUpdates(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	device := newTestDevice("device-1")
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, device))
+	assert.NoError(t, storage.UpdatePrivateKey(ctx, "device-1", device.PrivateKey, []byte("sealed"), "kek-1"))
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	stored, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("sealed"), stored.PrivateKey)
+	assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+}
+
+func TestFileStorageReplaysKeyRotations(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, rotateKey(storage, "device-1", "public-2"))
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	stored, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("public-2"), stored.PublicKey)
+
+	// The retired keys also survive a snapshot.
+	assert.NoError(t, storage.Close())
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	keys, err := storage.ListDeviceKeys(ctx, "device-1")
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 1) {
+		assert.Equal(t, 1, keys[0].Version)
+		assert.Equal(t, []byte("public"), keys[0].PublicKey)
+		assert.Equal(t, int32(0), *keys[0].ToCounter)
+	}
+}
+
+func TestFileStorageLogsUnitOfWorkAsOneRecord(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, rotateKey(storage, "device-1", "public-2"))
+	crash(t, storage)
+
+	data, err := os.ReadFile(filepath.Join(dir, logFileName))
+	assert.NoError(t, err)
+	reader := bytes.NewReader(data)
+	var types []string
+	for remaining := int64(len(data)); remaining > 0; {
+		record, size, err := readRecord(reader, remaining)
+		if !assert.NoError(t, err) {
+			break
+		}
+		types = append(types, record.Type)
+		remaining -= size
+	}
+	assert.Equal(t, []string{recordCreateDevice, recordDeviceTx}, types)
+
+	// Cutting the record off loses the transition record and the rotation together.
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, logFileName), data[:len(data)-1], 0o600))
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	stored, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), stored.SignatureCounter)
+	assert.Equal(t, []byte("public"), stored.PublicKey)
+}
+
+func TestFileStorageReplaysCertificates(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, storage.InsertCertificate(ctx, newTestCertificate("device-1", 1)))
+	assert.NoError(t, storage.RevokeCertificate(ctx, "device-1", "device-1-1", testTime, domain.RevocationReasonSuperseded))
+	assert.NoError(t, storage.InsertCertificate(ctx, newTestCertificate("device-1", 2)))
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	revoked, err := storage.ListRevokedCertificates(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, revoked, 1) {
+		assert.Equal(t, "device-1-1", revoked[0].SerialNumber)
+	}
+
+	// The certificates also survive a snapshot.
+	assert.NoError(t, storage.Close())
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	certificates, err := storage.ListCertificates(ctx, "device-1")
+	assert.NoError(t, err)
+	if assert.Len(t, certificates, 2) {
+		assert.Equal(t, testTime, *certificates[0].RevokedAt)
+		assert.Nil(t, certificates[1].RevokedAt)
+	}
+	err = storage.InsertCertificate(ctx, newTestCertificate("device-1", 2))
+	assert.ErrorIs(t, err, ErrConflict)
+}
+
+func TestFileStorageTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	crash(t, storage)
+
+	intact, err := os.Stat(logPath)
+	assert.NoError(t, err)
+
+	// Simulate a crash in the middle of writing the next record.
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, '{', '"'})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+
+	recovered, err := os.Stat(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, intact.Size(), recovered.Size())
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), device.SignatureCounter)
+
+	// Records appended after the recovery must survive the next restart.
+	assert.NoError(t, sign(ctx, storage, "device-1", "second"))
+	crash(t, storage)
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err = storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), device.SignatureCounter)
+}
+
+func TestFileStorageDetectsCorruptedLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	crash(t, storage)
+
+	// Flip the last byte, so that the checksum of the signature record does not match anymore.
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(logPath, data, 0o600))
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), device.SignatureCounter)
+}
+
+func TestFileStorageRefusesCorruptedRecordInTheMiddle(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	crash(t, storage)
+
+	// Flip the last byte of the device record, which is followed by the signature record.
+	data, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	record, size, err := readRecord(bytes.NewReader(data), int64(len(data)))
+	assert.NoError(t, err)
+	assert.Equal(t, recordCreateDevice, record.Type)
+	data[size-1] ^= 0xff
+	assert.NoError(t, os.WriteFile(logPath, data, 0o600))
+
+	_, err = OpenFileStorage(dir, 0)
+	assert.ErrorIs(t, err, ErrCorruptLog)
+
+	// The log is left untouched for inspection.
+	corrupted, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, data, corrupted)
+}
+
+func TestFileStorageTruncatesZeroedTail(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	crash(t, storage)
+
+	intact, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(logPath, append(intact, make([]byte, 64)...), 0o600))
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	recovered, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, intact, recovered)
+}
+
+func TestFileStorageSnapshots(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 2)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, sign(ctx, storage, "device-1", "signature"))
+	}
+	crash(t, storage)
+
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.NoError(t, err)
+
+	storage, err = OpenFileStorage(dir, 2)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), device.SignatureCounter)
+	assert.Len(t, storage.state.signatures["device-1"], 4)
+}
+
+func TestFileStorageIndexesIdempotencyKeysOfSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+		record := newTestSignature("first", testTime)
+		record.IdempotencyKey = "key-1"
+		return tx.InsertSignature(record)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, storage.Close())
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	record, err := storage.FindSignatureByIdempotencyKey(ctx, "device-1", "key-1", testTime)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", record.Signature)
+}
+
+func TestFileStorageSkipsRecordsContainedInSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, logFileName)
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	logged, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+
+	storage.mutex.Lock()
+	assert.NoError(t, storage.snapshot())
+	storage.mutex.Unlock()
+	crash(t, storage)
+
+	// Simulate a crash after the snapshot was written but before the log was truncated.
+	assert.NoError(t, os.WriteFile(logPath, logged, 0o600))
+
+	storage, err = OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	device, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), device.SignatureCounter)
+	assert.NoError(t, sign(ctx, storage, "device-1", "second"))
+}
+
+func TestFileStorageLoadsPlainSignaturesOfOlderVersions(t *testing.T) {
+	dir := t.TempDir()
+
+	device, err := json.Marshal(newTestDevice("device-1"))
+	assert.NoError(t, err)
+	device = bytes.Replace(device, []byte(`"signatureCounter":0`), []byte(`"signatureCounter":2`), 1)
+	snapshot := `{"lastSequence": 3, "devices": [` + string(device) + `], "signatures": {"device-1": ["first", "second"]}}`
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, snapshotFileName), []byte(snapshot), 0o600))
+
+	storage, err := OpenFileStorage(dir, 0)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	record, err := storage.GetSignature(ctx, "device-1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, &domain.SignatureRecord{DeviceID: "device-1", Counter: 1, Signature: "second"}, record)
+	assert.NoError(t, sign(ctx, storage, "device-1", "third"))
+}
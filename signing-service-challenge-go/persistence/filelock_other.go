@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package persistence
+
+import "os"
+
+// lockFile does nothing on platforms without flock, the file storage must not be opened twice there.
+func lockFile(file *os.File) error {
+	return nil
+}
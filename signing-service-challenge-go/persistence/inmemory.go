@@ -1,98 +1,575 @@
 package persistence
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"sort"
 	"sync"
+	"time"
 )
 
-// Storage Implement this interface in any persistence layer, such as a DB
-type Storage interface {
-	GetSignatureDevice(id string) (*domain.InternalSignatureDevice, error)
-	CreateSignatureDevice(device *domain.InternalSignatureDevice) error
-	GetAllSignatureDevices() ([]*domain.InternalSignatureDevice, error)
-	GetLastSignature() string
-	InsertSignature(signature string)
-}
-
-var (
-	once                   sync.Once
-	singletonMemoryStorage *DeviceStorage
-)
-
+// DeviceStorage keeps copies of the devices in memory, so that they can only be changed through the storage.
 type DeviceStorage struct {
 	devices    map[string]*domain.InternalSignatureDevice
-	signatures []string
-	mutex      sync.RWMutex
+	signatures map[string][]*domain.SignatureRecord
+	history    map[string][]*domain.DeviceStatusChange
+	keys       map[string][]*domain.DeviceKey
+	// certificates holds the certificates of every device, serialNumbers indexes them by their serial number.
+	certificates  map[string][]*domain.DeviceCertificate
+	serialNumbers map[string]*domain.DeviceCertificate
+	// idempotencyKeys maps every idempotency key and device ID to the latest signature the device created
+	// with the key, idempotencyOrder holds the indexed signatures ordered by their creation time for pruning.
+	idempotencyKeys  map[string]map[string]*domain.SignatureRecord
+	idempotencyOrder []*domain.SignatureRecord
+	mutex            sync.RWMutex
+	locks            deviceLocks
 }
 
 // NewSignatureDeviceStorage creates a new instance of DeviceStorage.
 func NewSignatureDeviceStorage() *DeviceStorage {
 	return &DeviceStorage{
 		devices:    make(map[string]*domain.InternalSignatureDevice),
-		signatures: make([]string, 0),
+		signatures: make(map[string][]*domain.SignatureRecord),
+		history:    make(map[string][]*domain.DeviceStatusChange),
+		keys:       make(map[string][]*domain.DeviceKey),
+
+		certificates:    make(map[string][]*domain.DeviceCertificate),
+		serialNumbers:   make(map[string]*domain.DeviceCertificate),
+		idempotencyKeys: make(map[string]map[string]*domain.SignatureRecord),
 	}
 }
 
-func GetSignatureDeviceStorage() *DeviceStorage {
-	once.Do(func() {
-		singletonMemoryStorage = NewSignatureDeviceStorage()
-	})
-	return singletonMemoryStorage
+// GetLastSignature retrieves the last inserted signature of a device from memory storage.
+// It returns an empty string if the device has not signed anything yet.
+func (m *DeviceStorage) GetLastSignature(ctx context.Context, deviceID string) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return "", fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	signatures := m.signatures[deviceID]
+	if len(signatures) == 0 {
+		return "", nil
+	}
+
+	return signatures[len(signatures)-1].Signature, nil
+}
+
+// ListSignatures retrieves the signatures of a device that match the filter from memory storage
+// ordered by their counter.
+func (m *DeviceStorage) ListSignatures(ctx context.Context, deviceID string, filter domain.SignatureFilter) ([]*domain.SignatureRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	// The counter starts at 0 and has no gaps, so it is the index of the signature.
+	signatures := m.signatures[deviceID]
+	if filter.FromCounter != nil && *filter.FromCounter > 0 {
+		if int(*filter.FromCounter) >= len(signatures) {
+			signatures = nil
+		} else {
+			signatures = signatures[*filter.FromCounter:]
+		}
+	}
+
+	records := make([]*domain.SignatureRecord, 0)
+	for _, record := range signatures {
+		if filter.Limit > 0 && len(records) == filter.Limit {
+			break
+		}
+		if filter.ToCounter != nil && record.Counter > *filter.ToCounter {
+			break
+		}
+		if filter.Matches(record) {
+			clone := *record
+			records = append(records, &clone)
+		}
+	}
+	return records, nil
+}
+
+// GetSignature retrieves the signature a device created with the given counter value from memory storage.
+func (m *DeviceStorage) GetSignature(ctx context.Context, deviceID string, counter int32) (*domain.SignatureRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	signatures := m.signatures[deviceID]
+	if counter < 0 || int(counter) >= len(signatures) {
+		return nil, fmt.Errorf("%w: signature %d of device %s", ErrNotFound, counter, deviceID)
+	}
+	record := *signatures[counter]
+	return &record, nil
+}
+
+// FindSignatureByIdempotencyKey retrieves the latest signature created with the idempotency key since the
+// given time from memory storage, of the device with the given ID or of any device if the ID is empty.
+func (m *DeviceStorage) FindSignatureByIdempotencyKey(ctx context.Context, deviceID string, key string, since time.Time) (*domain.SignatureRecord, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var record *domain.SignatureRecord
+	for id, candidate := range m.idempotencyKeys[key] {
+		if (deviceID == "" || id == deviceID) && (record == nil || candidate.CreatedAt.After(record.CreatedAt)) {
+			record = candidate
+		}
+	}
+	if record == nil || record.CreatedAt.Before(since) {
+		return nil, fmt.Errorf("%w: signature with idempotency key %s", ErrNotFound, key)
+	}
+	clone := *record
+	return &clone, nil
+}
+
+// setSignatures replaces the signatures of a device in memory storage and indexes their idempotency keys.
+// Callers must hold the mutex.
+func (m *DeviceStorage) setSignatures(deviceID string, records []*domain.SignatureRecord) {
+	m.signatures[deviceID] = records
+	for _, record := range records {
+		m.indexIdempotencyKey(record)
+	}
+}
+
+// indexIdempotencyKey remembers the record as the latest one its device created with its idempotency key.
+// Callers must hold the mutex.
+func (m *DeviceStorage) indexIdempotencyKey(record *domain.SignatureRecord) {
+	if record.IdempotencyKey == "" {
+		return
+	}
+	records, ok := m.idempotencyKeys[record.IdempotencyKey]
+	if !ok {
+		records = make(map[string]*domain.SignatureRecord)
+		m.idempotencyKeys[record.IdempotencyKey] = records
+	}
+	if latest, ok := records[record.DeviceID]; ok && latest.CreatedAt.After(record.CreatedAt) {
+		return
+	}
+	records[record.DeviceID] = record
+
+	// Signatures are usually indexed in the order they are created, only those of loaded devices
+	// may have to be inserted in between.
+	order := m.idempotencyOrder
+	i := len(order)
+	if i > 0 && order[i-1].CreatedAt.After(record.CreatedAt) {
+		i = sort.Search(len(order), func(j int) bool { return order[j].CreatedAt.After(record.CreatedAt) })
+	}
+	order = append(order, nil)
+	copy(order[i+1:], order[i:])
+	order[i] = record
+	m.idempotencyOrder = order
 }
 
-// GetLastSignature retrieves the last inserted signature from memory storage.
-func (m *DeviceStorage) GetLastSignature() string {
+// PruneIdempotencyKeys forgets the idempotency keys of signatures created before the given time in memory storage.
+func (m *DeviceStorage) PruneIdempotencyKeys(ctx context.Context, before time.Time) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if len(m.signatures) == 0 {
-		return "0"
+	pruned := 0
+	for _, record := range m.idempotencyOrder {
+		if !record.CreatedAt.Before(before) {
+			break
+		}
+		records := m.idempotencyKeys[record.IdempotencyKey]
+		if records[record.DeviceID] == record {
+			delete(records, record.DeviceID)
+			if len(records) == 0 {
+				delete(m.idempotencyKeys, record.IdempotencyKey)
+			}
+		}
+		pruned++
+	}
+	m.idempotencyOrder = m.idempotencyOrder[pruned:]
+	return nil
+}
+
+// ListDeviceHistory retrieves the lifecycle state changes of a device from memory storage.
+func (m *DeviceStorage) ListDeviceHistory(ctx context.Context, deviceID string) ([]*domain.DeviceStatusChange, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	history := make([]*domain.DeviceStatusChange, 0, len(m.history[deviceID]))
+	for _, change := range m.history[deviceID] {
+		clone := *change
+		history = append(history, &clone)
+	}
+	return history, nil
+}
+
+// ListDeviceKeys retrieves the retired keys of a device from memory storage.
+func (m *DeviceStorage) ListDeviceKeys(ctx context.Context, deviceID string) ([]*domain.DeviceKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
 	}
 
-	return m.signatures[len(m.signatures)-1]
+	keys := make([]*domain.DeviceKey, 0, len(m.keys[deviceID]))
+	for _, key := range m.keys[deviceID] {
+		clone := *key
+		keys = append(keys, &clone)
+	}
+	return keys, nil
 }
 
-// InsertSignature creates a signature in memory storage.
-func (m *DeviceStorage) InsertSignature(signature string) {
+// InsertCertificate stores a certificate issued for a key of a device in memory storage.
+func (m *DeviceStorage) InsertCertificate(ctx context.Context, certificate *domain.DeviceCertificate) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.signatures = append(m.signatures, signature)
+	err := m.checkCertificate(certificate)
+	if err != nil {
+		return err
+	}
+	m.setCertificate(certificate)
+	return nil
+}
+
+// checkCertificate reports whether the certificate can be inserted. Callers must hold the mutex.
+func (m *DeviceStorage) checkCertificate(certificate *domain.DeviceCertificate) error {
+	if _, ok := m.devices[certificate.DeviceID]; !ok {
+		return fmt.Errorf("%w: device %s", ErrNotFound, certificate.DeviceID)
+	}
+	if _, exists := m.serialNumbers[certificate.SerialNumber]; exists {
+		return fmt.Errorf("%w: certificate %s already exists", ErrConflict, certificate.SerialNumber)
+	}
+	for _, stored := range m.certificates[certificate.DeviceID] {
+		if stored.KeyVersion == certificate.KeyVersion {
+			return fmt.Errorf("%w: key version %d of device %s already has a certificate", ErrConflict, certificate.KeyVersion, certificate.DeviceID)
+		}
+	}
+	return nil
+}
+
+// setCertificate adds the certificate in the order of the key versions and indexes its serial number.
+// Callers must hold the mutex.
+func (m *DeviceStorage) setCertificate(certificate *domain.DeviceCertificate) {
+	clone := *certificate
+	certificates := append(m.certificates[clone.DeviceID], &clone)
+	for i := len(certificates) - 1; i > 0 && certificates[i-1].KeyVersion > clone.KeyVersion; i-- {
+		certificates[i], certificates[i-1] = certificates[i-1], certificates[i]
+	}
+	m.certificates[clone.DeviceID] = certificates
+	m.serialNumbers[clone.SerialNumber] = &clone
+}
+
+// ListCertificates retrieves the certificates of a device from memory storage.
+func (m *DeviceStorage) ListCertificates(ctx context.Context, deviceID string) ([]*domain.DeviceCertificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if _, ok := m.devices[deviceID]; !ok {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	certificates := make([]*domain.DeviceCertificate, 0, len(m.certificates[deviceID]))
+	for _, certificate := range m.certificates[deviceID] {
+		clone := *certificate
+		certificates = append(certificates, &clone)
+	}
+	return certificates, nil
+}
+
+// ListRevokedCertificates retrieves the revoked certificates of all devices from memory storage.
+func (m *DeviceStorage) ListRevokedCertificates(ctx context.Context) ([]*domain.DeviceCertificate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	certificates := make([]*domain.DeviceCertificate, 0)
+	for _, certificate := range m.serialNumbers {
+		if certificate.RevokedAt != nil {
+			clone := *certificate
+			certificates = append(certificates, &clone)
+		}
+	}
+	sort.Slice(certificates, func(i, j int) bool {
+		if !certificates[i].RevokedAt.Equal(*certificates[j].RevokedAt) {
+			return certificates[i].RevokedAt.Before(*certificates[j].RevokedAt)
+		}
+		return certificates[i].SerialNumber < certificates[j].SerialNumber
+	})
+	return certificates, nil
+}
+
+// RevokeCertificate marks a certificate of a device as revoked in memory storage.
+func (m *DeviceStorage) RevokeCertificate(ctx context.Context, deviceID string, serialNumber string, revokedAt time.Time, reason string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	certificate, err := m.revocableCertificate(deviceID, serialNumber)
+	if err != nil {
+		return err
+	}
+	certificate.RevokedAt = &revokedAt
+	certificate.RevocationReason = reason
+	return nil
+}
+
+// revocableCertificate looks up a certificate of a device that has not been revoked yet.
+// Callers must hold the mutex.
+func (m *DeviceStorage) revocableCertificate(deviceID string, serialNumber string) (*domain.DeviceCertificate, error) {
+	certificate, ok := m.serialNumbers[serialNumber]
+	if !ok || certificate.DeviceID != deviceID {
+		return nil, fmt.Errorf("%w: certificate %s of device %s", ErrNotFound, serialNumber, deviceID)
+	}
+	if certificate.RevokedAt != nil {
+		return nil, fmt.Errorf("%w: certificate %s has already been revoked", ErrConflict, serialNumber)
+	}
+	return certificate, nil
 }
 
 // GetSignatureDevice retrieves a signature device by ID from memory storage.
-func (m *DeviceStorage) GetSignatureDevice(id string) (*domain.InternalSignatureDevice, error) {
+func (m *DeviceStorage) GetSignatureDevice(ctx context.Context, id string) (*domain.InternalSignatureDevice, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
 	device, ok := m.devices[id]
 	if !ok {
-		return nil, errors.New("device not found")
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, id)
 	}
-	return device, nil
+	return device.Clone(), nil
 }
 
 // CreateSignatureDevice creates a signature device in memory storage.
-func (m *DeviceStorage) CreateSignatureDevice(device *domain.InternalSignatureDevice) error {
+func (m *DeviceStorage) CreateSignatureDevice(ctx context.Context, device *domain.InternalSignatureDevice) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	if _, exists := m.devices[device.ID]; exists {
-		return errors.New("device with the same ID already exists")
+		return fmt.Errorf("%w: device %s already exists", ErrConflict, device.ID)
+	}
+	m.devices[device.ID] = device.Clone()
+	return nil
+}
+
+// UpdatePrivateKey replaces the private key of a signature device in memory storage
+// if it is still the previous one.
+func (m *DeviceStorage) UpdatePrivateKey(ctx context.Context, deviceID string, previous []byte, privateKey []byte, keyEncryptionKeyID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stored, exists := m.devices[deviceID]
+	if !exists {
+		return fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+	if !bytes.Equal(stored.PrivateKey, previous) {
+		return fmt.Errorf("%w: the private key of device %s has changed", ErrConflict, deviceID)
 	}
-	m.devices[device.ID] = device
+	return m.setPrivateKey(deviceID, privateKey, keyEncryptionKeyID)
+}
+
+// setPrivateKey replaces the private key of a device unconditionally. Callers must hold the mutex.
+func (m *DeviceStorage) setPrivateKey(deviceID string, privateKey []byte, keyEncryptionKeyID string) error {
+	stored, exists := m.devices[deviceID]
+	if !exists {
+		return fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+	stored.PrivateKey = append([]byte(nil), privateKey...)
+	stored.KeyEncryptionKeyID = keyEncryptionKeyID
 	return nil
 }
 
 // GetAllSignatureDevices retrieves all signature devices from memory storage.
-func (m *DeviceStorage) GetAllSignatureDevices() ([]*domain.InternalSignatureDevice, error) {
+func (m *DeviceStorage) GetAllSignatureDevices(ctx context.Context) ([]*domain.InternalSignatureDevice, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
 	devices := make([]*domain.InternalSignatureDevice, 0, len(m.devices))
 	for _, device := range m.devices {
-		devices = append(devices, device)
+		devices = append(devices, device.Clone())
 	}
 	return devices, nil
 }
+
+// WithDeviceTx runs fn as a unit of work on a device in memory storage. The signatures inserted, status
+// changes, label updates and key rotations made by fn are buffered and applied together once fn returns nil.
+func (m *DeviceStorage) WithDeviceTx(ctx context.Context, id string, fn func(tx DeviceTx) error) error {
+	unlock := m.locks.lock(id)
+	defer unlock()
+
+	device, err := m.GetSignatureDevice(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx := &memoryDeviceTx{ctx: ctx, device: device, state: m}
+	err = fn(tx)
+	if err != nil || len(tx.changes) == 0 {
+		return err
+	}
+	return m.applyChanges(id, tx.changes)
+}
+
+// deviceChange is a single write of a unit of work on a device, exactly one of its fields is set.
+type deviceChange struct {
+	SignatureRecord *domain.SignatureRecord    `json:"signatureRecord,omitempty"`
+	StatusChange    *domain.DeviceStatusChange `json:"statusChange,omitempty"`
+	KeyRotation     *domain.KeyRotation        `json:"keyRotation,omitempty"`
+	LabelChange     *labelChange               `json:"labelChange,omitempty"`
+}
+
+// labelChange sets the label of a device, a nil label removes it.
+type labelChange struct {
+	Label *string `json:"label"`
+}
+
+// applyChanges applies the writes of a unit of work on a device in memory storage in their order,
+// either all of them or none.
+func (m *DeviceStorage) applyChanges(deviceID string, changes []*deviceChange) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.checkChanges(deviceID, changes)
+	if err != nil {
+		return err
+	}
+	m.setChanges(deviceID, changes)
+	return nil
+}
+
+// checkChanges reports whether the writes of a unit of work can be applied to a device. Every write must
+// continue the state left by the previous ones: a signature the counter of the device, a status change its
+// status and a key rotation its current key, which ends with its last signature. Callers must hold the mutex.
+func (m *DeviceStorage) checkChanges(deviceID string, changes []*deviceChange) error {
+	stored, ok := m.devices[deviceID]
+	if !ok {
+		return fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+
+	device := stored.Clone()
+	for _, change := range changes {
+		switch {
+		case change.SignatureRecord != nil:
+			record := change.SignatureRecord
+			if record.Counter != device.SignatureCounter {
+				return fmt.Errorf("%w: signature counter %d has already been used", ErrConflict, record.Counter)
+			}
+			device.RecordSignature(record.Signature)
+		case change.StatusChange != nil:
+			if device.CurrentStatus() != change.StatusChange.FromStatus {
+				return fmt.Errorf("%w: device %s is no longer %s", ErrConflict, deviceID, change.StatusChange.FromStatus)
+			}
+			device.Status = change.StatusChange.ToStatus
+		case change.KeyRotation != nil:
+			retired := change.KeyRotation.Retired
+			if !bytes.Equal(device.PublicKey, retired.PublicKey) {
+				return fmt.Errorf("%w: the key of device %s has changed", ErrConflict, deviceID)
+			}
+			if *retired.ToCounter != device.SignatureCounter-1 {
+				return fmt.Errorf("%w: signature %d is not the last signature of device %s", ErrConflict, *retired.ToCounter, deviceID)
+			}
+			device.PublicKey = change.KeyRotation.PublicKey
+		case change.LabelChange != nil:
+		default:
+			return fmt.Errorf("empty change of device %s", deviceID)
+		}
+	}
+	return nil
+}
+
+// setChanges applies the checked writes of a unit of work to a device. It sets the sequence of the
+// status changes and the version and first counter of the retired keys. Callers must hold the mutex.
+func (m *DeviceStorage) setChanges(deviceID string, changes []*deviceChange) {
+	device := m.devices[deviceID]
+	for _, change := range changes {
+		switch {
+		case change.SignatureRecord != nil:
+			clone := *change.SignatureRecord
+			device.RecordSignature(clone.Signature)
+			m.signatures[deviceID] = append(m.signatures[deviceID], &clone)
+			m.indexIdempotencyKey(&clone)
+		case change.StatusChange != nil:
+			change.StatusChange.Sequence = len(m.history[deviceID]) + 1
+			clone := *change.StatusChange
+			device.Status = clone.ToStatus
+			m.history[deviceID] = append(m.history[deviceID], &clone)
+		case change.KeyRotation != nil:
+			rotation := change.KeyRotation
+			retired := rotation.Retired
+			keys := m.keys[deviceID]
+			retired.Version = len(keys) + 1
+			retired.FromCounter = 0
+			if len(keys) > 0 {
+				retired.FromCounter = *keys[len(keys)-1].ToCounter + 1
+			}
+			clone := *retired
+			m.keys[deviceID] = append(keys, &clone)
+
+			device.PublicKey = rotation.PublicKey
+			device.PrivateKey = rotation.PrivateKey
+			device.KeyEncryptionKeyID = rotation.KeyEncryptionKeyID
+			device.KeyHandle = rotation.KeyHandle
+		case change.LabelChange != nil:
+			if label := change.LabelChange.Label; label != nil {
+				clone := *label
+				device.Label = &clone
+			} else {
+				device.Label = nil
+			}
+		}
+	}
+}
+
+// memoryDeviceTx is the DeviceTx of the storages that keep their state in memory. It buffers the
+// writes of the unit of work in their order.
+type memoryDeviceTx struct {
+	ctx     context.Context
+	device  *domain.InternalSignatureDevice
+	state   *DeviceStorage
+	changes []*deviceChange
+}
+
+func (tx *memoryDeviceTx) Device() *domain.InternalSignatureDevice {
+	return tx.device
+}
+
+// InsertSignature buffers the signature record until the unit of work completes.
+func (tx *memoryDeviceTx) InsertSignature(record *domain.SignatureRecord) error {
+	record.DeviceID = tx.device.ID
+	record.Counter = tx.device.SignatureCounter
+	clone := *record
+	tx.changes = append(tx.changes, &deviceChange{SignatureRecord: &clone})
+	tx.device.RecordSignature(record.Signature)
+	return nil
+}
+
+// FindSignatureByIdempotencyKey looks up the stored signatures of the device, signatures buffered
+// by the unit of work are not considered.
+func (tx *memoryDeviceTx) FindSignatureByIdempotencyKey(key string, since time.Time) (*domain.SignatureRecord, error) {
+	return tx.state.FindSignatureByIdempotencyKey(tx.ctx, tx.device.ID, key, since)
+}
+
+// ChangeStatus buffers the status change until the unit of work completes.
+func (tx *memoryDeviceTx) ChangeStatus(change *domain.DeviceStatusChange) error {
+	tx.device.ChangeStatus(change)
+	tx.changes = append(tx.changes, &deviceChange{StatusChange: change})
+	return nil
+}
+
+// UpdateLabel buffers the label update until the unit of work completes.
+func (tx *memoryDeviceTx) UpdateLabel(label *string) error {
+	tx.device.Label = label
+	tx.changes = append(tx.changes, &deviceChange{LabelChange: &labelChange{Label: label}})
+	return nil
+}
+
+// RotateKey buffers the key rotation until the unit of work completes.
+func (tx *memoryDeviceTx) RotateKey(rotation *domain.KeyRotation) error {
+	tx.device.RotateKey(rotation)
+	tx.changes = append(tx.changes, &deviceChange{KeyRotation: rotation})
+	return nil
+}
@@ -0,0 +1,44 @@
+package persistence
+
+import "sync"
+
+// deviceLocks serializes the units of work per device, so that units of work on different
+// devices run in parallel while those on the same device run one after another.
+// The zero value is ready to use.
+type deviceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*deviceLock
+}
+
+// deviceLock is the lock of a single device, it is removed once nobody holds or waits for it.
+type deviceLock struct {
+	sync.Mutex
+	references int
+}
+
+// lock blocks until the lock of the device is acquired and returns the function releasing it.
+func (l *deviceLocks) lock(id string) func() {
+	l.mutex.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*deviceLock)
+	}
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &deviceLock{}
+		l.locks[id] = lock
+	}
+	lock.references++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		lock.references--
+		if lock.references == 0 {
+			delete(l.locks, id)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is a versioned change of the database schema.
+// Migrations are applied in order and must never be changed once released, add a new one instead.
+type migration struct {
+	version    int
+	statements []string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE devices (
+				id TEXT PRIMARY KEY,
+				algorithm TEXT NOT NULL,
+				label TEXT,
+				curve TEXT NOT NULL DEFAULT '',
+				key_size INTEGER NOT NULL DEFAULT 0,
+				signature_scheme TEXT NOT NULL DEFAULT '',
+				salt_length INTEGER NOT NULL DEFAULT 0,
+				hash_algorithm TEXT NOT NULL DEFAULT '',
+				signature_counter INTEGER NOT NULL DEFAULT 0,
+				last_signature TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL
+			)`,
+			// The private key is kept apart from the device metadata. The service seals it with a
+			// key-encryption key, whose ID is recorded in key_encryption_key_id. An empty ID marks a PEM
+			// encoded key stored in the clear before a keyring was configured, which is sealed on startup.
+			`CREATE TABLE device_keys (
+				device_id TEXT PRIMARY KEY REFERENCES devices (id),
+				public_key BLOB NOT NULL,
+				private_key BLOB NOT NULL,
+				key_encryption_key_id TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE signatures (
+				device_id TEXT NOT NULL REFERENCES devices (id),
+				counter INTEGER NOT NULL,
+				signature TEXT NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (device_id, counter)
+			)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`ALTER TABLE signatures ADD COLUMN data_to_be_signed TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE signatures ADD COLUMN signed_data TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE signatures ADD COLUMN algorithm TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX signatures_device_id_created_at ON signatures (device_id, created_at)`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			// An empty status means active, as for all devices created before lifecycle states were introduced.
+			`ALTER TABLE devices ADD COLUMN status TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE signatures ADD COLUMN kind TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE device_history (
+				device_id TEXT NOT NULL REFERENCES devices (id),
+				sequence INTEGER NOT NULL,
+				from_status TEXT NOT NULL,
+				to_status TEXT NOT NULL,
+				reason TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (device_id, sequence)
+			)`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			`ALTER TABLE signatures ADD COLUMN idempotency_key TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX signatures_idempotency_key ON signatures (idempotency_key, created_at)`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			// Keys kept in a PKCS#11 token are referenced by their handle and have an empty private key.
+			`ALTER TABLE device_keys ADD COLUMN key_handle TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			// The public keys a device signed with before its key was rotated, device_keys holds the current key.
+			`CREATE TABLE device_key_history (
+				device_id TEXT NOT NULL REFERENCES devices (id),
+				version INTEGER NOT NULL,
+				public_key BLOB NOT NULL,
+				from_counter INTEGER NOT NULL,
+				to_counter INTEGER NOT NULL,
+				retired_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (device_id, version)
+			)`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			// The certificates issued for the keys of a device, revoked ones carry their revocation time and reason.
+			`CREATE TABLE device_certificates (
+				serial_number TEXT PRIMARY KEY,
+				device_id TEXT NOT NULL REFERENCES devices (id),
+				key_version INTEGER NOT NULL,
+				certificate BLOB NOT NULL,
+				not_before TIMESTAMP NOT NULL,
+				not_after TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP,
+				revocation_reason TEXT NOT NULL DEFAULT '',
+				UNIQUE (device_id, key_version)
+			)`,
+			`CREATE INDEX device_certificates_revoked_at ON device_certificates (revoked_at)`,
+		},
+	},
+}
+
+// migrate brings the database schema to the latest version.
+// Every migration runs in its own transaction together with the update of the schema version.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	for _, m := range migrations {
+		err = applyMigration(db, m)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Checked within the transaction, so that concurrently starting instances apply it only once.
+	var applied int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+
+	for _, statement := range m.statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, m.version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,696 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"time"
+)
+
+// SQLStorage implements Storage on top of a relational database through database/sql.
+// The queries use "?" placeholders as understood by SQLite and MySQL. Private keys are stored as
+// handed over by the service, which seals them with a key-encryption key. The service refuses to use
+// the SQLite backend without one and seals the keys still stored in the clear on startup.
+type SQLStorage struct {
+	db    *sql.DB
+	locks deviceLocks
+}
+
+// NewSQLStorage creates a new instance of SQLStorage and migrates the database schema to the latest version.
+func NewSQLStorage(db *sql.DB) (*SQLStorage, error) {
+	err := migrate(db)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStorage{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+const selectDevice = `SELECT d.id, d.algorithm, d.label, d.curve, d.key_size, d.signature_scheme, d.salt_length,
+	d.hash_algorithm, d.status, d.signature_counter, d.last_signature, k.public_key, k.private_key,
+	k.key_encryption_key_id, k.key_handle
+	FROM devices d JOIN device_keys k ON k.device_id = d.id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanDevice(row rowScanner) (*domain.InternalSignatureDevice, error) {
+	var device domain.InternalSignatureDevice
+	var label sql.NullString
+	err := row.Scan(
+		&device.ID,
+		&device.Algorithm,
+		&label,
+		&device.Curve,
+		&device.KeySize,
+		&device.SignatureScheme,
+		&device.SaltLength,
+		&device.HashAlgorithm,
+		&device.Status,
+		&device.SignatureCounter,
+		&device.LastSignature,
+		&device.PublicKey,
+		&device.PrivateKey,
+		&device.KeyEncryptionKeyID,
+		&device.KeyHandle,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if label.Valid {
+		device.Label = &label.String
+	}
+	return &device, nil
+}
+
+// GetSignatureDevice retrieves a signature device by ID from the database.
+func (s *SQLStorage) GetSignatureDevice(ctx context.Context, id string) (*domain.InternalSignatureDevice, error) {
+	device, err := scanDevice(s.db.QueryRowContext(ctx, selectDevice+` WHERE d.id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: device %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device: %w", err)
+	}
+	return device, nil
+}
+
+// CreateSignatureDevice stores a signature device together with its key pair in the database.
+func (s *SQLStorage) CreateSignatureDevice(ctx context.Context, device *domain.InternalSignatureDevice) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM devices WHERE id = ?`, device.ID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return fmt.Errorf("%w: device %s already exists", ErrConflict, device.ID)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO devices (id, algorithm, label, curve, key_size, signature_scheme, salt_length,
+		hash_algorithm, status, signature_counter, last_signature, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		device.ID,
+		device.Algorithm,
+		device.Label,
+		device.Curve,
+		device.KeySize,
+		device.SignatureScheme,
+		device.SaltLength,
+		device.HashAlgorithm,
+		device.Status,
+		device.SignatureCounter,
+		device.LastSignature,
+		time.Now().UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert device: %w", err)
+	}
+
+	// Devices with a key in a PKCS#11 token have no private key, which is stored as an empty one.
+	privateKey := device.PrivateKey
+	if privateKey == nil {
+		privateKey = []byte{}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO device_keys (device_id, public_key, private_key, key_encryption_key_id, key_handle)
+		VALUES (?, ?, ?, ?, ?)`, device.ID, device.PublicKey, privateKey, device.KeyEncryptionKeyID, device.KeyHandle)
+	if err != nil {
+		return fmt.Errorf("failed to insert device keys: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// UpdatePrivateKey replaces the private key of a signature device in the database
+// if it is still the previous one.
+func (s *SQLStorage) UpdatePrivateKey(ctx context.Context, deviceID string, previous []byte, privateKey []byte, keyEncryptionKeyID string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE device_keys SET private_key = ?, key_encryption_key_id = ?
+		WHERE device_id = ? AND private_key = ?`, privateKey, keyEncryptionKeyID, deviceID, previous)
+	if err != nil {
+		return fmt.Errorf("failed to update private key: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		if _, err := s.GetSignatureDevice(ctx, deviceID); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: the private key of device %s has changed", ErrConflict, deviceID)
+	}
+	return nil
+}
+
+// GetAllSignatureDevices retrieves all signature devices from the database.
+func (s *SQLStorage) GetAllSignatureDevices(ctx context.Context) ([]*domain.InternalSignatureDevice, error) {
+	rows, err := s.db.QueryContext(ctx, selectDevice+` ORDER BY d.created_at, d.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load devices: %w", err)
+	}
+	defer rows.Close()
+
+	devices := make([]*domain.InternalSignatureDevice, 0)
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load devices: %w", err)
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// GetLastSignature retrieves the last signature of a device from the database.
+// It returns an empty string if the device has not signed anything yet.
+func (s *SQLStorage) GetLastSignature(ctx context.Context, deviceID string) (string, error) {
+	var lastSignature string
+	err := s.db.QueryRowContext(ctx, `SELECT last_signature FROM devices WHERE id = ?`, deviceID).Scan(&lastSignature)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%w: device %s", ErrNotFound, deviceID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load last signature: %w", err)
+	}
+	return lastSignature, nil
+}
+
+const selectSignature = `SELECT device_id, counter, kind, data_to_be_signed, signed_data, signature, algorithm,
+	idempotency_key, created_at FROM signatures`
+
+func scanSignature(row rowScanner) (*domain.SignatureRecord, error) {
+	var record domain.SignatureRecord
+	err := row.Scan(
+		&record.DeviceID,
+		&record.Counter,
+		&record.Kind,
+		&record.DataToBeSigned,
+		&record.SignedData,
+		&record.Signature,
+		&record.Algorithm,
+		&record.IdempotencyKey,
+		&record.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	record.CreatedAt = record.CreatedAt.UTC()
+	return &record, nil
+}
+
+// ListSignatures retrieves the signatures of a device that match the filter from the database
+// ordered by their counter.
+func (s *SQLStorage) ListSignatures(ctx context.Context, deviceID string, filter domain.SignatureFilter) ([]*domain.SignatureRecord, error) {
+	// Distinguishes a device without signatures from an unknown device.
+	_, err := s.GetLastSignature(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := selectSignature + ` WHERE device_id = ?`
+	args := []interface{}{deviceID}
+	if filter.FromCounter != nil {
+		query += ` AND counter >= ?`
+		args = append(args, *filter.FromCounter)
+	}
+	if filter.ToCounter != nil {
+		query += ` AND counter <= ?`
+		args = append(args, *filter.ToCounter)
+	}
+	if !filter.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, filter.Until.UTC())
+	}
+	query += ` ORDER BY counter`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signatures: %w", err)
+	}
+	defer rows.Close()
+
+	records := make([]*domain.SignatureRecord, 0)
+	for rows.Next() {
+		record, err := scanSignature(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signatures: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// GetSignature retrieves the signature a device created with the given counter value from the database.
+func (s *SQLStorage) GetSignature(ctx context.Context, deviceID string, counter int32) (*domain.SignatureRecord, error) {
+	record, err := scanSignature(s.db.QueryRowContext(ctx, selectSignature+` WHERE device_id = ? AND counter = ?`,
+		deviceID, counter))
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = s.GetLastSignature(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: signature %d of device %s", ErrNotFound, counter, deviceID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signature: %w", err)
+	}
+	return record, nil
+}
+
+// PruneIdempotencyKeys does nothing, the keys are looked up in the signatures table, which keeps every signature.
+func (s *SQLStorage) PruneIdempotencyKeys(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+// FindSignatureByIdempotencyKey retrieves the latest signature created with the idempotency key since the
+// given time from the database, of the device with the given ID or of any device if the ID is empty.
+func (s *SQLStorage) FindSignatureByIdempotencyKey(ctx context.Context, deviceID string, key string, since time.Time) (*domain.SignatureRecord, error) {
+	query := selectSignature + ` WHERE idempotency_key = ? AND created_at >= ?`
+	args := []interface{}{key, since.UTC()}
+	if deviceID != "" {
+		query += ` AND device_id = ?`
+		args = append(args, deviceID)
+	}
+	query += ` ORDER BY created_at DESC LIMIT 1`
+
+	record, err := scanSignature(s.db.QueryRowContext(ctx, query, args...))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: signature with idempotency key %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signature: %w", err)
+	}
+	return record, nil
+}
+
+// ListDeviceHistory retrieves the lifecycle state changes of a device from the database.
+func (s *SQLStorage) ListDeviceHistory(ctx context.Context, deviceID string) ([]*domain.DeviceStatusChange, error) {
+	_, err := s.GetLastSignature(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT device_id, sequence, from_status, to_status, reason, created_at
+		FROM device_history WHERE device_id = ? ORDER BY sequence`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device history: %w", err)
+	}
+	defer rows.Close()
+
+	history := make([]*domain.DeviceStatusChange, 0)
+	for rows.Next() {
+		var change domain.DeviceStatusChange
+		err = rows.Scan(&change.DeviceID, &change.Sequence, &change.FromStatus, &change.ToStatus, &change.Reason, &change.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load device history: %w", err)
+		}
+		change.CreatedAt = change.CreatedAt.UTC()
+		history = append(history, &change)
+	}
+	return history, rows.Err()
+}
+
+// ListDeviceKeys retrieves the retired keys of a device from the database.
+func (s *SQLStorage) ListDeviceKeys(ctx context.Context, deviceID string) ([]*domain.DeviceKey, error) {
+	_, err := s.GetLastSignature(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT device_id, version, public_key, from_counter, to_counter, retired_at
+		FROM device_key_history WHERE device_id = ? ORDER BY version`, deviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := make([]*domain.DeviceKey, 0)
+	for rows.Next() {
+		var key domain.DeviceKey
+		var toCounter int32
+		var retiredAt time.Time
+		err = rows.Scan(&key.DeviceID, &key.Version, &key.PublicKey, &key.FromCounter, &toCounter, &retiredAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load device keys: %w", err)
+		}
+		retiredAt = retiredAt.UTC()
+		key.ToCounter = &toCounter
+		key.RetiredAt = &retiredAt
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+// InsertCertificate stores a certificate issued for a key of a device in the database.
+func (s *SQLStorage) InsertCertificate(ctx context.Context, certificate *domain.DeviceCertificate) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM devices WHERE id = ?`, certificate.DeviceID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("%w: device %s", ErrNotFound, certificate.DeviceID)
+	}
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM device_certificates WHERE serial_number = ?
+		OR (device_id = ? AND key_version = ?)`, certificate.SerialNumber, certificate.DeviceID, certificate.KeyVersion).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return fmt.Errorf("%w: key version %d of device %s already has a certificate", ErrConflict, certificate.KeyVersion, certificate.DeviceID)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO device_certificates (serial_number, device_id, key_version, certificate,
+		not_before, not_after, revoked_at, revocation_reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		certificate.SerialNumber,
+		certificate.DeviceID,
+		certificate.KeyVersion,
+		certificate.Certificate,
+		certificate.NotBefore,
+		certificate.NotAfter,
+		certificate.RevokedAt,
+		certificate.RevocationReason,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert certificate: %w", err)
+	}
+	return tx.Commit()
+}
+
+const selectCertificate = `SELECT serial_number, device_id, key_version, certificate, not_before, not_after,
+	revoked_at, revocation_reason FROM device_certificates`
+
+func scanCertificate(row rowScanner) (*domain.DeviceCertificate, error) {
+	var certificate domain.DeviceCertificate
+	var revokedAt sql.NullTime
+	err := row.Scan(
+		&certificate.SerialNumber,
+		&certificate.DeviceID,
+		&certificate.KeyVersion,
+		&certificate.Certificate,
+		&certificate.NotBefore,
+		&certificate.NotAfter,
+		&revokedAt,
+		&certificate.RevocationReason,
+	)
+	if err != nil {
+		return nil, err
+	}
+	certificate.NotBefore = certificate.NotBefore.UTC()
+	certificate.NotAfter = certificate.NotAfter.UTC()
+	if revokedAt.Valid {
+		revoked := revokedAt.Time.UTC()
+		certificate.RevokedAt = &revoked
+	}
+	return &certificate, nil
+}
+
+// queryCertificates loads the certificates selected by the query.
+func (s *SQLStorage) queryCertificates(ctx context.Context, query string, args ...interface{}) ([]*domain.DeviceCertificate, error) {
+	rows, err := s.db.QueryContext(ctx, selectCertificate+query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificates: %w", err)
+	}
+	defer rows.Close()
+
+	certificates := make([]*domain.DeviceCertificate, 0)
+	for rows.Next() {
+		certificate, err := scanCertificate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load certificates: %w", err)
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, rows.Err()
+}
+
+// ListCertificates retrieves the certificates of a device from the database.
+func (s *SQLStorage) ListCertificates(ctx context.Context, deviceID string) ([]*domain.DeviceCertificate, error) {
+	_, err := s.GetLastSignature(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return s.queryCertificates(ctx, ` WHERE device_id = ? ORDER BY key_version`, deviceID)
+}
+
+// ListRevokedCertificates retrieves the revoked certificates of all devices from the database.
+func (s *SQLStorage) ListRevokedCertificates(ctx context.Context) ([]*domain.DeviceCertificate, error) {
+	return s.queryCertificates(ctx, ` WHERE revoked_at IS NOT NULL ORDER BY revoked_at, serial_number`)
+}
+
+// RevokeCertificate marks a certificate of a device as revoked in the database, unless it already is.
+func (s *SQLStorage) RevokeCertificate(ctx context.Context, deviceID string, serialNumber string, revokedAt time.Time, reason string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE device_certificates SET revoked_at = ?, revocation_reason = ?
+		WHERE serial_number = ? AND device_id = ? AND revoked_at IS NULL`, revokedAt, reason, serialNumber, deviceID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke certificate: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		certificates, err := s.queryCertificates(ctx, ` WHERE serial_number = ? AND device_id = ?`, serialNumber, deviceID)
+		if err != nil {
+			return err
+		}
+		if len(certificates) == 0 {
+			return fmt.Errorf("%w: certificate %s of device %s", ErrNotFound, serialNumber, deviceID)
+		}
+		return fmt.Errorf("%w: certificate %s has already been revoked", ErrConflict, serialNumber)
+	}
+	return nil
+}
+
+// WithDeviceTx runs fn while holding the lock of the device within this process. The signatures
+// inserted, status changes, label updates and key rotations made by fn are buffered and written in one short database transaction
+// once fn returns nil, so that signing does not hold a database lock. If another process advanced
+// the counter or changed the status in the meantime, the transaction is rolled back and ErrConflict returned.
+func (s *SQLStorage) WithDeviceTx(ctx context.Context, id string, fn func(tx DeviceTx) error) error {
+	unlock := s.locks.lock(id)
+	defer unlock()
+
+	device, err := s.GetSignatureDevice(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	tx := &sqlDeviceTx{ctx: ctx, storage: s, device: device}
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	if len(tx.signatures) == 0 && len(tx.statusChanges) == 0 && len(tx.keyRotations) == 0 && !tx.labelChanged {
+		return nil
+	}
+	return s.commitDeviceTx(ctx, tx)
+}
+
+// commitDeviceTx stores the signature records, status changes and key rotations of a unit of work within
+// one transaction. The counter is only advanced, the status only changed and the key only replaced if they
+// still have the expected value, so concurrent writers can never store two signatures for the same counter.
+func (s *SQLStorage) commitDeviceTx(ctx context.Context, deviceTx *sqlDeviceTx) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, record := range deviceTx.signatures {
+		result, err := tx.ExecContext(ctx, `UPDATE devices SET signature_counter = signature_counter + 1, last_signature = ?
+			WHERE id = ? AND signature_counter = ?`, record.Signature, record.DeviceID, record.Counter)
+		if err != nil {
+			return fmt.Errorf("failed to advance signature counter: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return fmt.Errorf("%w: signature counter %d has already been used", ErrConflict, record.Counter)
+		}
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO signatures (device_id, counter, kind, data_to_be_signed, signed_data,
+			signature, algorithm, idempotency_key, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			record.DeviceID,
+			record.Counter,
+			record.Kind,
+			record.DataToBeSigned,
+			record.SignedData,
+			record.Signature,
+			record.Algorithm,
+			record.IdempotencyKey,
+			record.CreatedAt.UTC(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert signature: %w", err)
+		}
+	}
+
+	for _, change := range deviceTx.statusChanges {
+		// Devices stored before lifecycle states were introduced have an empty status and are active.
+		result, err := tx.ExecContext(ctx, `UPDATE devices SET status = ?
+			WHERE id = ? AND (status = ? OR (status = '' AND ? = ?))`,
+			change.ToStatus, change.DeviceID, change.FromStatus, change.FromStatus, domain.DeviceStatusActive)
+		if err != nil {
+			return fmt.Errorf("failed to change device status: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return fmt.Errorf("%w: device %s is no longer %s", ErrConflict, change.DeviceID, change.FromStatus)
+		}
+
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) + 1 FROM device_history WHERE device_id = ?`,
+			change.DeviceID).Scan(&change.Sequence)
+		if err != nil {
+			return fmt.Errorf("failed to load device history: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO device_history (device_id, sequence, from_status, to_status, reason,
+			created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			change.DeviceID,
+			change.Sequence,
+			change.FromStatus,
+			change.ToStatus,
+			change.Reason,
+			change.CreatedAt.UTC(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert device history: %w", err)
+		}
+	}
+
+	if deviceTx.labelChanged {
+		_, err = tx.ExecContext(ctx, `UPDATE devices SET label = ? WHERE id = ?`, deviceTx.label, deviceTx.device.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update device: %w", err)
+		}
+	}
+
+	for _, rotation := range deviceTx.keyRotations {
+		retired := rotation.Retired
+		privateKey := rotation.PrivateKey
+		if privateKey == nil {
+			privateKey = []byte{}
+		}
+		result, err := tx.ExecContext(ctx, `UPDATE device_keys SET public_key = ?, private_key = ?,
+			key_encryption_key_id = ?, key_handle = ? WHERE device_id = ? AND public_key = ?`,
+			rotation.PublicKey, privateKey, rotation.KeyEncryptionKeyID, rotation.KeyHandle, retired.DeviceID, retired.PublicKey)
+		if err != nil {
+			return fmt.Errorf("failed to rotate device key: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return fmt.Errorf("%w: the key of device %s has changed", ErrConflict, retired.DeviceID)
+		}
+
+		var lastCounter sql.NullInt32
+		err = tx.QueryRowContext(ctx, `SELECT COUNT(*) + 1, MAX(to_counter) FROM device_key_history WHERE device_id = ?`,
+			retired.DeviceID).Scan(&retired.Version, &lastCounter)
+		if err != nil {
+			return fmt.Errorf("failed to load device keys: %w", err)
+		}
+		retired.FromCounter = 0
+		if lastCounter.Valid {
+			retired.FromCounter = lastCounter.Int32 + 1
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO device_key_history (device_id, version, public_key, from_counter,
+			to_counter, retired_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			retired.DeviceID,
+			retired.Version,
+			retired.PublicKey,
+			retired.FromCounter,
+			*retired.ToCounter,
+			retired.RetiredAt.UTC(),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert device key: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// sqlDeviceTx is the DeviceTx of SQLStorage.
+type sqlDeviceTx struct {
+	ctx           context.Context
+	storage       *SQLStorage
+	device        *domain.InternalSignatureDevice
+	signatures    []*domain.SignatureRecord
+	statusChanges []*domain.DeviceStatusChange
+	keyRotations  []*domain.KeyRotation
+	label         *string
+	labelChanged  bool
+}
+
+func (t *sqlDeviceTx) Device() *domain.InternalSignatureDevice {
+	return t.device
+}
+
+// InsertSignature buffers the signature record until the unit of work completes.
+func (t *sqlDeviceTx) InsertSignature(record *domain.SignatureRecord) error {
+	record.DeviceID = t.device.ID
+	record.Counter = t.device.SignatureCounter
+	clone := *record
+	t.signatures = append(t.signatures, &clone)
+	t.device.RecordSignature(record.Signature)
+	return nil
+}
+
+// FindSignatureByIdempotencyKey looks up the stored signatures of the device, signatures buffered
+// by the unit of work are not considered.
+func (t *sqlDeviceTx) FindSignatureByIdempotencyKey(key string, since time.Time) (*domain.SignatureRecord, error) {
+	return t.storage.FindSignatureByIdempotencyKey(t.ctx, t.device.ID, key, since)
+}
+
+// ChangeStatus buffers the status change until the unit of work completes.
+func (t *sqlDeviceTx) ChangeStatus(change *domain.DeviceStatusChange) error {
+	t.device.ChangeStatus(change)
+	t.statusChanges = append(t.statusChanges, change)
+	return nil
+}
+
+// UpdateLabel buffers the label update until the unit of work completes.
+func (t *sqlDeviceTx) UpdateLabel(label *string) error {
+	t.device.Label = label
+	t.label = label
+	t.labelChanged = true
+	return nil
+}
+
+// RotateKey buffers the key rotation until the unit of work completes.
+func (t *sqlDeviceTx) RotateKey(rotation *domain.KeyRotation) error {
+	t.device.RotateKey(rotation)
+	t.keyRotations = append(t.keyRotations, rotation)
+	return nil
+}
@@ -0,0 +1,28 @@
+package persistence
+
+import (
+	"database/sql"
+	"net/url"
+
+	// Registers the "sqlite3" database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSQLiteStorage opens the SQLite database file at path, creating it if it does not exist,
+// and returns a SQLStorage on top of it.
+func OpenSQLiteStorage(path string) (*SQLStorage, error) {
+	// Write transactions take the database lock immediately, so that concurrent writers wait
+	// for each other instead of failing when upgrading a read lock.
+	dsn := "file:" + url.PathEscape(path) + "?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := NewSQLStorage(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
@@ -0,0 +1,15 @@
+package persistence
+
+import "github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+
+// The storage interface lives in the domain package, so that the domain services can depend on it
+// without importing the implementations. The aliases keep it addressable from the persistence layer.
+type (
+	Storage  = domain.Storage
+	DeviceTx = domain.DeviceTx
+)
+
+var (
+	ErrNotFound = domain.ErrNotFound
+	ErrConflict = domain.ErrConflict
+)
@@ -0,0 +1,675 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fiskaly/coding-challenges/signing-service-challenge/domain"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+// sign stores a signature through a unit of work, like the sign flow of the API does.
+func sign(ctx context.Context, storage Storage, id string, signature string) error {
+	return signAt(ctx, storage, id, signature, testTime)
+}
+
+// testTime is the default creation time of the test signatures.
+var testTime = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func signAt(ctx context.Context, storage Storage, id string, signature string, createdAt time.Time) error {
+	return storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+		return tx.InsertSignature(newTestSignature(signature, createdAt))
+	})
+}
+
+func newTestSignature(signature string, createdAt time.Time) *domain.SignatureRecord {
+	return &domain.SignatureRecord{
+		DataToBeSigned: "data",
+		SignedData:     "signed data",
+		Signature:      signature,
+		Algorithm:      "ECC",
+		CreatedAt:      createdAt,
+	}
+}
+
+func newTestDevice(id string) *domain.InternalSignatureDevice {
+	label := "Test device"
+	return &domain.InternalSignatureDevice{
+		ID:            id,
+		Algorithm:     "ECC",
+		Label:         &label,
+		Curve:         "P-384",
+		HashAlgorithm: "SHA-384",
+		PublicKey:     []byte("public"),
+		PrivateKey:    []byte("private"),
+	}
+}
+
+func newSQLiteTestStorage(t *testing.T) *SQLStorage {
+	storage, err := OpenSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		storage.Close()
+	})
+	return storage
+}
+
+func newFileTestStorage(t *testing.T) *FileStorage {
+	storage, err := OpenFileStorage(t.TempDir(), DefaultSnapshotInterval)
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		storage.Close()
+	})
+	return storage
+}
+
+// storages returns a fresh instance of every Storage implementation.
+func storages(t *testing.T) map[string]Storage {
+	return map[string]Storage{
+		"memory": NewSignatureDeviceStorage(),
+		"file":   newFileTestStorage(t),
+		"sqlite": newSQLiteTestStorage(t),
+	}
+}
+
+func TestStorageCreateAndGetDevice(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			device := newTestDevice("device-1")
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, device))
+			assert.ErrorIs(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")), ErrConflict)
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, device, stored)
+
+			// Changing a returned device must not change the stored one.
+			stored.SignatureCounter = 42
+			*stored.Label = "Changed"
+			stored, err = storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, device, stored)
+
+			_, err = storage.GetSignatureDevice(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+			devices, err := storage.GetAllSignatureDevices(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, devices, 2)
+		})
+	}
+}
+
+func TestStorageKeepsKeyHandle(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			device := newTestDevice("device-1")
+			device.PrivateKey = nil
+			device.KeyHandle = "pkcs11:token=signing;id=%01%02"
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, device))
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, device.KeyHandle, stored.KeyHandle)
+			assert.Empty(t, stored.PrivateKey)
+		})
+	}
+}
+
+func TestStorageUpdateDeviceLabel(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+
+			updateLabel := func(id string, label *string) error {
+				return storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+					return tx.UpdateLabel(label)
+				})
+			}
+			label := "Renamed"
+			assert.NoError(t, updateLabel("device-1", &label))
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "Renamed", *stored.Label)
+			assert.Equal(t, int32(0), stored.SignatureCounter)
+
+			assert.NoError(t, updateLabel("device-1", nil))
+			stored, err = storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Nil(t, stored.Label)
+
+			assert.ErrorIs(t, updateLabel("unknown", &label), ErrNotFound)
+		})
+	}
+}
+
+func TestStorageUpdatePrivateKey(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			device := newTestDevice("device-1")
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, device))
+
+			assert.NoError(t, storage.UpdatePrivateKey(ctx, "device-1", device.PrivateKey, []byte("sealed"), "kek-1"))
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("sealed"), stored.PrivateKey)
+			assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+			assert.Equal(t, device.PublicKey, stored.PublicKey)
+
+			// The key is only replaced if it has not changed in the meantime.
+			err = storage.UpdatePrivateKey(ctx, "device-1", device.PrivateKey, []byte("stale"), "kek-2")
+			assert.ErrorIs(t, err, ErrConflict)
+			stored, err = storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "kek-1", stored.KeyEncryptionKeyID)
+
+			err = storage.UpdatePrivateKey(ctx, "unknown", nil, []byte("sealed"), "kek-1")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorageDeviceTxAdvancesCounter(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			lastSignature, err := storage.GetLastSignature(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "", lastSignature)
+
+			assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+			err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				assert.Equal(t, int32(1), tx.Device().SignatureCounter)
+				assert.Equal(t, "first", tx.Device().LastSignature)
+				err := tx.InsertSignature(newTestSignature("second", testTime))
+				assert.Equal(t, int32(2), tx.Device().SignatureCounter)
+				return err
+			})
+			assert.NoError(t, err)
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(2), stored.SignatureCounter)
+			assert.Equal(t, "second", stored.LastSignature)
+			lastSignature, err = storage.GetLastSignature(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, "second", lastSignature)
+
+			assert.ErrorIs(t, sign(ctx, storage, "unknown", "signature"), ErrNotFound)
+			_, err = storage.GetLastSignature(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorageDeviceTxChangesStatus(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			history, err := storage.ListDeviceHistory(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Empty(t, history)
+
+			for _, status := range []string{domain.DeviceStatusSuspended, domain.DeviceStatusActive} {
+				err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+					return tx.ChangeStatus(&domain.DeviceStatusChange{ToStatus: status, Reason: "test", CreatedAt: testTime})
+				})
+				assert.NoError(t, err)
+			}
+			err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				err := tx.InsertSignature(newTestSignature("closing", testTime))
+				if err != nil {
+					return err
+				}
+				return tx.ChangeStatus(&domain.DeviceStatusChange{ToStatus: domain.DeviceStatusDecommissioned, CreatedAt: testTime})
+			})
+			assert.NoError(t, err)
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, domain.DeviceStatusDecommissioned, stored.Status)
+			assert.Equal(t, int32(1), stored.SignatureCounter)
+
+			history, err = storage.ListDeviceHistory(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, []*domain.DeviceStatusChange{
+				{DeviceID: "device-1", Sequence: 1, FromStatus: "active", ToStatus: "suspended", Reason: "test", CreatedAt: testTime},
+				{DeviceID: "device-1", Sequence: 2, FromStatus: "suspended", ToStatus: "active", Reason: "test", CreatedAt: testTime},
+				{DeviceID: "device-1", Sequence: 3, FromStatus: "active", ToStatus: "decommissioned", CreatedAt: testTime},
+			}, history)
+
+			_, err = storage.ListDeviceHistory(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+// rotateKey signs a key transition record and replaces the key pair in one unit of work,
+// like the key rotation of the service does.
+func rotateKey(storage Storage, id string, publicKey string) error {
+	return storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+		err := tx.InsertSignature(newTestSignature("transition to "+publicKey, testTime))
+		if err != nil {
+			return err
+		}
+		return tx.RotateKey(&domain.KeyRotation{
+			PublicKey:  []byte(publicKey),
+			PrivateKey: []byte("private " + publicKey),
+			CreatedAt:  testTime,
+		})
+	})
+}
+
+func TestStorageDeviceTxRotatesKey(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			keys, err := storage.ListDeviceKeys(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+
+			assert.NoError(t, sign(ctx, storage, "device-1", "signature-0"))
+			assert.NoError(t, rotateKey(storage, "device-1", "public-2"))
+			assert.NoError(t, sign(ctx, storage, "device-1", "signature-2"))
+			assert.NoError(t, rotateKey(storage, "device-1", "public-3"))
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("public-3"), stored.PublicKey)
+			assert.Equal(t, []byte("private public-3"), stored.PrivateKey)
+			assert.Equal(t, int32(4), stored.SignatureCounter)
+
+			first, second := int32(1), int32(3)
+			keys, err = storage.ListDeviceKeys(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, []*domain.DeviceKey{
+				{DeviceID: "device-1", Version: 1, PublicKey: []byte("public"), FromCounter: 0, ToCounter: &first, RetiredAt: &testTime},
+				{DeviceID: "device-1", Version: 2, PublicKey: []byte("public-2"), FromCounter: 2, ToCounter: &second, RetiredAt: &testTime},
+			}, keys)
+
+			_, err = storage.ListDeviceKeys(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func newTestCertificate(deviceID string, keyVersion int) *domain.DeviceCertificate {
+	return &domain.DeviceCertificate{
+		DeviceID:     deviceID,
+		KeyVersion:   keyVersion,
+		SerialNumber: fmt.Sprintf("%s-%d", deviceID, keyVersion),
+		Certificate:  []byte("certificate"),
+		NotBefore:    testTime,
+		NotAfter:     testTime.Add(time.Hour),
+	}
+}
+
+func TestStorageCertificates(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+
+			assert.NoError(t, storage.InsertCertificate(ctx, newTestCertificate("device-1", 2)))
+			assert.NoError(t, storage.InsertCertificate(ctx, newTestCertificate("device-1", 1)))
+			assert.NoError(t, storage.InsertCertificate(ctx, newTestCertificate("device-2", 1)))
+			err := storage.InsertCertificate(ctx, newTestCertificate("device-1", 1))
+			assert.ErrorIs(t, err, ErrConflict)
+			err = storage.InsertCertificate(ctx, newTestCertificate("unknown", 1))
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			certificates, err := storage.ListCertificates(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, []*domain.DeviceCertificate{
+				newTestCertificate("device-1", 1),
+				newTestCertificate("device-1", 2),
+			}, certificates)
+
+			later := testTime.Add(time.Minute)
+			assert.NoError(t, storage.RevokeCertificate(ctx, "device-2", "device-2-1", later, domain.RevocationReasonKeyCompromise))
+			assert.NoError(t, storage.RevokeCertificate(ctx, "device-1", "device-1-1", testTime, domain.RevocationReasonSuperseded))
+			err = storage.RevokeCertificate(ctx, "device-1", "device-1-1", later, domain.RevocationReasonUnspecified)
+			assert.ErrorIs(t, err, ErrConflict)
+			err = storage.RevokeCertificate(ctx, "device-1", "device-2-1", later, domain.RevocationReasonUnspecified)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			revoked, err := storage.ListRevokedCertificates(ctx)
+			assert.NoError(t, err)
+			if assert.Len(t, revoked, 2) {
+				assert.Equal(t, "device-1-1", revoked[0].SerialNumber)
+				assert.Equal(t, testTime, *revoked[0].RevokedAt)
+				assert.Equal(t, domain.RevocationReasonSuperseded, revoked[0].RevocationReason)
+				assert.Equal(t, "device-2-1", revoked[1].SerialNumber)
+				assert.Equal(t, later, *revoked[1].RevokedAt)
+			}
+
+			_, err = storage.ListCertificates(ctx, "unknown")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorageFindSignatureByIdempotencyKey(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+			for _, id := range []string{"device-1", "device-2"} {
+				err := storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+					record := newTestSignature(id, testTime.Add(time.Duration(len(id))*time.Minute))
+					record.IdempotencyKey = "key-" + id
+					return tx.InsertSignature(record)
+				})
+				assert.NoError(t, err)
+			}
+
+			record, err := storage.FindSignatureByIdempotencyKey(ctx, "", "key-device-2", testTime)
+			assert.NoError(t, err)
+			assert.Equal(t, "device-2", record.DeviceID)
+			assert.Equal(t, "key-device-2", record.IdempotencyKey)
+
+			_, err = storage.FindSignatureByIdempotencyKey(ctx, "device-1", "key-device-2", testTime)
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = storage.FindSignatureByIdempotencyKey(ctx, "", "key-device-2", testTime.Add(time.Hour))
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = storage.FindSignatureByIdempotencyKey(ctx, "", "unknown", testTime)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				record, err := tx.FindSignatureByIdempotencyKey("key-device-1", testTime)
+				assert.NoError(t, err)
+				assert.Equal(t, int32(0), record.Counter)
+				_, err = tx.FindSignatureByIdempotencyKey("key-device-2", testTime)
+				assert.ErrorIs(t, err, ErrNotFound)
+				return nil
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestStorageFindSignatureByIdempotencyKeyReusedOnAnotherDevice(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+			for i, id := range []string{"device-1", "device-2"} {
+				err := storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+					record := newTestSignature(id, testTime.Add(time.Duration(i)*time.Minute))
+					record.IdempotencyKey = "key"
+					return tx.InsertSignature(record)
+				})
+				assert.NoError(t, err)
+			}
+
+			record, err := storage.FindSignatureByIdempotencyKey(ctx, "", "key", testTime)
+			assert.NoError(t, err)
+			assert.Equal(t, "device-2", record.DeviceID)
+			for _, id := range []string{"device-1", "device-2"} {
+				record, err := storage.FindSignatureByIdempotencyKey(ctx, id, "key", testTime)
+				assert.NoError(t, err)
+				assert.Equal(t, id, record.DeviceID)
+			}
+
+			err = storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				record, err := tx.FindSignatureByIdempotencyKey("key", testTime)
+				assert.NoError(t, err)
+				assert.Equal(t, "device-1", record.DeviceID)
+				return nil
+			})
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDeviceStoragePrunesIdempotencyKeys(t *testing.T) {
+	storage := NewSignatureDeviceStorage()
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+	signWithKey := func(id string, key string, createdAt time.Time) {
+		err := storage.WithDeviceTx(ctx, id, func(tx DeviceTx) error {
+			record := newTestSignature(key, createdAt)
+			record.IdempotencyKey = key
+			return tx.InsertSignature(record)
+		})
+		assert.NoError(t, err)
+	}
+	signWithKey("device-1", "key-1", testTime.Add(2*time.Minute))
+	signWithKey("device-2", "key-2", testTime.Add(time.Minute))
+	signWithKey("device-1", "key-1", testTime.Add(3*time.Minute))
+
+	assert.NoError(t, storage.PruneIdempotencyKeys(ctx, testTime.Add(150*time.Second)))
+	assert.Len(t, storage.idempotencyKeys, 1)
+	assert.Len(t, storage.idempotencyOrder, 1)
+	record, err := storage.FindSignatureByIdempotencyKey(ctx, "", "key-1", testTime)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), record.Counter)
+	_, err = storage.FindSignatureByIdempotencyKey(ctx, "", "key-2", testTime)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, storage.PruneIdempotencyKeys(ctx, testTime.Add(time.Hour)))
+	assert.Empty(t, storage.idempotencyKeys)
+	assert.Empty(t, storage.idempotencyOrder)
+}
+
+func TestStorageListSignatures(t *testing.T) {
+	counter := func(value int32) *int32 {
+		return &value
+	}
+
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			records, err := storage.ListSignatures(ctx, "device-1", domain.SignatureFilter{})
+			assert.NoError(t, err)
+			assert.Empty(t, records)
+
+			for i := 0; i < 5; i++ {
+				createdAt := testTime.Add(time.Duration(i) * time.Hour)
+				assert.NoError(t, signAt(ctx, storage, "device-1", fmt.Sprintf("signature-%d", i), createdAt))
+			}
+
+			records, err = storage.ListSignatures(ctx, "device-1", domain.SignatureFilter{})
+			assert.NoError(t, err)
+			if assert.Len(t, records, 5) {
+				expected := newTestSignature("signature-1", testTime.Add(time.Hour))
+				expected.DeviceID = "device-1"
+				expected.Counter = 1
+				assert.Equal(t, expected, records[1])
+			}
+
+			tests := []struct {
+				name     string
+				filter   domain.SignatureFilter
+				counters []int32
+			}{
+				{"counter range", domain.SignatureFilter{FromCounter: counter(1), ToCounter: counter(3)}, []int32{1, 2, 3}},
+				{"from counter", domain.SignatureFilter{FromCounter: counter(3)}, []int32{3, 4}},
+				{"beyond last counter", domain.SignatureFilter{FromCounter: counter(7)}, []int32{}},
+				{"limit", domain.SignatureFilter{FromCounter: counter(1), Limit: 2}, []int32{1, 2}},
+				{"time window", domain.SignatureFilter{Since: testTime.Add(time.Hour), Until: testTime.Add(3 * time.Hour)}, []int32{1, 2}},
+				{"since", domain.SignatureFilter{Since: testTime.Add(90 * time.Minute)}, []int32{2, 3, 4}},
+				{"counter and time", domain.SignatureFilter{ToCounter: counter(2), Until: testTime.Add(time.Hour)}, []int32{0}},
+			}
+			for _, test := range tests {
+				records, err := storage.ListSignatures(ctx, "device-1", test.filter)
+				assert.NoError(t, err)
+				counters := make([]int32, 0)
+				for _, record := range records {
+					counters = append(counters, record.Counter)
+				}
+				assert.Equal(t, test.counters, counters, test.name)
+			}
+
+			record, err := storage.GetSignature(ctx, "device-1", 1)
+			assert.NoError(t, err)
+			assert.Equal(t, "signature-1", record.Signature)
+			assert.Equal(t, testTime.Add(time.Hour), record.CreatedAt)
+
+			_, err = storage.GetSignature(ctx, "device-1", 5)
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = storage.GetSignature(ctx, "unknown", 0)
+			assert.ErrorIs(t, err, ErrNotFound)
+			_, err = storage.ListSignatures(ctx, "unknown", domain.SignatureFilter{})
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorageDeviceTxReturnsErrorOfUnitOfWork(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+
+			failure := errors.New("signing failed")
+			err := storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				return failure
+			})
+			assert.ErrorIs(t, err, failure)
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(0), stored.SignatureCounter)
+		})
+	}
+}
+
+func TestStorageDeviceTxDiscardsWritesOfFailedUnitOfWork(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+
+			failure := errors.New("unit of work failed")
+			err := storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				assert.NoError(t, tx.InsertSignature(newTestSignature("discarded", testTime)))
+				assert.NoError(t, tx.RotateKey(&domain.KeyRotation{PublicKey: []byte("public-2"), CreatedAt: testTime}))
+				assert.NoError(t, tx.ChangeStatus(&domain.DeviceStatusChange{ToStatus: domain.DeviceStatusDecommissioned, CreatedAt: testTime}))
+				return failure
+			})
+			assert.ErrorIs(t, err, failure)
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(0), stored.SignatureCounter)
+			assert.Equal(t, "", stored.LastSignature)
+			assert.Equal(t, domain.DeviceStatusActive, stored.CurrentStatus())
+			assert.Equal(t, []byte("public"), stored.PublicKey)
+
+			history, err := storage.ListDeviceHistory(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Empty(t, history)
+			keys, err := storage.ListDeviceKeys(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+			_, err = storage.GetSignature(ctx, "device-1", 0)
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestStorageConcurrentDeviceTxNeverReusesCounter(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+
+			const writers = 8
+			var wg sync.WaitGroup
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.NoError(t, sign(ctx, storage, "device-1", "signature"))
+				}()
+			}
+			wg.Wait()
+
+			stored, err := storage.GetSignatureDevice(ctx, "device-1")
+			assert.NoError(t, err)
+			assert.Equal(t, int32(writers), stored.SignatureCounter)
+		})
+	}
+}
+
+func TestStorageDeviceTxRunsDevicesInParallel(t *testing.T) {
+	for name, storage := range storages(t) {
+		t.Run(name, func(t *testing.T) {
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+			assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-2")))
+
+			// The unit of work on the first device only finishes once the second device has signed,
+			// which would never happen if the units of work of all devices were serialized.
+			signed := make(chan error, 1)
+			err := storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+				go func() {
+					signed <- sign(ctx, storage, "device-2", "signature")
+				}()
+				select {
+				case err := <-signed:
+					assert.NoError(t, err)
+				case <-time.After(5 * time.Second):
+					t.Error("unit of work on another device was blocked")
+				}
+				return tx.InsertSignature(newTestSignature("signature", testTime))
+			})
+			assert.NoError(t, err)
+
+			for _, id := range []string{"device-1", "device-2"} {
+				stored, err := storage.GetSignatureDevice(ctx, id)
+				assert.NoError(t, err)
+				assert.Equal(t, int32(1), stored.SignatureCounter)
+			}
+		})
+	}
+}
+
+func TestSQLStorageDeviceTxRollsBack(t *testing.T) {
+	storage := newSQLiteTestStorage(t)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+
+	failure := errors.New("unit of work failed")
+	err := storage.WithDeviceTx(ctx, "device-1", func(tx DeviceTx) error {
+		assert.NoError(t, tx.InsertSignature(newTestSignature("discarded", testTime)))
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+
+	stored, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), stored.SignatureCounter)
+	assert.Equal(t, "", stored.LastSignature)
+
+	var signatures int
+	assert.NoError(t, storage.db.QueryRow(`SELECT COUNT(*) FROM signatures`).Scan(&signatures))
+	assert.Equal(t, 0, signatures)
+}
+
+func TestSQLiteStorageSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	storage, err := OpenSQLiteStorage(path)
+	assert.NoError(t, err)
+	assert.NoError(t, storage.CreateSignatureDevice(ctx, newTestDevice("device-1")))
+	assert.NoError(t, sign(ctx, storage, "device-1", "first"))
+	assert.NoError(t, storage.Close())
+
+	// Reopening runs the migrations again, which must be a no-op.
+	storage, err = OpenSQLiteStorage(path)
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	stored, err := storage.GetSignatureDevice(ctx, "device-1")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), stored.SignatureCounter)
+
+	var version int
+	assert.NoError(t, storage.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version))
+	assert.Equal(t, migrations[len(migrations)-1].version, version)
+}